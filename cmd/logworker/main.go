@@ -0,0 +1,107 @@
+// Command logworker mirrors one Pub/Sub subscription into a local message log for the Splunk forwarder.
+//
+// Usage:
+//
+//	logworker -config /etc/logworker/sub.json [-dry-run] [-log-level debug|info|warn|error] [-metrics-addr :9100] [-max-messages n]
+//
+//	logworker -config /etc/logworker/sub.json -seek-to 2020-01-02T03:04:05Z
+//
+// -config is a json or yaml file, - for json on stdin, or an http(s) URL fetched at startup. Flags take precedence over
+// the config. The worker restarts its receive cycle every maxwaitmin minutes and stops cleanly on SIGINT or SIGTERM,
+// flushing the batch it holds. It exits 2 on a config error and 1 on any other fatal error, e.g. credentials pub/sub
+// does not accept.
+//
+// -seek-to resets the subscription to an RFC 3339 time, to replay what was published since, and exits without
+// consuming. The replay comes in with the next normal run.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jyang49/logworker_gcp/consumers"
+	"golang.org/x/net/context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configfile := flag.String("config", "", "json or yaml config file, - for stdin or an http(s) URL")
+	dryRun := flag.Bool("dry-run", false, "log a sample of each batch and nack it instead of writing, see workerinfo.dry_run")
+	logLevel := flag.String("log-level", "", "worker log level, debug, info, warn or error, overrides workerinfo.log_level")
+	metricsAddr := flag.String("metrics-addr", "", "serve prometheus metrics on this address, overrides workerinfo.metrics_addr")
+	maxMessages := flag.Int("max-messages", 0, "stop after this many messages, for backfills, overrides workerinfo.max_messages")
+	seekTo := flag.String("seek-to", "", "seek the subscription to this RFC 3339 time and exit, replays what was published since")
+	flag.Parse()
+
+	if *configfile == "" {
+		fatal(2, errors.New("-config is required"))
+	}
+	var seek time.Time
+	if *seekTo != "" {
+		var err error
+		if seek, err = time.Parse(time.RFC3339, *seekTo); err != nil {
+			fatal(2, fmt.Errorf("-seek-to %q must be an RFC 3339 time like 2020-01-02T03:04:05Z", *seekTo))
+		}
+	}
+
+	gcpinfo, err := consumers.NewGCPclientWithOverrides(*configfile, func(gcpinfo *consumers.GCPInfo) {
+		if *dryRun {
+			gcpinfo.Worker.Dry_run = true
+		}
+		if *metricsAddr != "" {
+			gcpinfo.Worker.Metrics_addr = *metricsAddr
+		}
+		if *logLevel != "" {
+			gcpinfo.Worker.Log_level = *logLevel
+		}
+		if *maxMessages != 0 {
+			gcpinfo.Worker.Max_messages = *maxMessages
+		}
+	})
+	if err != nil {
+		fatal(exitCode(err), err)
+	}
+
+	if *seekTo != "" {
+		err = gcpinfo.Seek(context.Background(), seek)
+		if cerr := gcpinfo.Shutdown(context.Background()); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fatal(exitCode(err), err)
+		}
+		return
+	}
+
+	//Run shuts the worker down once ctx is cancelled, the receive cycle handles a signal on its own but the restart
+	//backoff between cycles does not
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if err = gcpinfo.Run(ctx); err != nil {
+		fatal(exitCode(err), err)
+	}
+}
+
+//exitCode is 2 for errors that will not go away until the config is fixed and 1 for the rest.
+
+func exitCode(err error) int {
+	if errors.Is(err, consumers.ErrConfigRead) || errors.Is(err, consumers.ErrConfigParse) || errors.Is(err, consumers.ErrConfigInvalid) {
+		return 2
+	}
+	return 1
+}
+
+func fatal(code int, err error) {
+	fmt.Fprintln(os.Stderr, "logworker:", err)
+	os.Exit(code)
+}
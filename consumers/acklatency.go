@@ -0,0 +1,63 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"fmt"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// DefaultAckDeadline is the ack deadline of a subscription created without one, what ack_latency_warning measures
+// against when the deadline of the subscription is not known.
+const DefaultAckDeadline = 10 * time.Second
+
+//checkAckWarning checks workerinfo.ack_latency_warning, a fraction of the ack deadline.
+
+func (worker *WorkerInfo) checkAckWarning() error {
+	if w := worker.Ack_warning; w < 0 || w > 1 {
+		return fmt.Errorf("ERROR: config field workerinfo.ack_latency_warning is %v, it must be a fraction of the ack deadline between 0 and 1", w)
+	}
+	return nil
+}
+
+//noteAckDeadline remembers the ack deadline of the subscription for ack_latency_warning, applyAckDeadline does it when
+//ack_deadline_seconds is set.
+
+func (gcpinfo *GCPInfo) noteAckDeadline(ctx context.Context, sub *pubsub.Subscription) error {
+	config, err := gcpinfo.subscriptionConfig(ctx, sub)
+	if err != nil {
+		return err
+	}
+	gcpinfo.deadline.Store(int64(config.AckDeadline))
+	return nil
+}
+
+//observeAck records how long a batch waited between its first message coming in, received, and its acks. That is the
+//longest any message of the batch was held, it goes into MaxAckLatency. With ack_latency_warning a batch held past that
+//fraction of the ack deadline is warned about: the client extends the deadline of held messages, but a flush that
+//takes that long is where redeliveries start when an extension comes late.
+
+func (gcpinfo *GCPInfo) observeAck(received time.Time, msgs int) {
+	if received.IsZero() || msgs == 0 {
+		return
+	}
+	latency := time.Since(received)
+	for {
+		seen := gcpinfo.counts.maxAckLatency.Load()
+		if int64(latency) <= seen || gcpinfo.counts.maxAckLatency.CompareAndSwap(seen, int64(latency)) {
+			break
+		}
+	}
+
+	w := gcpinfo.Worker.Ack_warning
+	if w == 0 {
+		return
+	}
+	deadline := time.Duration(gcpinfo.deadline.Load())
+	if deadline == 0 {
+		deadline = DefaultAckDeadline
+	}
+	if latency > time.Duration(float64(deadline)*w) {
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING: a batch of", msgs, "messages was acked", latency.Round(time.Millisecond), "after its first message came in, over", w, "of the ack deadline", deadline, "lower batchsize or set flush_interval")
+	}
+}
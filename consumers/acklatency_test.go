@@ -0,0 +1,60 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlushWarnsAboutAckLatency(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	var errlog bytes.Buffer
+	gcpinfo.Worker.Worker_logger_error = log.New(&errlog, "", 0)
+	gcpinfo.Worker.Ack_warning = 0.5
+	gcpinfo.deadline.Store(int64(time.Second))
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a batch held for a quarter of the deadline is fine
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	gcpinfo.firstAt = time.Now().Add(-250 * time.Millisecond)
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if errlog.Len() != 0 {
+		t.Errorf("expected no warning under half the deadline, got %q", errlog.String())
+	}
+	if l := gcpinfo.Stats().MaxAckLatency; l < 250*time.Millisecond || l > time.Second {
+		t.Errorf("expected a max ack latency of about 250ms, got %s", l)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "2", Data: []byte("two")})
+	gcpinfo.firstAt = time.Now().Add(-800 * time.Millisecond)
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errlog.String(), "WARNING: a batch of 1 messages was acked") {
+		t.Errorf("expected a warning past half the deadline, got %q", errlog.String())
+	}
+	if l := gcpinfo.Stats().MaxAckLatency; l < 800*time.Millisecond {
+		t.Errorf("expected the max ack latency to go up to 800ms, got %s", l)
+	}
+}
+
+func TestCheckAckWarning(t *testing.T) {
+	for _, w := range []float64{-0.1, 1.5} {
+		worker := WorkerInfo{Ack_warning: w}
+		if err := worker.checkAckWarning(); err == nil {
+			t.Errorf("expected ack_latency_warning %v to be rejected", w)
+		}
+	}
+}
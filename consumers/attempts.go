@@ -0,0 +1,41 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"github.com/jyang49/logworker_gcp/metrics"
+)
+
+// AttemptBuckets are the upper bounds of Stats.DeliveryAttempts, in the same order. A message whose delivery attempt is
+// past the last bound is counted in one more bucket at the end.
+var AttemptBuckets = [...]int{1, 2, 3, 5, 10, 20, 50, 100}
+
+//recordAttempt counts the delivery attempt of a received message and warns once it reaches delivery_attempt_warning,
+//a message that keeps coming back is either poison or held past its ack deadline. DeliveryAttempt is only set on
+//subscriptions with a dead-letter policy, messages without it are not counted.
+
+func (gcpinfo *GCPInfo) recordAttempt(msg *pubsub.Message) {
+	if msg.DeliveryAttempt == nil {
+		return
+	}
+	attempt := *msg.DeliveryAttempt
+	metrics.DeliveryAttempts.Observe(gcpinfo.Subscription, float64(attempt))
+
+	bucket := len(AttemptBuckets)
+	for i, bound := range AttemptBuckets {
+		if attempt <= bound {
+			bucket = i
+			break
+		}
+	}
+	gcpinfo.counts.attempts[bucket].Add(1)
+	for {
+		seen := gcpinfo.counts.maxAttempt.Load()
+		if int64(attempt) <= seen || gcpinfo.counts.maxAttempt.CompareAndSwap(seen, int64(attempt)) {
+			break
+		}
+	}
+
+	if w := gcpinfo.Worker.Attempt_warning; w > 0 && attempt >= w {
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING:", messageID(msg), "is on delivery attempt", attempt, "check for a poison message or an ack deadline shorter than a flush")
+	}
+}
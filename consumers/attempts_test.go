@@ -0,0 +1,45 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReceiveRecordsDeliveryAttempts(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	var logged bytes.Buffer
+	gcpinfo.Worker.Worker_logger_error = log.New(&logged, "ERROR: ", 0)
+	gcpinfo.Worker.Attempt_warning = 5
+
+	attempt := func(n int) *int { return &n }
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one"), DeliveryAttempt: attempt(1)},
+		{ID: "2", Data: []byte("two"), DeliveryAttempt: attempt(4)},
+		{ID: "3", Data: []byte("three"), DeliveryAttempt: attempt(500)},
+		{ID: "4", Data: []byte("four")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := gcpinfo.Stats()
+	want := []uint64{1, 0, 0, 1, 0, 0, 0, 0, 1}
+	if !reflect.DeepEqual(stats.DeliveryAttempts, want) {
+		t.Errorf("expected buckets %v, got %v", want, stats.DeliveryAttempts)
+	}
+	if stats.MaxDeliveryAttempt != 500 {
+		t.Errorf("expected max delivery attempt 500, got %d", stats.MaxDeliveryAttempt)
+	}
+	if n := strings.Count(logged.String(), "WARNING"); n != 1 || !strings.Contains(logged.String(), "3") {
+		t.Errorf("expected one warning for message 3, got %q", logged.String())
+	}
+}
@@ -0,0 +1,86 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Range pub/sub allows for ack_deadline_seconds.
+const (
+	MinAckDeadline = 10
+	MaxAckDeadline = 600
+)
+
+//checkAckDeadline checks ack_deadline_seconds, 0 leaves the ack deadline to pub/sub.
+
+func checkAckDeadline(seconds int) error {
+	if seconds != 0 && (seconds < MinAckDeadline || seconds > MaxAckDeadline) {
+		return fmt.Errorf("ERROR: config field ack_deadline_seconds %d must be between %d and %d", seconds, MinAckDeadline, MaxAckDeadline)
+	}
+	return nil
+}
+
+//ensureSubscription creates the subscription on topic when it does not exist yet, for auto_create_subscription, see
+//newSubscriptionConfig. Another worker creating it at the same time is fine, AlreadyExists counts as created.
+
+func (gcpinfo *GCPInfo) ensureSubscription(ctx context.Context, client *pubsub.Client, sub *pubsub.Subscription) error {
+	var found bool
+	err := gcpinfo.retry(ctx, "check the subscription", func() (err error) {
+		found, err = sub.Exists(ctx)
+		return err
+	})
+	if err != nil {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to check subscription %q in project %q. Does the user have view permissions", gcpinfo.Subscription, gcpinfo.Project), err)
+	}
+	if found {
+		return nil
+	}
+
+	topic := client.Topic(gcpinfo.Topic)
+	if err = gcpinfo.checkExists(ctx, "topic", gcpinfo.Topic, topic.Exists); err != nil {
+		return err
+	}
+	config := gcpinfo.newSubscriptionConfig(topic)
+	gcpinfo.Worker.Worker_logger_error.Println("WARNING: subscription", gcpinfo.Subscription, "not found, creating it on topic", gcpinfo.Topic, "as auto_create_subscription is set")
+	err = gcpinfo.retry(ctx, "create the subscription", func() error {
+		_, err := client.CreateSubscription(ctx, gcpinfo.Subscription, config)
+		return err
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to create subscription %q on topic %q in project %q. Does the user have edit permissions", gcpinfo.Subscription, gcpinfo.Topic, gcpinfo.Project), err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("Created subscription", gcpinfo.Subscription, "on topic", gcpinfo.Topic)
+	return nil
+}
+
+//applyAckDeadline logs the ack deadline the subscription has, after setting it to ack_deadline_seconds first when
+//update_ack_deadline is set. Without it an existing subscription keeps its own, which is warned about when it differs.
+
+func (gcpinfo *GCPInfo) applyAckDeadline(ctx context.Context, sub *pubsub.Subscription) error {
+	config, err := gcpinfo.subscriptionConfig(ctx, sub)
+	if err != nil {
+		return err
+	}
+	want := time.Duration(gcpinfo.Ack_deadline) * time.Second
+	if config.AckDeadline != want {
+		if !gcpinfo.Update_ack {
+			gcpinfo.Worker.Worker_logger_error.Println("WARNING: subscription", gcpinfo.Subscription, "has an ack deadline of", config.AckDeadline, "not ack_deadline_seconds", want, "set update_ack_deadline to change it")
+		} else {
+			gcpinfo.Worker.Worker_logger_info.Println("Changing the ack deadline of subscription", gcpinfo.Subscription, "from", config.AckDeadline, "to", want)
+			err = gcpinfo.retry(ctx, "update the subscription", func() (err error) {
+				config, err = sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{AckDeadline: want})
+				return err
+			})
+			if err != nil {
+				return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to update the ack deadline of subscription %q in project %q. Does the user have edit permissions", gcpinfo.Subscription, gcpinfo.Project), err)
+			}
+		}
+	}
+	gcpinfo.deadline.Store(int64(config.AckDeadline))
+	gcpinfo.Worker.Worker_logger_info.Println("Subscription", gcpinfo.Subscription, "has an ack deadline of", config.AckDeadline)
+	return nil
+}
@@ -0,0 +1,52 @@
+package consumers
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewGCPclientRejectsAutoCreateWithoutTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","auto_create_subscription":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "topic is required with auto_create_subscription") {
+		t.Errorf("expected an error for auto_create_subscription without a topic, got %v", err)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"project":"p","topic":"t","subscription":"s","auto_create_subscription":true,"ack_deadline_seconds":5,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "ack_deadline_seconds") {
+		t.Errorf("expected an error naming ack_deadline_seconds, got %v", err)
+	}
+}
+
+func TestCheckAckDeadline(t *testing.T) {
+	for _, seconds := range []int{0, MinAckDeadline, 60, MaxAckDeadline} {
+		if err := checkAckDeadline(seconds); err != nil {
+			t.Errorf("expected %d to be a valid ack deadline, got %v", seconds, err)
+		}
+	}
+	for _, seconds := range []int{-1, MinAckDeadline - 1, MaxAckDeadline + 1} {
+		if err := checkAckDeadline(seconds); err == nil {
+			t.Errorf("expected %d to be rejected", seconds)
+		}
+	}
+}
+
+func TestNewGCPclientRejectsUpdateAckDeadlineWithoutDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","update_ack_deadline":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "update_ack_deadline needs ack_deadline_seconds") {
+		t.Errorf("expected an error for update_ack_deadline without ack_deadline_seconds, got %v", err)
+	}
+}
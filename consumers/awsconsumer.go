@@ -0,0 +1,506 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/jyang49/logworker_gcp/metrics"
+	"golang.org/x/net/context"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//SQS hands out at most 10 messages per receive and takes at most 10 entries per batch delete.
+
+const sqsMaxMessages = 10
+
+//sqsWaitSeconds is the long poll of each receive, the SQS maximum.
+
+const sqsWaitSeconds = 20
+
+// AWSInfo is the SQS counterpart of GCPInfo. It takes the same workerinfo, batches messages from the queue into the
+// same kind of message log and deletes them from the queue, the SQS ack, only once their batch is flushed. A batch
+// that fails to flush is made visible again straight away, the SQS nack.
+type AWSInfo struct {
+	Queue_url        string     `json:"queue_url" yaml:"queue_url"`
+	Region           string     `json:"region" yaml:"region"`
+	Credentials_file string     `json:"credentials_file,omitempty" yaml:"credentials_file,omitempty"` //shared credentials file, the default credential chain when empty
+	Profile          string     `json:"profile,omitempty" yaml:"profile,omitempty"`                   //profile in credentials_file, "default" when empty
+	Endpoint         string     `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`                 //SQS endpoint override, e.g. for localstack
+	Worker           WorkerInfo `json:"workerinfo" yaml:"workerinfo"`
+	batchWriter                 //batch, sink and the shutdown state below are only touched holding mu
+	batch            []*sqs.Message
+	cancel           context.CancelFunc //stops the running Consume
+	done             chan struct{}      //closed once Consume has flushed its tail
+	stopping         bool               //set by Shutdown so a Consume that has not started yet exits straight away
+	sqs              sqsiface.SQSAPI
+	workerlog        *lumberjack.Logger
+}
+
+func NewAWSclient(configfile string) (*AWSInfo, error) {
+	awsinfo := &AWSInfo{}
+
+	content, err := readConfig(configfile)
+	if err != nil {
+		return nil, wrap(ErrConfigRead, "ERROR: Unable to read the config "+configfile, err)
+	}
+	if err = unmarshalConfig(configfile, content, awsinfo); err != nil {
+		return nil, wrap(ErrConfigParse, "ERROR: Unable to unmarshal config file "+configfile, err)
+	}
+
+	//fill defaults the same way NewGCPclient does, then check what is left
+	if awsinfo.Worker.Batchsize == 0 {
+		awsinfo.Worker.Batchsize = 3
+	}
+	if awsinfo.Worker.Maxwaitmin == 0 {
+		awsinfo.Worker.Maxwaitmin = 10
+	}
+	awsinfo.Worker.Maxwaittime = time.Duration(awsinfo.Worker.Maxwaitmin) * time.Minute
+	awsinfo.Worker.Flush_every = time.Duration(awsinfo.Worker.Flush_interval) * time.Second
+	if awsinfo.Worker.Output_format == "" {
+		awsinfo.Worker.Output_format = OutputNDJSON
+	}
+
+	if err = awsinfo.validate(); err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
+	}
+
+	awsinfo.workerlog = awsinfo.Worker.openWorkerLog(configfile, awsinfo.queueName())
+	if awsinfo.Worker.Dry_run {
+		awsinfo.Worker.Worker_logger_info.Println("DRY RUN is on: messages are logged and released, nothing is written to", awsinfo.Worker.Message_log_path)
+	}
+
+	if awsinfo.Worker.Sink_type == SinkFIFO {
+		err = createFIFO(awsinfo.Worker.Message_log_path, awsinfo.messageLogName(), 0, 0)
+	} else {
+		err = createMessageLog(awsinfo.Worker.Message_log_path, awsinfo.messageLogName(), 0, 0)
+	}
+	if err != nil {
+		return nil, wrap(ErrFileOpen, "ERROR: Unable to create message log files. Check permissions", err)
+	}
+
+	config := aws.NewConfig().WithRegion(awsinfo.Region)
+	if awsinfo.Credentials_file != "" {
+		config = config.WithCredentials(credentials.NewSharedCredentials(awsinfo.Credentials_file, awsinfo.Profile))
+	}
+	if awsinfo.Endpoint != "" {
+		config = config.WithEndpoint(awsinfo.Endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, wrap(ErrClientCreate, "ERROR: Unable to create an AWS session. Are the credentials valid", err)
+	}
+	awsinfo.sqs = sqs.New(sess)
+
+	awsinfo.batch = make([]*sqs.Message, 0, awsinfo.Worker.Batchsize)
+	return awsinfo, nil
+}
+
+//validate checks the config once defaults are filled, the subset of workerinfo the SQS consumer uses.
+
+func (awsinfo *AWSInfo) validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"queue_url", awsinfo.Queue_url},
+		{"region", awsinfo.Region},
+		{"workerinfo.messagelogpath", awsinfo.Worker.Message_log_path},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("ERROR: config field %s is required", field.name)
+		}
+	}
+
+	if err := awsinfo.Worker.checkWorkerLogPath(); err != nil {
+		return err
+	}
+	if awsinfo.Worker.Batchsize <= 0 || awsinfo.Worker.Batchsize > MaxBatchsize {
+		return fmt.Errorf("ERROR: config field workerinfo.batchsize is %d, it must be between 1 and %d", awsinfo.Worker.Batchsize, MaxBatchsize)
+	}
+	if awsinfo.Worker.Maxwaitmin < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.maxwaitmin is %d, it must be positive", awsinfo.Worker.Maxwaitmin)
+	}
+	if awsinfo.Worker.Flush_interval < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.flush_interval is %d, it must be positive", awsinfo.Worker.Flush_interval)
+	}
+	if awsinfo.Worker.Min_free_disk < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.min_free_disk_bytes is %d, it must be positive", awsinfo.Worker.Min_free_disk)
+	}
+	if awsinfo.Worker.Max_batch_bytes < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_batch_bytes is %d, it must be positive", awsinfo.Worker.Max_batch_bytes)
+	}
+	if b := awsinfo.Worker.Writer_buffer_bytes; b != 0 && (b < MinWriterBuffer || b > MaxWriterBuffer) {
+		return fmt.Errorf("ERROR: config field workerinfo.writer_buffer_bytes is %d, it must be between %d and %d", b, MinWriterBuffer, MaxWriterBuffer)
+	}
+	if err := awsinfo.Worker.checkOutputFormat(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkRotation(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkMeta(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkHEC(); err != nil {
+		return err
+	}
+	//the pub/sub only parts of workerinfo, better refused than silently ignored
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"workerinfo.spool", awsinfo.Worker.Spool != nil},
+		{"workerinfo.max_message_bytes", awsinfo.Worker.Max_message_bytes != 0},
+		{"workerinfo.max_message_action", awsinfo.Worker.Max_message_action != ""},
+		{"workerinfo.ack_latency_warning", awsinfo.Worker.Ack_warning != 0},
+		{"workerinfo.delivery_mode", awsinfo.Worker.Delivery_mode != "" && awsinfo.Worker.Delivery_mode != AtLeastOnce},
+		{"workerinfo.file_name_template", awsinfo.Worker.File_name_template != ""},
+		{"workerinfo.dir_mode", awsinfo.Worker.Dir_mode != ""},
+		{"workerinfo.file_mode", awsinfo.Worker.File_mode != ""},
+		{"workerinfo.dedup_size", awsinfo.Worker.Dedup_size != 0},
+		{"workerinfo.dedup_attribute", awsinfo.Worker.Dedup_attribute != ""},
+		{"workerinfo.deadletter_path", awsinfo.Worker.Deadletter_path != ""},
+		{"workerinfo.deadletter_attempts", awsinfo.Worker.Deadletter_attempts != 0},
+		{"workerinfo.delivery_attempt_warning", awsinfo.Worker.Attempt_warning != 0},
+		{"workerinfo.max_messages_per_second", awsinfo.Worker.Max_rate != 0},
+		{"workerinfo.max_messages", awsinfo.Worker.Max_messages != 0},
+		{"workerinfo.max_outstanding_messages", awsinfo.Worker.Max_outstanding != 0},
+		{"workerinfo.num_goroutines", awsinfo.Worker.Num_goroutines != 0},
+		{"workerinfo.max_extension", awsinfo.Worker.Max_extension != ""},
+		{"workerinfo.connect_attempts", awsinfo.Worker.Connect_attempts != 0},
+		{"workerinfo.timestamp_format", awsinfo.Worker.Timestamp_format != ""},
+		{"workerinfo.heartbeat_interval", awsinfo.Worker.Heartbeat_interval != 0},
+		{"workerinfo.metrics_addr", awsinfo.Worker.Metrics_addr != ""},
+		{"workerinfo.health_addr", awsinfo.Worker.Health_addr != ""},
+		{"workerinfo.async_ack", awsinfo.Worker.Async_ack},
+	}
+	for _, field := range unsupported {
+		if field.set {
+			return fmt.Errorf("ERROR: config field %s is not supported for SQS", field.name)
+		}
+	}
+	if awsinfo.Worker.Manual_pull {
+		return errors.New("ERROR: config field workerinfo.manual_pull is not supported for SQS, it always pulls one batch at a time")
+	}
+	if err := awsinfo.Worker.checkLogLevel(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkWorkerLogRotation(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkMaxWaitJitter(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkOpenRetry(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkSinkType(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkTee(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkOutputExtension(); err != nil {
+		return err
+	}
+	if err := awsinfo.Worker.checkLines(); err != nil {
+		return err
+	}
+
+	if err := checkWritable(awsinfo.Worker.Message_log_path, 0744); err != nil {
+		return fmt.Errorf("ERROR: config field workerinfo.messagelogpath %q is not writable: %v", awsinfo.Worker.Message_log_path, err)
+	}
+	return nil
+}
+
+//queueName is the last part of the queue URL, it stands in for the subscription in file names and metrics.
+
+func (awsinfo *AWSInfo) queueName() string {
+	return path.Base(awsinfo.Queue_url)
+}
+
+func (awsinfo *AWSInfo) messageLogName() string {
+	name := awsinfo.queueName() + awsinfo.Worker.outputExtension()
+	if awsinfo.Worker.Compress_messages {
+		return name + ".gz"
+	}
+	return name
+}
+
+// Consume polls the queue into the message log until the max wait time expires or ctx is cancelled, the same cycle as
+// GCPInfo.Consume.
+func (awsinfo *AWSInfo) Consume(ctx context.Context) error {
+	return awsinfo.consume(ctx)
+}
+
+func (awsinfo *AWSInfo) consume(ctx context.Context) error {
+	awsinfo.Worker.Worker_logger_info.Println("Starting SQS Receiver for", awsinfo.Queue_url)
+
+	cctx, cancel := context.WithTimeout(ctx, awsinfo.Worker.cycleTimeout())
+	defer cancel()
+
+	awsinfo.mu.Lock()
+	if awsinfo.stopping {
+		awsinfo.mu.Unlock()
+		return nil
+	}
+	if err := awsinfo.lockLog(&awsinfo.Worker, awsinfo.queueName()); err != nil {
+		awsinfo.mu.Unlock()
+		return err
+	}
+	if err := awsinfo.openRetrying(ctx, &awsinfo.Worker, awsinfo.messageLogName(), &awsinfo.stopping); err != nil || awsinfo.stopping {
+		awsinfo.mu.Unlock()
+		return err
+	}
+	awsinfo.cancel = cancel
+	awsinfo.done = make(chan struct{})
+	defer close(awsinfo.done)
+	awsinfo.mu.Unlock()
+
+	//stop cleanly on SIGINT/SIGTERM instead of losing the in-memory batch
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			awsinfo.Worker.Worker_logger_info.Println("Received", sig, "shutting down SQS Receiver")
+			awsinfo.Shutdown(context.Background())
+		case <-cctx.Done():
+		}
+	}()
+
+	//under low traffic a batch can take a long time to fill, flush it on a timer as well
+	var flushers sync.WaitGroup
+	if awsinfo.Worker.Flush_every > 0 {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			awsinfo.flushEvery(cctx, &awsinfo.Worker, awsinfo.flush, nil)
+		}()
+	}
+
+	var err error
+	for cctx.Err() == nil {
+		var out *sqs.ReceiveMessageOutput
+		out, err = awsinfo.sqs.ReceiveMessageWithContext(cctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(awsinfo.Queue_url),
+			MaxNumberOfMessages:   aws.Int64(sqsMaxMessages),
+			WaitTimeSeconds:       aws.Int64(sqsWaitSeconds),
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		if err != nil {
+			if cctx.Err() != nil {
+				//the cycle ended in the middle of a long poll
+				err = nil
+			}
+			break
+		}
+
+		awsinfo.mu.Lock()
+		for _, msg := range out.Messages {
+			metrics.MessagesReceived.Inc(awsinfo.queueName())
+			awsinfo.batch = append(awsinfo.batch, msg)
+			if awsinfo.add(&awsinfo.Worker, len(awsinfo.batch), len(aws.StringValue(msg.Body))) {
+				if ferr := awsinfo.flush(); ferr != nil {
+					awsinfo.Worker.Worker_logger_error.Println(ferr)
+				}
+			}
+		}
+		awsinfo.mu.Unlock()
+	}
+
+	//stop the timed flushes before the tail is flushed under them
+	cancel()
+	flushers.Wait()
+
+	//flush the tail, otherwise it comes back once its visibility timeout runs out
+	awsinfo.mu.Lock()
+	if ferr := awsinfo.flush(); ferr != nil {
+		awsinfo.Worker.Worker_logger_error.Println(ferr)
+	}
+	awsinfo.mu.Unlock()
+
+	if err != nil {
+		return wrap(ErrReceive, "ERROR: Unable to receive messages from "+awsinfo.Queue_url, err)
+	}
+	awsinfo.Worker.Worker_logger_info.Println("Closing SQS Receiver")
+	return nil
+}
+
+// Flush writes the current batch to the sink and deletes it from the queue. It returns the first write or flush error,
+// the batch is made visible again by then. It is safe to call from any goroutine while Consume runs.
+func (awsinfo *AWSInfo) Flush() error {
+	awsinfo.mu.Lock()
+	defer awsinfo.mu.Unlock()
+	if awsinfo.sink == nil {
+		return nil
+	}
+	return awsinfo.flush()
+}
+
+//flush is Flush for callers already holding awsinfo.mu. Callers that cannot return the error log it.
+
+func (awsinfo *AWSInfo) flush() error {
+	if len(awsinfo.batch) == 0 {
+		return nil
+	}
+	if awsinfo.Worker.Dry_run {
+		awsinfo.flushDryRun()
+		return nil
+	}
+	start := time.Now()
+	queue := awsinfo.queueName()
+
+	err := awsinfo.checkDisk(&awsinfo.Worker)
+	if err == nil {
+		err = awsinfo.reopenIfGone(&awsinfo.Worker, awsinfo.messageLogName())
+	}
+	var written int
+	for _, msg := range awsinfo.batch {
+		if err != nil {
+			break
+		}
+		line := awsinfo.Worker.terminate(awsinfo.Worker.oneLine([]byte(aws.StringValue(msg.Body))))
+		if err = awsinfo.sink.Write(line); err != nil {
+			break
+		}
+		written += len(line)
+	}
+	if err == nil {
+		err = awsinfo.sink.Flush()
+	}
+
+	//delete only once the whole batch made it out of the buffer, otherwise make all of it visible again
+	n := len(awsinfo.batch)
+	if err != nil {
+		awsinfo.release(awsinfo.batch)
+		metrics.MessagesNacked.Add(queue, uint64(len(awsinfo.batch)))
+	} else {
+		awsinfo.delete(awsinfo.batch)
+		metrics.MessagesAcked.Add(queue, uint64(len(awsinfo.batch)))
+		metrics.BytesWritten.Add(queue, uint64(written))
+	}
+	metrics.Flushes.Inc(queue)
+	metrics.FlushDuration.Observe(queue, time.Since(start).Seconds())
+
+	awsinfo.batch = make([]*sqs.Message, 0, awsinfo.Worker.Batchsize)
+	awsinfo.flushed()
+
+	if err != nil {
+		metrics.FlushFailures.Inc(queue)
+		return fmt.Errorf("Unable to write batch of %d messages, released: %w", n, err)
+	}
+	return nil
+}
+
+//flushDryRun is GCPInfo.flushDryRun for SQS, it logs the first few messages of the batch and releases all of it
+//without deleting anything.
+
+func (awsinfo *AWSInfo) flushDryRun() {
+	for i, msg := range awsinfo.batch {
+		if i == dryRunSample {
+			break
+		}
+		line := awsinfo.Worker.oneLine([]byte(aws.StringValue(msg.Body)))
+		awsinfo.Worker.Worker_logger_info.Printf("DRY RUN: would write %s: %s", aws.StringValue(msg.MessageId), line)
+	}
+	awsinfo.release(awsinfo.batch)
+	awsinfo.Worker.Worker_logger_info.Println("DRY RUN: released a batch of", len(awsinfo.batch), "messages")
+	metrics.MessagesNacked.Add(awsinfo.queueName(), uint64(len(awsinfo.batch)))
+
+	awsinfo.batch = make([]*sqs.Message, 0, awsinfo.Worker.Batchsize)
+	awsinfo.flushed()
+}
+
+//delete removes written messages from the queue, sqsMaxMessages at a time. A message that fails to delete is only
+//logged, it comes back after its visibility timeout and is written again.
+
+func (awsinfo *AWSInfo) delete(msgs []*sqs.Message) {
+	for start := 0; start < len(msgs); start += sqsMaxMessages {
+		end := start + sqsMaxMessages
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		input := &sqs.DeleteMessageBatchInput{QueueUrl: aws.String(awsinfo.Queue_url)}
+		for i, msg := range msgs[start:end] {
+			input.Entries = append(input.Entries, &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: msg.ReceiptHandle})
+		}
+
+		out, err := awsinfo.sqs.DeleteMessageBatchWithContext(context.Background(), input)
+		if err != nil {
+			awsinfo.Worker.Worker_logger_error.Println("Unable to delete", len(input.Entries), "written messages, they will be redelivered:", err)
+			continue
+		}
+		for _, failed := range out.Failed {
+			awsinfo.Worker.Worker_logger_error.Println("Unable to delete a written message, it will be redelivered:", aws.StringValue(failed.Message))
+		}
+	}
+}
+
+//release sets the visibility timeout of unwritten messages to 0 so SQS redelivers them now rather than after the
+//timeout.
+
+func (awsinfo *AWSInfo) release(msgs []*sqs.Message) {
+	for start := 0; start < len(msgs); start += sqsMaxMessages {
+		end := start + sqsMaxMessages
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		input := &sqs.ChangeMessageVisibilityBatchInput{QueueUrl: aws.String(awsinfo.Queue_url)}
+		for i, msg := range msgs[start:end] {
+			input.Entries = append(input.Entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: msg.ReceiptHandle, VisibilityTimeout: aws.Int64(0)})
+		}
+
+		if _, err := awsinfo.sqs.ChangeMessageVisibilityBatchWithContext(context.Background(), input); err != nil {
+			awsinfo.Worker.Worker_logger_error.Println("Unable to release", len(input.Entries), "messages, they come back after their visibility timeout:", err)
+		}
+	}
+}
+
+// Close flushes the current batch, closes the sink and the worker log and returns the first error. It is safe to call
+// more than once and without Consume ever running.
+func (awsinfo *AWSInfo) Close() error {
+	err := awsinfo.close(awsinfo.flush)
+	if lerr := closeWorkerLog(awsinfo.workerlog); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Shutdown stops a running Consume, flushes the current batch, closes the message log and releases the lock file. It
+// returns once that is done or when ctx expires, and is safe to call more than once.
+func (awsinfo *AWSInfo) Shutdown(ctx context.Context) error {
+	awsinfo.mu.Lock()
+	awsinfo.stopping = true
+	cancel, done := awsinfo.cancel, awsinfo.done
+	awsinfo.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := awsinfo.Close()
+	awsinfo.mu.Lock()
+	defer awsinfo.mu.Unlock()
+	if uerr := awsinfo.unlockLog(); err == nil {
+		err = uerr
+	}
+	return err
+}
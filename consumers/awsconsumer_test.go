@@ -0,0 +1,201 @@
+package consumers
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeSQS hands out its messages on the first receive and then long polls until the context is done. It records the
+//receipt handles that get deleted or released.
+
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	msgs     []*sqs.Message
+	deleted  []string
+	released []string
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if len(f.msgs) > 0 {
+		n := len(f.msgs)
+		if n > int(aws.Int64Value(in.MaxNumberOfMessages)) {
+			n = int(aws.Int64Value(in.MaxNumberOfMessages))
+		}
+		out := &sqs.ReceiveMessageOutput{Messages: f.msgs[:n]}
+		f.msgs = f.msgs[n:]
+		return out, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakeSQS) DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	for _, e := range in.Entries {
+		f.deleted = append(f.deleted, aws.StringValue(e.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	for _, e := range in.Entries {
+		f.released = append(f.released, aws.StringValue(e.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func sqsMessages(bodies ...string) []*sqs.Message {
+	var msgs []*sqs.Message
+	for i, body := range bodies {
+		msgs = append(msgs, &sqs.Message{MessageId: aws.String(body), ReceiptHandle: aws.String("r" + strconv.Itoa(i)), Body: aws.String(body)})
+	}
+	return msgs
+}
+
+func newTestAWSInfo(t *testing.T, batchsize int, fake *fakeSQS) *AWSInfo {
+	dir, err := ioutil.TempDir("", "awsconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+
+	awsinfo := &AWSInfo{
+		Queue_url: "https://sqs.us-east-1.amazonaws.com/123456789012/AllEvents",
+		Region:    "us-east-1",
+		Worker: WorkerInfo{
+			Message_log_path:    dir,
+			Batchsize:           batchsize,
+			Maxwaittime:         100 * time.Millisecond,
+			Worker_logger_info:  log.New(ioutil.Discard, "INFO: ", 0),
+			Worker_logger_error: log.New(ioutil.Discard, "ERROR: ", 0),
+		},
+		sqs: fake,
+	}
+	if err = createMessageLog(dir, awsinfo.messageLogName(), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return awsinfo
+}
+
+func TestAWSConsumeWritesAndDeletes(t *testing.T) {
+	fake := &fakeSQS{msgs: sqsMessages("one", "two", "three")}
+	awsinfo := newTestAWSInfo(t, 2, fake)
+	defer os.RemoveAll(awsinfo.Worker.Message_log_path)
+
+	if err := awsinfo.Consume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	awsinfo.Close()
+
+	content, err := ioutil.ReadFile(awsinfo.Worker.Message_log_path + "/AllEvents.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "one\ntwo\nthree\n" {
+		t.Errorf("expected all 3 messages in AllEvents.log, got %q", content)
+	}
+	if !reflect.DeepEqual(fake.deleted, []string{"r0", "r1", "r2"}) || len(fake.released) != 0 {
+		t.Errorf("expected every message deleted, got deleted %v released %v", fake.deleted, fake.released)
+	}
+}
+
+func TestAWSFlushReleasesOnWriteFailure(t *testing.T) {
+	fake := &fakeSQS{}
+	awsinfo := newTestAWSInfo(t, 10, fake)
+	defer os.RemoveAll(awsinfo.Worker.Message_log_path)
+
+	awsinfo.sink = failingSink{}
+	awsinfo.batch = sqsMessages("one", "two")
+	if err := awsinfo.Flush(); err == nil {
+		t.Error("expected Flush to return the write error")
+	}
+
+	if len(fake.deleted) != 0 || !reflect.DeepEqual(fake.released, []string{"r0", "r1"}) {
+		t.Errorf("expected the whole batch released and nothing deleted, got deleted %v released %v", fake.deleted, fake.released)
+	}
+}
+
+func TestAWSDryRunNeitherWritesNorDeletes(t *testing.T) {
+	fake := &fakeSQS{msgs: sqsMessages("one", "two", "three")}
+	awsinfo := newTestAWSInfo(t, 2, fake)
+	defer os.RemoveAll(awsinfo.Worker.Message_log_path)
+	awsinfo.Worker.Dry_run = true
+	var out bytes.Buffer
+	awsinfo.Worker.Worker_logger_info = log.New(&out, "INFO: ", 0)
+
+	if err := awsinfo.Consume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	awsinfo.Close()
+
+	if content, _ := ioutil.ReadFile(awsinfo.Worker.Message_log_path + "/AllEvents.log"); len(content) != 0 {
+		t.Errorf("expected nothing written in a dry run, got %q", content)
+	}
+	if len(fake.deleted) != 0 || !reflect.DeepEqual(fake.released, []string{"r0", "r1", "r2"}) {
+		t.Errorf("expected every message released and nothing deleted, got deleted %v released %v", fake.deleted, fake.released)
+	}
+	if !strings.Contains(out.String(), "DRY RUN: would write three: three") {
+		t.Errorf("expected the messages logged, got %q", out.String())
+	}
+}
+
+func TestAWSMessageLogName(t *testing.T) {
+	awsinfo := &AWSInfo{Queue_url: "https://sqs.us-east-1.amazonaws.com/123456789012/AllEvents"}
+	awsinfo.Worker.Output_extension = ".json"
+	if name := awsinfo.messageLogName(); name != "AllEvents.json" {
+		t.Errorf("expected AllEvents.json, got %s", name)
+	}
+	awsinfo.Worker.Compress_messages = true
+	if name := awsinfo.messageLogName(); name != "AllEvents.json.gz" {
+		t.Errorf("expected the compressed log to keep output_extension, got %s", name)
+	}
+}
+
+func TestNewAWSclient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"queue_url":"https://sqs.us-east-1.amazonaws.com/123456789012/AllEvents","region":"us-east-1","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":10}}`)
+	awsinfo, err := NewAWSclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if awsinfo.Worker.Batchsize != 10 || awsinfo.Worker.Maxwaittime != 10*time.Minute || awsinfo.sqs == nil {
+		t.Errorf("unexpected parsed config %+v", awsinfo)
+	}
+	if _, err := os.Stat(dir + "/AllEvents.log"); err != nil {
+		t.Errorf("expected the message log named after the queue: %v", err)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"region":"us-east-1","workerinfo":{"messagelogpath":"`+dir+`"}}`)
+	if _, err := NewAWSclient(configfile); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("expected a missing queue_url to be ErrConfigInvalid, got %v", err)
+	}
+
+	//pub/sub only fields have to be refused rather than ignored
+	configfile = writeTestConfig(t, dir, `{"queue_url":"https://sqs.us-east-1.amazonaws.com/123456789012/AllEvents","region":"us-east-1","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","writer_buffer_bytes":10}}`)
+	if _, err := NewAWSclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "writer_buffer_bytes") {
+		t.Errorf("expected a writer_buffer_bytes below MinWriterBuffer to be refused, got %v", err)
+	}
+
+	for _, field := range []string{`"delivery_mode":"at_most_once"`, `"file_name_template":"{subscription}.log"`, `"dedup_size":10`, `"async_ack":true`} {
+		configfile = writeTestConfig(t, dir, `{"queue_url":"https://sqs.us-east-1.amazonaws.com/123456789012/AllEvents","region":"us-east-1","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`",`+field+`}}`)
+		if _, err := NewAWSclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "not supported for SQS") {
+			t.Errorf("expected %s to be refused for SQS, got %v", field, err)
+		}
+	}
+}
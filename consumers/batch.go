@@ -0,0 +1,135 @@
+package consumers
+
+import (
+	"golang.org/x/net/context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Consumer is what every provider's worker does: run receive cycles into the message log, flush the current batch on
+// demand and stop cleanly. A receive cycle ends after maxwaitmin or as soon as the ctx passed to Consume is cancelled.
+type Consumer interface {
+	Consume(ctx context.Context) error
+	Flush() error
+	Shutdown(ctx context.Context) error
+}
+
+var (
+	_ Consumer = (*GCPInfo)(nil)
+	_ Consumer = (*AWSInfo)(nil)
+)
+
+//batchWriter is the part of a consumer that does not depend on the provider: the lock, the sink with its buffered
+//writer, and the rules for when a batch is due. The consumer embeds it, keeps its own slice of provider messages and
+//passes its flush, which writes them to the sink and acks or nacks them, to the methods that may need to flush.
+
+type batchWriter struct {
+	mu         sync.RWMutex //the batch, the sink and the consumer's shutdown state are only touched holding mu
+	sink       Sink
+	pending    int      //messages in the batch
+	batchBytes int      //payload bytes in the batch
+	lowDisk    bool     //the last checkDisk found the disk below min_free_disk_bytes
+	lock       *os.File //held from the first receive cycle until Shutdown, see lockLog
+}
+
+//open opens the sink unless it is already open. Callers hold mu.
+
+func (w *batchWriter) open(worker *WorkerInfo, name string) error {
+	if w.sink != nil {
+		return nil
+	}
+	sink, err := worker.openSink(name)
+	if err != nil {
+		return err
+	}
+	w.sink = sink
+	return nil
+}
+
+//vanishing is a sink whose file can be removed from under it, by an operator or a logrotate that does not know about
+//the worker. Writes into the unlinked file would still succeed and the batch would be acked into nothing.
+
+type vanishing interface {
+	gone() bool
+}
+
+//reopenIfGone checks, before a batch is written, that the message log the sink writes to still exists. If it was
+//removed the sink is closed and a new one opened on a recreated file, a reopen that failed before is tried again.
+//Callers hold mu.
+
+func (w *batchWriter) reopenIfGone(worker *WorkerInfo, name string) error {
+	if w.sink != nil {
+		sink, ok := w.sink.(vanishing)
+		if !ok || !sink.gone() {
+			return nil
+		}
+		worker.Worker_logger_error.Println("WARNING: message log", name, "was removed, reopening it")
+		if err := w.sink.Close(); err != nil {
+			worker.Worker_logger_error.Println("Unable to close removed message log", name+":", err)
+		}
+		w.sink = nil
+	}
+	return w.open(worker, name)
+}
+
+//add records a message of size payload bytes appended to the batch, which now holds n messages, and reports whether
+//the batch is due, on whichever of batchsize and max_batch_bytes is hit first. The byte limit keeps large payloads
+//from piling up in memory. Callers hold mu.
+
+func (w *batchWriter) add(worker *WorkerInfo, n, size int) bool {
+	w.pending = n
+	w.batchBytes += size
+	return w.pending >= worker.Batchsize || (worker.Max_batch_bytes > 0 && w.batchBytes >= worker.Max_batch_bytes)
+}
+
+//flushed resets the counts once the consumer has flushed its batch. Callers hold mu.
+
+func (w *batchWriter) flushed() {
+	w.pending = 0
+	w.batchBytes = 0
+}
+
+//flushEvery calls flush holding mu every flush_interval until ctx is done and logs what fails. Ticks with an empty
+//batch do nothing. settle, when set, runs after each tick once mu is released.
+
+func (w *batchWriter) flushEvery(ctx context.Context, worker *WorkerInfo, flush func() error, settle func()) {
+	ticker := time.NewTicker(worker.Flush_every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.pending > 0 {
+				if err := flush(); err != nil {
+					worker.Worker_logger_error.Println(err)
+				}
+			}
+			w.mu.Unlock()
+			if settle != nil {
+				settle()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//close flushes the batch and closes the sink, returning the first error of the two. It is safe to call more than once,
+//a later open starts a new sink.
+
+func (w *batchWriter) close(flush func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.sink == nil {
+		return nil
+	}
+	err := flush()
+	if cerr := w.sink.Close(); err == nil {
+		err = cerr
+	}
+	w.sink = nil
+	return err
+}
@@ -0,0 +1,22 @@
+package consumers
+
+import "testing"
+
+func TestBatchWriterAddIsDueOnCountOrBytes(t *testing.T) {
+	worker := &WorkerInfo{Batchsize: 3, Max_batch_bytes: 10}
+	var w batchWriter
+
+	if w.add(worker, 1, 4) || w.add(worker, 2, 4) {
+		t.Fatal("expected the batch not to be due below both limits")
+	}
+	if !w.add(worker, 3, 0) {
+		t.Error("expected the batch to be due at batchsize")
+	}
+	w.flushed()
+	if w.pending != 0 || w.batchBytes != 0 {
+		t.Fatalf("expected flushed to reset the counts, got %d messages and %d bytes", w.pending, w.batchBytes)
+	}
+	if !w.add(worker, 1, 10) {
+		t.Error("expected the batch to be due at max_batch_bytes")
+	}
+}
@@ -0,0 +1,84 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// NewGCPclientWithContext is NewGCPclient that also connects to pub/sub up front, so a bad credential fails at startup
+// rather than on the first Consume. The client is kept for every later Consume and closed by Shutdown.
+func NewGCPclientWithContext(ctx context.Context, configfile string) (*GCPInfo, error) {
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = gcpinfo.pubsubClient(ctx); err != nil {
+		return nil, err
+	}
+	return gcpinfo, nil
+}
+
+// NewGCPclientWithOptions is NewGCPclient with extra options for the pub/sub client, e.g. gRPC dial options or a quota
+// project. They are appended after the credential options, so an option given here wins where both set the same thing.
+func NewGCPclientWithOptions(configfile string, opts ...option.ClientOption) (*GCPInfo, error) {
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		return nil, err
+	}
+	gcpinfo.clientOpts = opts
+	return gcpinfo, nil
+}
+
+// SetClient makes Consume use an existing pub/sub client, e.g. one pointed at the emulator in tests. The caller keeps
+// ownership, Shutdown does not close it.
+func (gcpinfo *GCPInfo) SetClient(client *pubsub.Client) {
+	gcpinfo.mu.Lock()
+	defer gcpinfo.mu.Unlock()
+	gcpinfo.client = client
+	gcpinfo.ownsClient = false
+}
+
+//pubsubClient returns the stored client, creating it with whichever credentials are configured the first time.
+
+func (gcpinfo *GCPInfo) pubsubClient(ctx context.Context) (*pubsub.Client, error) {
+	gcpinfo.mu.RLock()
+	client := gcpinfo.client
+	gcpinfo.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+
+	opts, source := gcpinfo.credentials()
+	gcpinfo.Worker.Worker_logger_info.Println("Using credentials from", source)
+	opts = append(opts, gcpinfo.clientOpts...)
+
+	//pub/sub or the metadata server being briefly away should not kill the worker, so retry on blips
+	err := gcpinfo.retry(ctx, "create a pub/sub client", func() (err error) {
+		client, err = pubsub.NewClient(ctx, gcpinfo.Project, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, wrap(ErrClientCreate, "ERROR: Unable to create a pub/sub client. Are the credentials valid", err)
+	}
+
+	gcpinfo.mu.Lock()
+	gcpinfo.client = client
+	gcpinfo.ownsClient = true
+	gcpinfo.mu.Unlock()
+	return client, nil
+}
+
+//closeClient closes the client if this worker created it.
+
+func (gcpinfo *GCPInfo) closeClient() error {
+	gcpinfo.mu.Lock()
+	defer gcpinfo.mu.Unlock()
+
+	client, owned := gcpinfo.client, gcpinfo.ownsClient
+	gcpinfo.client = nil
+	if client == nil || !owned {
+		return nil
+	}
+	return client.Close()
+}
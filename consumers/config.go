@@ -0,0 +1,77 @@
+package consumers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConfigStdin is the config path that makes NewGCPclient and NewAWSclient read the config from stdin, as json. Besides
+// a file path the config can also be an http:// or https:// URL, fetched once at startup.
+const ConfigStdin = "-"
+
+//configFetchTimeout bounds fetching a config from a URL, a config server that hangs should fail the start, not stall it.
+
+const configFetchTimeout = 30 * time.Second
+
+//stdin is where a ConfigStdin config is read from, tests replace it.
+
+var stdin io.Reader = os.Stdin
+
+//readConfig reads the config from a file, stdin or a URL, whichever configfile names.
+
+func readConfig(configfile string) ([]byte, error) {
+	if configfile == ConfigStdin {
+		return ioutil.ReadAll(stdin)
+	}
+	if isConfigURL(configfile) {
+		return fetchConfig(configfile)
+	}
+	return ioutil.ReadFile(configfile)
+}
+
+func isConfigURL(configfile string) bool {
+	return strings.HasPrefix(configfile, "http://") || strings.HasPrefix(configfile, "https://")
+}
+
+//fetchConfig GETs a config, anything but 200 is an error rather than a config.
+
+func fetchConfig(address string) ([]byte, error) {
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", address, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+//configName is the file name of configfile, the last element of the path of a URL without its query, empty for stdin.
+//It picks the config format and names the worker log.
+
+func configName(configfile string) string {
+	if configfile == ConfigStdin {
+		return ""
+	}
+	if isConfigURL(configfile) {
+		u, err := url.Parse(configfile)
+		if err != nil {
+			return ""
+		}
+		configfile = u.Path
+	}
+	if name := filepath.Base(configfile); name != "." && name != "/" {
+		return name
+	}
+	return ""
+}
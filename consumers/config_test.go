@@ -0,0 +1,61 @@
+package consumers
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewGCPclientReadsConfigFromStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(`{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"` + dir + `","workerlogpath":"` + dir + `"}}`)
+
+	gcpinfo, err := NewGCPclient(ConfigStdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Subscription != "s" || gcpinfo.workerlog.Filename != dir+"/s.log" {
+		t.Errorf("expected subscription s logging to %s/s.log, got %s and %s", dir, gcpinfo.Subscription, gcpinfo.workerlog.Filename)
+	}
+}
+
+func TestNewGCPclientFetchesConfigFromURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configs/sub.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("project: p\nsubscription: s\nworkerinfo:\n  messagelogpath: " + dir + "\n  workerlogpath: " + dir + "\n"))
+	}))
+	defer server.Close()
+
+	gcpinfo, err := NewGCPclient(server.URL + "/configs/sub.yaml?rev=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Subscription != "s" || gcpinfo.workerlog.Filename != dir+"/sub.log" {
+		t.Errorf("expected the yaml config logging to %s/sub.log, got %s and %s", dir, gcpinfo.Subscription, gcpinfo.workerlog.Filename)
+	}
+
+	_, err = NewGCPclient(server.URL + "/configs/missing.json")
+	if !errors.Is(err, ErrConfigRead) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a read error naming the 404, got %v", err)
+	}
+}
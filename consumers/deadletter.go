@@ -0,0 +1,39 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"github.com/jyang49/logworker_gcp/metrics"
+	"os"
+)
+
+//nack hands a failed message back to pub/sub, unless it has already come back Deadletter_attempts times. Then it goes
+//to the dead-letter file and is acked the way delivery_mode acks a written message, so one poison message cannot stall
+//the subscription. DeliveryAttempt is only set on subscriptions with a dead-letter policy, without one every failed
+//message is nacked. Callers hold mu, exactly_once queues the ack for ackQueued.
+
+func (gcpinfo *GCPInfo) nack(msg *pubsub.Message) {
+	if gcpinfo.Worker.Deadletter_path != "" && msg.DeliveryAttempt != nil && *msg.DeliveryAttempt >= gcpinfo.Worker.Deadletter_attempts {
+		err := gcpinfo.deadLetter(msg)
+		if err == nil {
+			gcpinfo.Worker.Worker_logger_error.Println("WARNING: dead-lettered", messageID(msg), "after", *msg.DeliveryAttempt, "delivery attempts")
+			gcpinfo.settle(msg, nil)
+			return
+		}
+		gcpinfo.Worker.Worker_logger_error.Println("Unable to dead-letter", messageID(msg), "nacking:", err)
+	}
+	nackMessage(msg)
+	metrics.MessagesNacked.Inc(gcpinfo.Subscription)
+	gcpinfo.counts.nacked.Add(1)
+}
+
+func (gcpinfo *GCPInfo) deadLetter(msg *pubsub.Message) error {
+	file, err := os.OpenFile(gcpinfo.Worker.Deadletter_path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, orDefault(gcpinfo.Worker.Filemode, 0666))
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write([]byte(string(msg.Data) + "\n")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
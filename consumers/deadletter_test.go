@@ -0,0 +1,66 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFailedFlushDeadLettersPoisonMessages(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Deadletter_path = gcpinfo.Worker.Message_log_path + "/deadletter.log"
+	gcpinfo.Worker.Deadletter_attempts = 3
+
+	first, poison := 1, 3
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "first", Data: []byte("one"), DeliveryAttempt: &first},
+		&pubsub.Message{ID: "poison", Data: []byte("two"), DeliveryAttempt: &poison},
+		&pubsub.Message{ID: "untracked", Data: []byte("three")},
+	)
+	gcpinfo.Flush()
+
+	if len(*acked) != 1 || (*acked)[0] != "poison" {
+		t.Errorf("expected only the poison message acked, got %v", *acked)
+	}
+	if len(*nacked) != 2 {
+		t.Errorf("expected the other two nacked, got %v", *nacked)
+	}
+
+	content, err := ioutil.ReadFile(gcpinfo.Worker.Deadletter_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "two\n" {
+		t.Errorf("expected the poison message in the dead-letter file, got %q", content)
+	}
+}
+
+func TestDeadLetterAckIsConfirmedWithExactlyOnce(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+	ackMessage = func(msg *pubsub.Message) { t.Errorf("expected %s acked with a result, not a plain ack", msg.ID) }
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = ExactlyOnce
+	gcpinfo.Worker.Deadletter_path = gcpinfo.Worker.Message_log_path + "/deadletter.log"
+	gcpinfo.Worker.Deadletter_attempts = 3
+
+	poison := 3
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "poison", Data: []byte("two"), DeliveryAttempt: &poison})
+	gcpinfo.Flush()
+
+	if len(*acked) != 1 || (*acked)[0] != "poison" || len(*nacked) != 0 {
+		t.Errorf("expected the poison message acked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if stats := gcpinfo.Stats(); stats.Acked != 1 || stats.Nacked != 0 {
+		t.Errorf("expected the dead-lettered message counted as acked, got %d acked and %d nacked", stats.Acked, stats.Nacked)
+	}
+}
@@ -0,0 +1,56 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Values for the decompress config field. DecompressGzip gunzips every payload, a payload that is not gzip fails like
+// a corrupt one. DecompressAuto only gunzips payloads that start with the gzip magic bytes and passes the rest through,
+// for subscriptions where only some publishers compress.
+const (
+	DecompressGzip = "gzip"
+	DecompressAuto = "auto"
+)
+
+//gzipMagic starts every gzip stream.
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (gcpinfo *GCPInfo) checkDecompress() error {
+	switch gcpinfo.Decompress {
+	case "", DecompressGzip, DecompressAuto:
+		return nil
+	}
+	return fmt.Errorf("ERROR: config field decompress %q must be %s or %s", gcpinfo.Decompress, DecompressGzip, DecompressAuto)
+}
+
+//decompress replaces the payload of msg with its gunzipped self as the decompress config says, before anything else
+//looks at it. On an error msg is left as it was, the caller nacks it rather than writing compressed bytes. With
+//max_message_bytes and max_message_action truncate or skip no more than one byte over it is unpacked, so a small
+//payload cannot blow up in memory, and the cut payload is oversize in the flush like any other. Nothing of it is kept
+//either way. deadletter keeps the whole message, so there the payload is unpacked in full.
+
+func (gcpinfo *GCPInfo) decompress(msg *pubsub.Message) error {
+	if gcpinfo.Decompress == "" || (gcpinfo.Decompress == DecompressAuto && !bytes.HasPrefix(msg.Data, gzipMagic)) {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.Data))
+	if err != nil {
+		return err
+	}
+	var unpacked io.Reader = r
+	if limit := gcpinfo.Worker.Max_message_bytes; limit > 0 && gcpinfo.Worker.Max_message_action != OversizeDeadLetter {
+		unpacked = io.LimitReader(r, int64(limit)+1)
+	}
+	data, err := ioutil.ReadAll(unpacked)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	return nil
+}
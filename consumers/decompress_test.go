@@ -0,0 +1,101 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"compress/gzip"
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReceiveDecompressesPayloads(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Decompress = DecompressAuto
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: gzipped(t, "one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: append([]byte{0x1f, 0x8b}, "not really gzip"...)},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+		t.Errorf("expected the gunzipped and the plain payload, got %q", lines)
+	}
+	if len(*acked) != 2 || len(*nacked) != 1 || (*nacked)[0] != "3" {
+		t.Errorf("expected the corrupt payload nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestDecompressGzipRejectsPlainPayload(t *testing.T) {
+	gcpinfo := &GCPInfo{Decompress: DecompressGzip}
+	if err := gcpinfo.decompress(&pubsub.Message{Data: []byte("plain")}); err == nil {
+		t.Error("expected a plain payload to fail with decompress gzip")
+	}
+}
+
+func TestDecompressStopsPastMaxMessageBytes(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Decompress = DecompressGzip
+	gcpinfo.Worker.Max_message_bytes = 100
+	gcpinfo.Worker.Max_message_action = OversizeSkip
+
+	bomb := &pubsub.Message{ID: "1", Data: gzipped(t, strings.Repeat("x", 1<<20))}
+	if err := gcpinfo.decompress(bomb); err != nil {
+		t.Fatal(err)
+	}
+	if len(bomb.Data) != 101 {
+		t.Errorf("expected the payload unpacked to one byte over max_message_bytes, got %d bytes", len(bomb.Data))
+	}
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: gzipped(t, strings.Repeat("x", 1<<20))},
+		{ID: "2", Data: gzipped(t, "two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "two" {
+		t.Errorf("expected the oversize payload skipped, got %q", lines)
+	}
+	if len(*acked) != 2 || len(*nacked) != 0 {
+		t.Errorf("expected both acked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestDecompressDeadLettersWholePayload(t *testing.T) {
+	gcpinfo := &GCPInfo{Decompress: DecompressGzip}
+	gcpinfo.Worker.Max_message_bytes = 100
+	gcpinfo.Worker.Max_message_action = OversizeDeadLetter
+
+	big := strings.Repeat("x", 1000)
+	msg := &pubsub.Message{ID: "1", Data: gzipped(t, big)}
+	if err := gcpinfo.decompress(msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != big {
+		t.Errorf("expected the whole payload kept for the dead-letter file, got %d bytes", len(msg.Data))
+	}
+}
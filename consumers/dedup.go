@@ -0,0 +1,118 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"container/list"
+	"errors"
+	"github.com/jyang49/logworker_gcp/metrics"
+)
+
+//seenIDs is a bounded LRU of the dedup keys of messages already written. It only lives as long as the process, so it
+//catches a redelivery of a message in flight, not one that comes back after a restart.
+
+type seenIDs struct {
+	size  int
+	order *list.List //most recently seen first
+	index map[string]*list.Element
+}
+
+func newSeenIDs(size int) *seenIDs {
+	return &seenIDs{size: size, order: list.New(), index: make(map[string]*list.Element, size)}
+}
+
+func (s *seenIDs) contains(key string) bool {
+	e, ok := s.index[key]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok
+}
+
+func (s *seenIDs) add(key string) {
+	if e, ok := s.index[key]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.index[key] = s.order.PushFront(key)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.index, oldest.Value.(string))
+	}
+}
+
+//dedupKey is what duplicates are recognised by, the message ID or the dedup_attribute. Empty means do not dedup.
+
+func (gcpinfo *GCPInfo) dedupKey(msg *pubsub.Message) string {
+	if gcpinfo.seen == nil {
+		return ""
+	}
+	if gcpinfo.Worker.Dedup_attribute != "" {
+		return msg.Attributes[gcpinfo.Worker.Dedup_attribute]
+	}
+	return msg.ID
+}
+
+//batchCopies maps the dedup keys of the batch being flushed to the later copies of the first message with that key.
+//The copies are not written, they are settled with the outcome of the first one so a failed write brings them back too.
+
+type batchCopies map[string][]*pubsub.Message
+
+//errFirstCopyUnwritten is what the copies of a message that never made it to the sink are nacked with.
+
+var errFirstCopyUnwritten = errors.New("the first copy of the message was not written")
+
+//duplicate reports whether msg was written before or already came up in this batch. A message written before is acked
+//straight away, a copy of one in this batch goes into copies until the first one is settled.
+
+func (gcpinfo *GCPInfo) duplicate(msg *pubsub.Message, copies batchCopies) bool {
+	key := gcpinfo.dedupKey(msg)
+	if key == "" {
+		return false
+	}
+	if later, ok := copies[key]; ok {
+		copies[key] = append(later, msg)
+		return true
+	}
+	if !gcpinfo.seen.contains(key) {
+		copies[key] = nil
+		return false
+	}
+	gcpinfo.settle(msg, nil)
+	metrics.MessagesDeduped.Inc(gcpinfo.Subscription)
+	return true
+}
+
+//settle settles the copies of msg the way msg itself was settled, acked when err is nil and nacked otherwise.
+
+func (c batchCopies) settle(gcpinfo *GCPInfo, msg *pubsub.Message, err error) {
+	key := gcpinfo.dedupKey(msg)
+	later := c[key]
+	delete(c, key)
+	for _, dup := range later {
+		gcpinfo.settle(dup, err)
+		if err == nil {
+			metrics.MessagesDeduped.Inc(gcpinfo.Subscription)
+		}
+	}
+}
+
+//release nacks the copies of the messages that never made it to the sink, held back, oversize or not transformed, so
+//they come back with them.
+
+func (c batchCopies) release(gcpinfo *GCPInfo) {
+	for key, later := range c {
+		delete(c, key)
+		for _, dup := range later {
+			gcpinfo.settle(dup, errFirstCopyUnwritten)
+		}
+	}
+}
+
+//written remembers msg once it is safely out, so a redelivery of it is skipped.
+
+func (gcpinfo *GCPInfo) written(msg *pubsub.Message) {
+	if key := gcpinfo.dedupKey(msg); key != "" {
+		gcpinfo.seen.add(key)
+	}
+}
@@ -0,0 +1,102 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSeenIDsEvictsLeastRecent(t *testing.T) {
+	seen := newSeenIDs(2)
+	seen.add("1")
+	seen.add("2")
+	seen.contains("1")
+	seen.add("3")
+
+	if !seen.contains("1") || seen.contains("2") || !seen.contains("3") {
+		t.Errorf("expected 2 evicted as the least recently seen, got %v", seen.index)
+	}
+}
+
+func TestDedupSkipsRedeliveries(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.seen = newSeenIDs(10)
+
+	//1 is redelivered inside its own batch, 2 after its batch was written
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "1", Data: []byte("one")},
+		{ID: "3", Data: []byte("three")},
+		{ID: "2", Data: []byte("two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"one", "two", "three"}) {
+		t.Errorf("expected each message written once, got %q", lines)
+	}
+	if len(*acked) != 5 || len(*nacked) != 0 {
+		t.Errorf("expected the duplicates acked too, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestDedupCopiesFollowTheirBatch(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.seen = newSeenIDs(10)
+
+	//the copy of 1 must not be acked while the write that carries the first 1 fails
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("one")},
+		&pubsub.Message{ID: "2", Data: []byte("two")},
+		&pubsub.Message{ID: "1", Data: []byte("one")},
+	)
+	if err := gcpinfo.Flush(); err == nil {
+		t.Error("expected Flush to return the write error")
+	}
+
+	if len(*acked) != 0 || !reflect.DeepEqual(*nacked, []string{"1", "2", "1"}) {
+		t.Errorf("expected the copy nacked with the batch, got acked %v nacked %v", *acked, *nacked)
+	}
+	if gcpinfo.seen.contains("1") {
+		t.Error("expected an unwritten message not to be remembered")
+	}
+}
+
+func TestDedupSettlesDuplicatesLikeTheirBatch(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+	ackMessage = func(msg *pubsub.Message) { t.Errorf("expected %s acked with a result, not a plain ack", msg.ID) }
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.seen = newSeenIDs(10)
+	gcpinfo.Worker.Delivery_mode = ExactlyOnce
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "1", Data: []byte("one")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*acked) != 4 || len(*nacked) != 0 {
+		t.Errorf("expected every copy acked with a result, got acked %v nacked %v", *acked, *nacked)
+	}
+	if stats := gcpinfo.Stats(); stats.Acked != 4 {
+		t.Errorf("expected the duplicates counted as acked, got %d", stats.Acked)
+	}
+}
@@ -0,0 +1,39 @@
+package consumers
+
+import (
+	"fmt"
+)
+
+//freeBytes is the space left for unprivileged writes on the volume holding path, tests replace it.
+
+var freeBytes = diskFree
+
+//checkDisk returns ErrDiskLow while the volume of messagelogpath has less than min_free_disk_bytes free. The batch is
+//then nacked instead of written, pub/sub keeps the messages and redelivers them, and writing resumes by itself once
+//the forwarder has caught up and space was freed. It logs once when the disk runs low and once when it recovers, a
+//failed check does not stop the writes. Callers hold mu.
+
+func (w *batchWriter) checkDisk(worker *WorkerInfo) error {
+	floor := worker.Min_free_disk
+	if floor <= 0 || worker.HEC != nil {
+		return nil
+	}
+	free, err := freeBytes(worker.Message_log_path)
+	if err != nil {
+		worker.Worker_logger_error.Println("Unable to check free disk space of", worker.Message_log_path+":", err)
+		return nil
+	}
+
+	if free < uint64(floor) {
+		if !w.lowDisk {
+			worker.Worker_logger_error.Println("Free disk space of", worker.Message_log_path, "is", free, "bytes, below min_free_disk_bytes", floor, "nacking batches until space is freed")
+		}
+		w.lowDisk = true
+		return fmt.Errorf("%d bytes free: %w", free, ErrDiskLow)
+	}
+	if w.lowDisk {
+		worker.Worker_logger_info.Println("Free disk space of", worker.Message_log_path, "is", free, "bytes, writing batches again")
+	}
+	w.lowDisk = false
+	return nil
+}
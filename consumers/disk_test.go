@@ -0,0 +1,53 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFlushNacksWhileDiskIsLow(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+	defer func(f func(string) (uint64, error)) { freeBytes = f }(freeBytes)
+	free := uint64(10)
+	freeBytes = func(string) (uint64, error) { return free, nil }
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Min_free_disk = 100
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); !errors.Is(err, ErrDiskLow) {
+		t.Fatalf("expected ErrDiskLow, got %v", err)
+	}
+	if len(*acked) != 0 || len(*nacked) != 1 {
+		t.Fatalf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+
+	free = 1000
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*acked) != 1 || (*acked)[0] != "2" {
+		t.Errorf("expected writing to resume once space was freed, got acked %v", *acked)
+	}
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "two" {
+		t.Errorf("expected only the batch after the recovery in the message log, got %q", lines)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(os.TempDir())
+	if err != nil {
+		t.Skip(err)
+	}
+	if free == 0 {
+		t.Errorf("expected some free space in %s", os.TempDir())
+	}
+}
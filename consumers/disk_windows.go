@@ -0,0 +1,11 @@
+package consumers
+
+import (
+	"errors"
+)
+
+//diskFree is not implemented on windows, min_free_disk_bytes logs the failed check and lets every batch through.
+
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free disk space check is not supported on windows")
+}
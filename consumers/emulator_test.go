@@ -0,0 +1,284 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//TestEmulatorRoundTrip runs the worker against the pub/sub emulator, start one with
+//gcloud beta emulators pubsub start and export PUBSUB_EMULATOR_HOST to run it.
+
+func TestEmulatorRoundTrip(t *testing.T) {
+	host := os.Getenv(EmulatorHostEnv)
+	if host == "" {
+		t.Skip(EmulatorHostEnv + " is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	id := "logworker-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Delete(context.Background())
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Delete(context.Background())
+
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := writeTestConfig(t, dir, `{"project":"`+project+`","subscription":"`+id+`","emulator_host":"`+host+`","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":1}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Shutdown(context.Background())
+
+	want := []string{"one", "two", "three"}
+	for _, data := range want {
+		if _, err = topic.Publish(ctx, &pubsub.Message{Data: []byte(data)}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	got := map[string]bool{}
+	cctx, stop := context.WithCancel(ctx)
+	defer stop()
+	err = gcpinfo.ConsumeFunc(cctx, func(data []byte, attrs map[string]string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got[string(data)] = true
+		if len(got) == len(want) {
+			stop()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range want {
+		if !got[data] {
+			t.Errorf("expected %q from the emulator, got %v", data, got)
+		}
+	}
+}
+
+//TestEmulatorAutoCreateSubscription runs Consume on a subscription that does not exist yet with auto_create_subscription.
+
+func TestEmulatorAutoCreateSubscription(t *testing.T) {
+	host := os.Getenv(EmulatorHostEnv)
+	if host == "" {
+		t.Skip(EmulatorHostEnv + " is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	id := "logworker-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Delete(context.Background())
+	defer topic.Stop()
+	defer client.Subscription(id).Delete(context.Background())
+
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := writeTestConfig(t, dir, `{"project":"`+project+`","topic":"`+id+`","subscription":"`+id+`","auto_create_subscription":true,"ack_deadline_seconds":30,"emulator_host":"`+host+`","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":1}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Shutdown(context.Background())
+
+	cctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		//publish once the subscription is there, messages published before it was created are not delivered to it
+		for {
+			if ok, _ := client.Subscription(id).Exists(cctx); ok {
+				break
+			}
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-cctx.Done():
+				return
+			}
+		}
+		topic.Publish(cctx, &pubsub.Message{Data: []byte("one")})
+	}()
+	var got string
+	err = gcpinfo.ConsumeFunc(cctx, func(data []byte, attrs map[string]string) error {
+		got = string(data)
+		stop()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "one" {
+		t.Errorf("expected the message through the created subscription, got %q", got)
+	}
+	config, err := client.Subscription(id).Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AckDeadline != 30*time.Second {
+		t.Errorf("expected the created subscription to have a 30s ack deadline, got %s", config.AckDeadline)
+	}
+}
+
+//TestEmulatorTailTopic checks tail_topic consumes through a temporary subscription that Shutdown deletes.
+
+func TestEmulatorTailTopic(t *testing.T) {
+	host := os.Getenv(EmulatorHostEnv)
+	if host == "" {
+		t.Skip(EmulatorHostEnv + " is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	id := "logworker-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Delete(context.Background())
+	defer topic.Stop()
+
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := writeTestConfig(t, dir, `{"project":"`+project+`","topic":"`+id+`","tail_topic":true,"emulator_host":"`+host+`","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":1}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := client.Subscription(gcpinfo.Subscription)
+	defer tail.Delete(context.Background())
+
+	cctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		for {
+			if ok, _ := tail.Exists(cctx); ok {
+				break
+			}
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-cctx.Done():
+				return
+			}
+		}
+		topic.Publish(cctx, &pubsub.Message{Data: []byte("one")})
+	}()
+	var got string
+	err = gcpinfo.ConsumeFunc(cctx, func(data []byte, attrs map[string]string) error {
+		got = string(data)
+		stop()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "one" {
+		t.Errorf("expected the message through the temporary subscription, got %q", got)
+	}
+
+	if err = gcpinfo.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tail.Exists(ctx); err != nil || ok {
+		t.Errorf("expected Shutdown to delete temporary subscription %s, exists %v %v", gcpinfo.Subscription, ok, err)
+	}
+}
+
+//TestEmulatorUpdateAckDeadline checks update_ack_deadline sets the deadline of an existing subscription.
+
+func TestEmulatorUpdateAckDeadline(t *testing.T) {
+	host := os.Getenv(EmulatorHostEnv)
+	if host == "" {
+		t.Skip(EmulatorHostEnv + " is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	id := "logworker-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Delete(context.Background())
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Delete(context.Background())
+
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := writeTestConfig(t, dir, `{"project":"`+project+`","subscription":"`+id+`","ack_deadline_seconds":120,"update_ack_deadline":true,"emulator_host":"`+host+`","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Shutdown(context.Background())
+
+	wclient, err := gcpinfo.pubsubClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gcpinfo.applyAckDeadline(ctx, wclient.Subscription(id)); err != nil {
+		t.Fatal(err)
+	}
+	config, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AckDeadline != 120*time.Second {
+		t.Errorf("expected the subscription updated to a 120s ack deadline, got %s", config.AckDeadline)
+	}
+}
@@ -0,0 +1,62 @@
+package consumers
+
+import (
+	"cloud.google.com/go/errorreporting"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"os"
+	"time"
+)
+
+// ErrorReportingService is the service name fatal errors are reported under with error_reporting.
+const ErrorReportingService = "logworker"
+
+// ErrorReportTimeout bounds how long reporting a fatal error may hold up the worker on its way out.
+var ErrorReportTimeout = 10 * time.Second
+
+//errorReporter is the part of *errorreporting.Client reportError uses, tests fake it.
+
+type errorReporter interface {
+	ReportSync(ctx context.Context, entry errorreporting.Entry) error
+	Close() error
+}
+
+// error reporting hook, swapped out in tests like ackMessage.
+var newErrorReporter = func(ctx context.Context, project string, opts ...option.ClientOption) (errorReporter, error) {
+	client, err := errorreporting.NewClient(ctx, project, errorreporting.Config{ServiceName: ErrorReportingService}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+//reportError sends a fatal err to Cloud Error Reporting when error_reporting is set, with the subscription and project
+//in the message so the alert says which worker died. The client is created for the report with the same credentials
+//as pub/sub, a worker reports at most a few errors in its life. Reporting is best effort, a report that fails is only
+//logged, and there is nothing to report to with the emulator.
+
+func (gcpinfo *GCPInfo) reportError(err error) {
+	if !gcpinfo.Report_error || gcpinfo.Project == "" {
+		return
+	}
+	if gcpinfo.Emulator != "" || os.Getenv(EmulatorHostEnv) != "" {
+		return
+	}
+	opts, _ := gcpinfo.credentials()
+	ctx, cancel := context.WithTimeout(context.Background(), ErrorReportTimeout)
+	defer cancel()
+
+	reporter, rerr := newErrorReporter(ctx, gcpinfo.Project, opts...)
+	if rerr == nil {
+		rerr = reporter.ReportSync(ctx, errorreporting.Entry{
+			Error: fmt.Errorf("subscription %q in project %q: %v", gcpinfo.Subscription, gcpinfo.Project, err),
+		})
+		if cerr := reporter.Close(); rerr == nil {
+			rerr = cerr
+		}
+	}
+	if rerr != nil && gcpinfo.Worker.Worker_logger_error != nil {
+		gcpinfo.Worker.Worker_logger_error.Println("Unable to report the error to Cloud Error Reporting:", rerr)
+	}
+}
@@ -0,0 +1,86 @@
+package consumers
+
+import (
+	"cloud.google.com/go/errorreporting"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//fakeReporter records what reportError sends.
+
+type fakeReporter struct {
+	entries []errorreporting.Entry
+	closed  bool
+}
+
+func (r *fakeReporter) ReportSync(ctx context.Context, entry errorreporting.Entry) error {
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+func (r *fakeReporter) Close() error {
+	r.closed = true
+	return nil
+}
+
+func recordReports() (*fakeReporter, func()) {
+	reporter := &fakeReporter{}
+	saved := newErrorReporter
+	newErrorReporter = func(ctx context.Context, project string, opts ...option.ClientOption) (errorReporter, error) {
+		return reporter, nil
+	}
+	return reporter, func() { newErrorReporter = saved }
+}
+
+func TestNewGCPclientReportsFatalError(t *testing.T) {
+	reporter, restore := recordReports()
+	defer restore()
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","error_reporting":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","delivery_mode":"exactly_twice"}}`)
+	if _, err = NewGCPclient(configfile); err == nil {
+		t.Fatal("expected the bad delivery_mode to fail")
+	}
+	if len(reporter.entries) != 1 || !reporter.closed {
+		t.Fatalf("expected one report and the client closed, got %d reports closed %v", len(reporter.entries), reporter.closed)
+	}
+	msg := reporter.entries[0].Error.Error()
+	if !strings.Contains(msg, `subscription "s" in project "p"`) || !strings.Contains(msg, "delivery_mode") {
+		t.Errorf("expected the report to name the subscription, project and error, got %q", msg)
+	}
+
+	//without the flag nothing is reported
+	reporter.entries = nil
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","delivery_mode":"exactly_twice"}}`)
+	if _, err = NewGCPclient(configfile); err == nil {
+		t.Fatal("expected the bad delivery_mode to fail")
+	}
+	if len(reporter.entries) != 0 {
+		t.Errorf("expected no report without error_reporting, got %d", len(reporter.entries))
+	}
+}
+
+func TestConsumeReportsFatalError(t *testing.T) {
+	reporter, restore := recordReports()
+	defer restore()
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Report_error = true
+	gcpinfo.Worker.Message_log_path = gcpinfo.Worker.Message_log_path + "/log/\x00"
+	gcpinfo.receiver = &fakeReceiver{}
+
+	if err := gcpinfo.Consume(context.Background()); err == nil {
+		t.Fatal("expected Consume to fail on a message log it cannot open")
+	}
+	if len(reporter.entries) != 1 {
+		t.Errorf("expected the Consume error reported, got %d reports", len(reporter.entries))
+	}
+}
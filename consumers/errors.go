@@ -0,0 +1,53 @@
+package consumers
+
+import (
+	"errors"
+)
+
+// Sentinel errors for the failures a supervisor may want to tell apart, test for them with errors.Is. Retrying makes
+// sense for ErrClientCreate and ErrReceive, the config errors will not go away until the config is fixed.
+var (
+	ErrConfigRead    = errors.New("config file unreadable")
+	ErrConfigParse   = errors.New("config file could not be parsed")
+	ErrConfigInvalid = errors.New("config is invalid")
+	ErrClientCreate  = errors.New("pub/sub client could not be created")
+	ErrSubscription  = errors.New("subscription or topic is missing or not accessible")
+	ErrFileOpen      = errors.New("file could not be created or opened")
+	ErrReceive       = errors.New("receive from pub/sub failed")
+	ErrDiskLow       = errors.New("free disk space is below workerinfo.min_free_disk_bytes")
+	ErrLocked        = errors.New("another worker holds the lock of the message log")
+	ErrWriteFatal    = errors.New("message log write failed, a redelivery would fail the same way")
+)
+
+//errLockHeld is what lockFile returns when the lock is held, lockLog turns it into ErrLocked.
+
+var errLockHeld = errors.New("lock is held")
+
+// Error is what the package returns for the failures above. Kind is one of the sentinel errors and Err the underlying
+// cause, if any, reachable through errors.Unwrap and errors.As.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+//wrap builds an *Error, err may be nil when there is no cause and msg may be empty when err says it all.
+
+func wrap(kind error, msg string, err error) error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Err == nil:
+		return e.Msg
+	case e.Msg == "":
+		return e.Err.Error()
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the Kind of e, so errors.Is(err, ErrFileOpen) works through any wrapping.
+func (e *Error) Is(target error) bool { return target == e.Kind }
@@ -0,0 +1,63 @@
+package consumers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewGCPclientErrorKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err = NewGCPclient(dir + "/missing.json"); !errors.Is(err, ErrConfigRead) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrConfigRead wrapping the not exist error, got %v", err)
+	}
+
+	if _, err = NewGCPclient(writeTestConfig(t, dir, `{"project":`)); !errors.Is(err, ErrConfigParse) {
+		t.Errorf("expected ErrConfigParse, got %v", err)
+	}
+
+	if _, err = NewGCPclient(writeTestConfig(t, dir, `{"subscription":"s","workerinfo":{"messagelogpath":"`+dir+`"}}`)); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("expected ErrConfigInvalid, got %v", err)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrConfigInvalid {
+		t.Errorf("expected an *Error of kind ErrConfigInvalid, got %#v", err)
+	}
+}
+
+func TestNewFileSinkErrorKind(t *testing.T) {
+	if _, err := NewFileSink("/nonexistent/dir/sub.log"); !errors.Is(err, ErrFileOpen) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrFileOpen wrapping the not exist error, got %v", err)
+	}
+}
+
+func TestNewGCPclientNamesJSONErrorLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"{\n  \"project\": \"p\",\n  \"subscription\" \"s\"\n}", "line 3 column"},
+		{`{"project":"p","workerinfo":{"batchsize":"ten"}}`, "field workerinfo.batchsize"},
+		{`{"project":`, "unexpected end of JSON input"},
+	}
+	for _, test := range tests {
+		_, err := NewGCPclient(writeTestConfig(t, dir, test.config))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.config, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"fmt"
+	"github.com/jyang49/logworker_gcp/metrics"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// AckResultTimeout bounds how long delivery_mode exactly_once waits for pub/sub to confirm the acks of a batch. The
+// client retries a failed ack on its own for a while, an ack still unconfirmed by then is treated as failed.
+var AckResultTimeout = time.Minute
+
+//ackResult is what AckWithResult returns, tests fake it to confirm or fail an ack.
+
+type ackResult interface {
+	Get(ctx context.Context) (pubsub.AcknowledgeStatus, error)
+}
+
+// ack hook of exactly_once, swapped out in tests like ackMessage.
+var ackWithResult = func(msg *pubsub.Message) ackResult { return msg.AckWithResult() }
+
+//ackConfirmed acks msgs on an exactly-once subscription and waits until pub/sub confirmed each of them. The acks are
+//all sent before the first result is waited on, so a batch takes one round trip and not one per message. It runs from
+//ackQueued once mu is released, a slow confirmation holds up nothing but the acks themselves. A message whose ack is
+//not confirmed, e.g. because its ack deadline ran out, cannot be nacked any more, the client ignores a nack after
+//AckWithResult. Pub/sub redelivers it because the ack failed and it is counted as nacked. It is in the message log
+//already, dedup_size keeps the redelivery from being written twice.
+
+func (gcpinfo *GCPInfo) ackConfirmed(msgs []*pubsub.Message) {
+	results := make([]ackResult, len(msgs))
+	for i, msg := range msgs {
+		results[i] = ackWithResult(msg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AckResultTimeout)
+	defer cancel()
+	for i, result := range results {
+		status, err := result.Get(ctx)
+		if err == nil && status != pubsub.AcknowledgeStatusSuccess {
+			err = fmt.Errorf("acknowledge status %d", status)
+		}
+		if err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Pub/sub did not confirm the ack of", messageID(msgs[i]), "it will be redelivered because the ack failed:", err)
+			metrics.MessagesNacked.Inc(gcpinfo.Subscription)
+			gcpinfo.counts.nacked.Add(1)
+			continue
+		}
+		metrics.MessagesAcked.Inc(gcpinfo.Subscription)
+		gcpinfo.counts.acked.Add(1)
+	}
+}
+
+//checkExactlyOnce warns when delivery_mode exactly_once is set on a subscription without exactly-once delivery. Acks
+//are then confirmed at once and nothing is gained, but nothing breaks either.
+
+func (gcpinfo *GCPInfo) checkExactlyOnce(ctx context.Context, sub *pubsub.Subscription) error {
+	config, err := gcpinfo.subscriptionConfig(ctx, sub)
+	if err != nil {
+		return err
+	}
+	if !config.EnableExactlyOnceDelivery {
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING: delivery_mode is exactly_once but subscription", gcpinfo.Subscription, "does not have exactly-once delivery enabled, acks are not confirmed")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"golang.org/x/net/context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFlushExactlyOnceCountsUnconfirmedAck(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+	ackWithResult = func(msg *pubsub.Message) ackResult {
+		*acked = append(*acked, msg.ID)
+		switch msg.ID {
+		case "2":
+			return fakeAckResult{status: pubsub.AcknowledgeStatusInvalidAckID}
+		case "3":
+			return fakeAckResult{err: errors.New("ack deadline exceeded")}
+		}
+		return fakeAckResult{}
+	}
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = ExactlyOnce
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Close()
+	for _, id := range []string{"1", "2", "3"} {
+		gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: id, Data: []byte(id)})
+	}
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*acked, []string{"1", "2", "3"}) {
+		t.Errorf("expected every message acked with a result, got %v", *acked)
+	}
+	if len(*nacked) != 0 {
+		t.Errorf("expected no nack after AckWithResult, pub/sub redelivers on its own, got %v", *nacked)
+	}
+	if stats := gcpinfo.Stats(); stats.Acked != 1 || stats.Nacked != 2 {
+		t.Errorf("expected 1 acked and 2 nacked, got %d and %d", stats.Acked, stats.Nacked)
+	}
+}
+
+func TestFlushExactlyOnceNacksFailedBatchWithoutAcking(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = ExactlyOnce
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err == nil {
+		t.Fatal("expected the flush error")
+	}
+	if len(*acked) != 0 || !reflect.DeepEqual(*nacked, []string{"1"}) {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+//lockedAckResult reports whether gcpinfo.mu was free while its result was waited on.
+
+type lockedAckResult struct {
+	gcpinfo *GCPInfo
+	free    *bool
+}
+
+func (r lockedAckResult) Get(ctx context.Context) (pubsub.AcknowledgeStatus, error) {
+	if r.gcpinfo.mu.TryLock() {
+		r.gcpinfo.mu.Unlock()
+		*r.free = true
+	}
+	return pubsub.AcknowledgeStatusSuccess, nil
+}
+
+func TestFlushExactlyOnceWaitsOutsideTheLock(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = ExactlyOnce
+	var free bool
+	ackWithResult = func(msg *pubsub.Message) ackResult { return lockedAckResult{gcpinfo: gcpinfo, free: &free} }
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Close()
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !free {
+		t.Error("expected the ack result waited on after the batch lock was released")
+	}
+	if stats := gcpinfo.Stats(); stats.Acked != 1 {
+		t.Errorf("expected the message acked by the time Flush returned, got %d", stats.Acked)
+	}
+}
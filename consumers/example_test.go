@@ -0,0 +1,31 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"github.com/jyang49/logworker_gcp/metrics"
+	"golang.org/x/net/context"
+	"log"
+)
+
+//the hooks run holding the batch lock, so they only do cheap work like counting
+
+func ExampleGCPInfo_flushHooks() {
+	batchMessages := metrics.NewCounter("myapp_batch_messages_total", "Messages in the batches the worker flushed.")
+	failedBatches := metrics.NewCounter("myapp_failed_batches_total", "Batches the worker nacked.")
+
+	gcpinfo, err := NewGCPclient("/etc/logworker/sub.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	gcpinfo.BeforeFlush = func(batch []*pubsub.Message) {
+		batchMessages.Add(gcpinfo.Subscription, uint64(len(batch)))
+	}
+	gcpinfo.AfterFlush = func(n int, err error) {
+		if err != nil {
+			failedBatches.Inc(gcpinfo.Subscription)
+		}
+	}
+	if err = gcpinfo.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package consumers
+
+//fakes for driving the consume loop without pub/sub. Set GCPInfo.receiver to one of the receivers and Consume reads
+//from it instead of a subscription, recordAcks captures what happens to each message.
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+//fakeReceiver hands its messages to the callback and then returns, the same way Receive returns once the max wait time expires.
+
+type fakeReceiver struct {
+	msgs []*pubsub.Message
+	//delivered runs after the last callback, before Receive returns
+	delivered func(ctx context.Context)
+	//wait keeps Receive running until its context is done, like the real streaming pull
+	wait bool
+}
+
+func (f *fakeReceiver) Receive(ctx context.Context, cb func(context.Context, *pubsub.Message)) error {
+	for _, msg := range f.msgs {
+		cb(ctx, msg)
+	}
+	if f.delivered != nil {
+		f.delivered(ctx)
+	}
+	if f.wait {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+//concurrentReceiver fires every callback on its own goroutine, the way the streaming pull does.
+
+type concurrentReceiver struct {
+	msgs []*pubsub.Message
+}
+
+func (f *concurrentReceiver) Receive(ctx context.Context, cb func(context.Context, *pubsub.Message)) error {
+	var wg sync.WaitGroup
+	for _, msg := range f.msgs {
+		wg.Add(1)
+		go func(msg *pubsub.Message) {
+			defer wg.Done()
+			cb(ctx, msg)
+		}(msg)
+	}
+	wg.Wait()
+	return nil
+}
+
+//recordAcks swaps the ack/nack hooks for counters. Call the returned func to restore them.
+
+func recordAcks() (acked *[]string, nacked *[]string, restore func()) {
+	acked, nacked = &[]string{}, &[]string{}
+	ackMessage = func(msg *pubsub.Message) { *acked = append(*acked, msg.ID) }
+	nackMessage = func(msg *pubsub.Message) { *nacked = append(*nacked, msg.ID) }
+	ackWithResult = func(msg *pubsub.Message) ackResult {
+		*acked = append(*acked, msg.ID)
+		return fakeAckResult{}
+	}
+	return acked, nacked, func() {
+		ackMessage = (*pubsub.Message).Ack
+		nackMessage = (*pubsub.Message).Nack
+		ackWithResult = func(msg *pubsub.Message) ackResult { return msg.AckWithResult() }
+	}
+}
+
+//fakeAckResult is the result of an exactly_once ack, confirmed unless status or err say otherwise.
+
+type fakeAckResult struct {
+	status pubsub.AcknowledgeStatus
+	err    error
+}
+
+func (r fakeAckResult) Get(ctx context.Context) (pubsub.AcknowledgeStatus, error) {
+	return r.status, r.err
+}
+
+//failingSink accepts writes and fails the flush, like a full disk would.
+
+type failingSink struct{}
+
+func (failingSink) Write(p []byte) error { return nil }
+func (failingSink) Flush() error         { return errors.New("disk on fire") }
+func (failingSink) Close() error         { return nil }
+
+//eventSink records its writes and flushes into events, next to whatever else the test appends there.
+
+type eventSink struct{ events *[]string }
+
+func (s eventSink) Write(p []byte) error { *s.events = append(*s.events, "write"); return nil }
+func (s eventSink) Flush() error         { *s.events = append(*s.events, "flush"); return nil }
+func (s eventSink) Close() error         { return nil }
+
+//unsyncableFile takes writes and fails every fsync, like a disk that has gone read-only.
+
+type unsyncableFile struct{ bytes.Buffer }
+
+func (*unsyncableFile) Sync() error  { return errors.New("read-only file system") }
+func (*unsyncableFile) Close() error { return nil }
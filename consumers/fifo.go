@@ -0,0 +1,153 @@
+package consumers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Sink types for workerinfo.sink_type. SinkFile, the default, appends to the message log file. SinkFIFO writes to a
+// named pipe at the message log path instead, for a forwarder that reads the pipe and keeps the events off the disk.
+const (
+	SinkFile = "file"
+	SinkFIFO = "fifo"
+)
+
+// FIFOWriteTimeout bounds how long a flush waits for the reader of a fifo to take a batch. A reader stalled for longer
+// is treated like one that went away.
+var FIFOWriteTimeout = time.Minute
+
+//errNoReader is what opening a fifo without a reader returns.
+
+var errNoReader = errors.New("no reader has the fifo open")
+
+//checkSinkType checks workerinfo.sink_type. A fifo carries plain lines to one reader, the settings that assume a file
+//on disk, or a sink other than the message log, do not go with it.
+
+func (worker *WorkerInfo) checkSinkType() error {
+	switch worker.Sink_type {
+	case "", SinkFile:
+		return nil
+	case SinkFIFO:
+	default:
+		return fmt.Errorf("ERROR: config field workerinfo.sink_type %q must be %s or %s", worker.Sink_type, SinkFile, SinkFIFO)
+	}
+	conflicts := []struct {
+		name string
+		set  bool
+	}{
+		{"workerinfo.hec", worker.HEC != nil},
+		{"workerinfo.rotation", worker.Rotation != nil},
+		{"workerinfo.compress_messages", worker.Compress_messages},
+		{"workerinfo.fsync_on_flush", worker.Fsync_on_flush},
+		{"workerinfo.write_meta", worker.Write_meta},
+		{"workerinfo.output_format json_array", worker.Output_format == OutputJSONArray},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			return fmt.Errorf("ERROR: config field workerinfo.sink_type fifo does not go with %s", c.name)
+		}
+	}
+	return nil
+}
+
+//createFIFO is createMessageLog for sink_type fifo, it makes a named pipe at logpath/name unless one is there.
+
+func createFIFO(logpath string, name string, dirMode os.FileMode, fileMode os.FileMode) error {
+	if err := os.MkdirAll(logpath, orDefault(dirMode, 0744)); err != nil {
+		return wrap(ErrFileOpen, "Error: Unable to create target log files path", err)
+	}
+	path := logpath + "/" + name
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if err = makeFIFO(path, orDefault(fileMode, 0666)); err != nil {
+			return wrap(ErrFileOpen, "Error: Unable to create target fifo", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return wrap(ErrFileOpen, "Error: Unable to check target fifo", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return wrap(ErrFileOpen, "Error: target "+path+" is not a fifo", nil)
+	}
+	return nil
+}
+
+// FIFOSink writes events to a named pipe. A batch is buffered in memory and written to the pipe on Flush, so a batch
+// is only acked once its reader took it. The pipe is opened without waiting for a reader: while there is none, or
+// after the reader went away or stalled past FIFOWriteTimeout, Flush fails and the batch is nacked, the next Flush
+// opens the pipe again. A batch that failed half way may have reached the old reader in part and is redelivered whole.
+type FIFOSink struct {
+	path   string
+	file   *os.File //nil while not connected to a reader
+	buf    bytes.Buffer
+	closed bool
+}
+
+// NewFIFOSink opens the named pipe at path, which createFIFO made. Having no reader yet is not an error.
+func NewFIFOSink(path string) (*FIFOSink, error) {
+	s := &FIFOSink{path: path}
+	if err := s.connect(); err != nil && err != errNoReader {
+		return nil, wrap(ErrFileOpen, "Unable to Open events output fifo", err)
+	}
+	return s, nil
+}
+
+//connect opens the pipe for writing, errNoReader when nobody reads it.
+
+func (s *FIFOSink) connect() error {
+	file, err := openFIFO(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+func (s *FIFOSink) Write(p []byte) error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.buf.Write(p)
+	return nil
+}
+
+// Flush writes the buffered batch to the reader of the pipe, connecting first if there is none. The buffer is emptied
+// either way, a failed batch is nacked and comes back through pub/sub.
+func (s *FIFOSink) Flush() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	defer s.buf.Reset()
+	if s.file == nil {
+		if err := s.connect(); err != nil {
+			return fmt.Errorf("fifo %s: %v", s.path, err)
+		}
+	}
+	//a pipe without a poller, e.g. on windows, has no deadline and the write waits for the reader
+	s.file.SetWriteDeadline(time.Now().Add(FIFOWriteTimeout))
+	if _, err := s.file.Write(s.buf.Bytes()); err != nil {
+		s.file.Close()
+		s.file = nil
+		return fmt.Errorf("fifo %s lost its reader, reconnecting on the next flush: %v", s.path, err)
+	}
+	return nil
+}
+
+// Close closes the pipe, its reader sees the end of the stream.
+func (s *FIFOSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,124 @@
+//go:build !windows
+
+package consumers
+
+import (
+	"bufio"
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+//openReader opens the read end of the fifo at path without waiting for a writer, as a forwarder would.
+
+func openReader(t *testing.T, path string) (*os.File, *bufio.Reader) {
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, bufio.NewReader(r)
+}
+
+func TestFIFOSinkReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = createFIFO(dir, "sub.log", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/sub.log"
+
+	sink, err := NewFIFOSink(path)
+	if err != nil {
+		t.Fatalf("expected the fifo to open without a reader, got %v", err)
+	}
+	defer sink.Close()
+	sink.Write([]byte("lost\n"))
+	if err = sink.Flush(); err == nil || !strings.Contains(err.Error(), errNoReader.Error()) {
+		t.Fatalf("expected a flush without a reader to fail, got %v", err)
+	}
+
+	r, lines := openReader(t, path)
+	sink.Write([]byte("one\n"))
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := lines.ReadString('\n'); line != "one\n" {
+		t.Errorf("expected the batch after the reader connected, got %q", line)
+	}
+
+	//the reader goes away, the write after it fails with EPIPE and the flush after that finds the new reader
+	r.Close()
+	sink.Write([]byte("two\n"))
+	if err = sink.Flush(); err == nil || !strings.Contains(err.Error(), "lost its reader") {
+		t.Fatalf("expected a flush into a closed reader to fail, got %v", err)
+	}
+	r, lines = openReader(t, path)
+	defer r.Close()
+	sink.Write([]byte("three\n"))
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := lines.ReadString('\n'); line != "three\n" {
+		t.Errorf("expected the batch through the new reader, got %q", line)
+	}
+}
+
+func TestFlushWritesToFIFO(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	path := gcpinfo.Worker.Message_log_path + "/" + gcpinfo.messageLogName()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Worker.Sink_type = SinkFIFO
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected a fifo at %s, got %v %v", path, fi, err)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err == nil {
+		t.Fatal("expected the flush to fail without a reader")
+	}
+	r, lines := openReader(t, path)
+	defer r.Close()
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := lines.ReadString('\n'); line != "two\n" {
+		t.Errorf("expected the second batch in the fifo, got %q", line)
+	}
+	if len(*acked) != 1 || (*acked)[0] != "2" || len(*nacked) != 1 || (*nacked)[0] != "1" {
+		t.Errorf("expected 1 nacked without a reader and 2 acked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestNewGCPclientRejectsFIFOWithRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","sink_type":"fifo","rotation":{"maxsize":10}}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "workerinfo.rotation") {
+		t.Errorf("expected an error for a fifo with rotation, got %v", err)
+	}
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","sink_type":"pipe"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "sink_type") {
+		t.Errorf("expected an error naming sink_type, got %v", err)
+	}
+}
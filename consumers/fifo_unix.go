@@ -0,0 +1,25 @@
+//go:build !windows
+
+package consumers
+
+import (
+	"os"
+	"syscall"
+)
+
+//makeFIFO makes a named pipe at path.
+
+func makeFIFO(path string, mode os.FileMode) error {
+	return syscall.Mkfifo(path, uint32(mode.Perm()))
+}
+
+//openFIFO opens a named pipe for writing without blocking until a reader shows up, errNoReader when there is none.
+//The file is non-blocking, writes wait for the reader through the runtime poller and honour a write deadline.
+
+func openFIFO(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+		return nil, errNoReader
+	}
+	return file, err
+}
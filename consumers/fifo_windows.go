@@ -0,0 +1,18 @@
+package consumers
+
+import (
+	"errors"
+	"os"
+)
+
+//errNoFIFO is what sink_type fifo fails with on windows, which has no named pipes in the file system.
+
+var errNoFIFO = errors.New("sink_type fifo is not supported on windows")
+
+func makeFIFO(path string, mode os.FileMode) error {
+	return errNoFIFO
+}
+
+func openFIFO(path string) (*os.File, error) {
+	return nil, errNoFIFO
+}
@@ -0,0 +1,36 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"strings"
+)
+
+// ParseFilter compiles the filter config field. "name=value" keeps messages whose attribute name equals value,
+// "data~text" keeps messages whose payload contains text. An empty expression keeps everything and returns nil.
+func ParseFilter(expr string) (func(msg *pubsub.Message) bool, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(expr, "data~") {
+		text := []byte(strings.TrimPrefix(expr, "data~"))
+		if len(text) == 0 {
+			return nil, errors.New("data~ needs the text to look for")
+		}
+		return func(msg *pubsub.Message) bool {
+			return bytes.Contains(msg.Data, text)
+		}, nil
+	}
+
+	i := strings.Index(expr, "=")
+	if i <= 0 {
+		return nil, errors.New("expected attribute=value or data~text")
+	}
+	name, value := expr[:i], expr[i+1:]
+	return func(msg *pubsub.Message) bool {
+		v, ok := msg.Attributes[name]
+		return ok && v == value
+	}, nil
+}
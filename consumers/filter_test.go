@@ -0,0 +1,65 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	login := &pubsub.Message{Data: []byte(`{"user":"sriram"}`), Attributes: map[string]string{"eventType": "login"}}
+	logout := &pubsub.Message{Data: []byte(`{"user":"box"}`), Attributes: map[string]string{"eventType": "logout"}}
+
+	tests := []struct {
+		expr          string
+		login, logout bool
+	}{
+		{"eventType=login", true, false},
+		{"eventType=", false, false},
+		{"data~sriram", true, false},
+		{"data~user", true, true},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if filter(login) != test.login || filter(logout) != test.logout {
+			t.Errorf("%q: expected login %v logout %v", test.expr, test.login, test.logout)
+		}
+	}
+
+	for _, expr := range []string{"eventType", "=login", "data~"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestFilterWritesOnlyMatches(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.filter, _ = ParseFilter("eventType=login")
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one"), Attributes: map[string]string{"eventType": "login"}},
+		{ID: "2", Data: []byte("two"), Attributes: map[string]string{"eventType": "logout"}},
+		{ID: "3", Data: []byte("three")},
+		{ID: "4", Data: []byte("four"), Attributes: map[string]string{"eventType": "login"}},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"one", "four"}) {
+		t.Errorf("expected only the login events written, got %q", lines)
+	}
+	if len(*acked) != 4 || len(*nacked) != 0 {
+		t.Errorf("expected every message acked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
@@ -6,176 +6,1973 @@ worker process to mirror messages from GOOGLE pub/sub to a log file. Splunk forw
 package consumers
 
 import (
-	"bufio"
 	"cloud.google.com/go/pubsub"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/jyang49/logworker_gcp/metrics"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-//This is the GCP struct. In future you can create similar for AWS or AZURE and implement methods for them.
+// MaxBatchsize is the largest batch NewGCPclient accepts. Every message in a batch is held in memory until the flush.
+const MaxBatchsize = 10000
+
+// MinWriterBuffer and MaxWriterBuffer bound writer_buffer_bytes. The minimum is the bufio default.
+const (
+	MinWriterBuffer = 4096
+	MaxWriterBuffer = 64 << 20
+)
+
+// Delivery modes for workerinfo.delivery_mode. AtLeastOnce, the default, acks a message only once its batch is written
+// and flushed, so a crash or a failed write gets it redelivered and the message log can hold duplicates. AtMostOnce acks
+// a message as soon as it is received, before it is written, so nothing is redelivered but a crash or a failed write
+// loses whatever was in the batch. ExactlyOnce is AtLeastOnce on a subscription with exactly-once delivery: every ack
+// is sent with AckWithResult once the batch lock is released and waited on until pub/sub confirmed it, see ackConfirmed.
+const (
+	AtLeastOnce = "at_least_once"
+	AtMostOnce  = "at_most_once"
+	ExactlyOnce = "exactly_once"
+)
+
+// ack and nack hooks, swapped out in tests to observe what Flush does with a batch.
+var (
+	ackMessage  = (*pubsub.Message).Ack
+	nackMessage = (*pubsub.Message).Nack
+)
+
+//This is the GCP struct. AWSInfo is the one for SQS, in future you can create similar for AZURE and implement methods for them.
 
 type GCPInfo struct {
-	Project      string       `json:"project"`
-	Topic        string       `json:"topic,omitempty"`
-	Subscription string       `json:"subscription"`
-	Keyfile      string       `json:"keyfile"`
-	Worker       WorkerInfo   `json:"workerinfo"`
-	mu           sync.RWMutex //protect concurrent writes from different goroutines to avoid race conditions
+	Project      string     `json:"project" yaml:"project"`
+	Topic        string     `json:"topic,omitempty" yaml:"topic,omitempty"`
+	Tail_topic   bool       `json:"tail_topic,omitempty" yaml:"tail_topic,omitempty"`                             //consume topic through a temporary subscription deleted on shutdown, for debugging, see nameTail
+	Auto_create  bool       `json:"auto_create_subscription,omitempty" yaml:"auto_create_subscription,omitempty"` //create the subscription on topic when it is missing, for test environments
+	Ack_deadline int        `json:"ack_deadline_seconds,omitempty" yaml:"ack_deadline_seconds,omitempty"`         //ack deadline of an auto-created subscription, 10 to 600, 0 keeps the pub/sub default of 10s
+	Update_ack   bool       `json:"update_ack_deadline,omitempty" yaml:"update_ack_deadline,omitempty"`           //also set ack_deadline_seconds on an existing subscription at startup
+	Subscription string     `json:"subscription" yaml:"subscription"`
+	Keyfile      string     `json:"keyfile,omitempty" yaml:"keyfile,omitempty"`
+	Keyfile_json string     `json:"keyfile_json,omitempty" yaml:"keyfile_json,omitempty"`                 //service account key as a json string, see credentials for precedence
+	Emulator     string     `json:"emulator_host,omitempty" yaml:"emulator_host,omitempty"`               //pub/sub emulator like localhost:8085, connects without credentials
+	Report_error bool       `json:"error_reporting,omitempty" yaml:"error_reporting,omitempty"`           //report fatal errors of NewGCPclient and Consume to Cloud Error Reporting, see reportError
+	Decompress   string     `json:"decompress,omitempty" yaml:"decompress,omitempty"`                     //gunzip payloads before anything else, gzip or auto, see DecompressGzip
+	Transform    string     `json:"transform,omitempty" yaml:"transform,omitempty"`                       //named TransformFunc to use, see transforms
+	Include_attr bool       `json:"include_attributes,omitempty" yaml:"include_attributes,omitempty"`     //write attributes with the payload, same as transform "attributes"
+	Attr_allow   []string   `json:"attribute_allowlist,omitempty" yaml:"attribute_allowlist,omitempty"`   //only write these attributes, takes precedence over attribute_denylist
+	Attr_deny    []string   `json:"attribute_denylist,omitempty" yaml:"attribute_denylist,omitempty"`     //write all attributes but these, like the ones dataflow adds
+	Ordered      bool       `json:"ordered,omitempty" yaml:"ordered,omitempty"`                           //keep per ordering key order in the message log, the subscription must have ordering on
+	Ordering_key string     `json:"include_ordering_key,omitempty" yaml:"include_ordering_key,omitempty"` //add the ordering key to lines of messages that have one as a field or a prefix, see LabelField
+	Include_id   bool       `json:"include_message_id,omitempty" yaml:"include_message_id,omitempty"`     //add the message ID to each line, a _message_id field for json objects and message_id_prefix otherwise
+	Msgid_prefix string     `json:"message_id_prefix,omitempty" yaml:"message_id_prefix,omitempty"`       //prefix of include_message_id for lines that are not json objects, see DefaultMessageIDPrefix
+	Filter       string     `json:"filter,omitempty" yaml:"filter,omitempty"`                             //only write matching messages, see ParseFilter
+	Route_attr   string     `json:"route_by_attribute,omitempty" yaml:"route_by_attribute,omitempty"`     //write each value of this attribute to <message log>-<value>.log, messages without it to the message log
+	Max_routes   int        `json:"max_routes,omitempty" yaml:"max_routes,omitempty"`                     //files route_by_attribute opens at most, see DefaultMaxRoutes
+	Route_pool   int        `json:"route_concurrency,omitempty" yaml:"route_concurrency,omitempty"`       //flush up to this many routes at once, each acked or nacked on its own, see writeGroups
+	Source_label string     `json:"source_label,omitempty" yaml:"source_label,omitempty"`                 //names the subscription in its lines, defaults to the subscription name
+	Inject_label string     `json:"inject_label,omitempty" yaml:"inject_label,omitempty"`                 //add source_label to each line as a field or a prefix, see LabelField, off when empty
+	Label_prefix string     `json:"label_prefix,omitempty" yaml:"label_prefix,omitempty"`                 //prefix of inject_label prefix, see DefaultLabelPrefix
+	Worker       WorkerInfo `json:"workerinfo" yaml:"workerinfo"`
+	batchWriter             //Receive runs its callback on many goroutines. batch, sink and the shutdown state below are only touched holding mu
 	batch        []*pubsub.Message
-	writer       *bufio.Writer
+	processed    int                                              //messages flushed since the last heartbeat
+	lastFlush    time.Time                                        //when a non-empty batch was last flushed, zero until then
+	handler      func(data []byte, attrs map[string]string) error //set by ConsumeFunc in place of sink
+	cancel       context.CancelFunc                               //stops the running receive, set while receive is running
+	done         chan struct{}                                    //closed once receive has flushed and closed the message log
+	stopping     bool                                             //set by Shutdown so a receive that has not started yet exits straight away
+	receiving    bool                                             //true while Receive is running, see healthz
+	ready        bool                                             //set once the client is up and the subscription was found, see readyz
+	flushErr     error                                            //result of the last flush of the sink
+	failed       uint64                                           //flushes of the sink that failed since the process started, see FailedFlushes
+	counts       counters                                         //see Stats
+	metricsSrv   *http.Server
+	healthSrv    *http.Server
+	client       *pubsub.Client
+	receiver     receiver //read instead of the subscription when set, tests use it to feed synthetic messages
+	ownsClient   bool     //false for a client passed to SetClient, the caller closes that one
+	workerlog    *lumberjack.Logger
+	filter       func(msg *pubsub.Message) bool //compiled Filter, nil keeps every message
+	seen         *seenIDs                       //dedup keys already written, nil unless dedup_size is set
+	limiter      *rate.Limiter                  //paces the receive callback, nil unless max_messages_per_second is set
+	clientOpts   []option.ClientOption          //appended to the credentials, see NewGCPclientWithOptions
+	taken        int                            //messages counted into max_messages, see take
+	routes       map[string]Sink                //open files of route_by_attribute by route key, see routeSink
+	routesFull   bool                           //max_routes was reached and logged
+	label        []byte                         //what inject_label adds to each line, see labelBytes
+	acks         []*pubsub.Message              //flushed messages async_ack acks once mu is released, see ackQueued
+	spool        *spool                         //batches HEC did not take, nil unless workerinfo.spool is set
+	fatal        error                          //the write error that stopped the worker, see stopOnFatal
+	firstAt      time.Time                      //when the first message of the batch came in, see observeAck
+	acksFrom     time.Time                      //firstAt of the oldest batch in acks
+	deadline     atomic.Int64                   //ack deadline of the subscription, 0 until it was read, see noteAckDeadline
+	tailMu       sync.Mutex                     //held while the temporary subscription of tail_topic is created or deleted
+	tailing      bool                           //the temporary subscription exists, guarded by tailMu
+
+	//TransformFunc rewrites a message before it is written. Nil writes msg.Data as is, an error nacks the message.
+	TransformFunc func(msg *pubsub.Message) ([]byte, error) `json:"-" yaml:"-"`
+
+	//ReceiveSettingsFunc adjusts the receive settings of the subscription after the config has filled them in, right
+	//before each Receive, for settings the config does not cover. Nil leaves them as the config says.
+	ReceiveSettingsFunc func(settings *pubsub.ReceiveSettings) `json:"-" yaml:"-"`
+
+	//BeforeFlush and AfterFlush run around every flush of a batch that is not empty, e.g. to notify a sidecar or count
+	//batches in a metric of their own. BeforeFlush gets a copy of the batch, in the order it is written, and AfterFlush
+	//how many of its messages were written or handled, 0 when err says the batch was nacked. Both run holding the
+	//batch lock, on whichever goroutine flushes: they hold up the receive callbacks while they run and must not call
+	//Flush, Close, Stats or Shutdown. The messages are not theirs to ack, nack or change. Nil hooks do nothing.
+	BeforeFlush func(batch []*pubsub.Message) `json:"-" yaml:"-"`
+	AfterFlush  func(n int, err error)        `json:"-" yaml:"-"`
 }
 
 type WorkerInfo struct {
-	Message_log_path    string        `json:"messagelogpath"`
-	Worker_log_path     string        `json:"workerlogpath"`
-	Batchsize           float32       `json:"batchsize"`
-	Maxwaittime         time.Duration `json:"maxwaitmin"`
+	Message_log_path    string        `json:"messagelogpath" yaml:"messagelogpath"`
+	Worker_log_path     string        `json:"workerlogpath" yaml:"workerlogpath"`
+	Allow_tmp_fallback  bool          `json:"allow_tmp_fallback,omitempty" yaml:"allow_tmp_fallback,omitempty"` //write the worker log to TmpWorkerLogPath when workerlogpath is empty instead of failing
+	Worker_log_name     string        `json:"worker_log_name,omitempty" yaml:"worker_log_name,omitempty"`       //worker log file name without .log, defaults to the config file name
+	File_name_template  string        `json:"file_name_template,omitempty" yaml:"file_name_template,omitempty"` //message log name like {subscription}-{hostname}-{date}.log, see DefaultFileNameTemplate
+	Output_extension    string        `json:"output_extension,omitempty" yaml:"output_extension,omitempty"`     //extension of the message log like .json, defaults to DefaultOutputExtension
+	Log_format          string        `json:"log_format,omitempty" yaml:"log_format,omitempty"`                 //text (default) or json for the worker log
+	Log_level           string        `json:"log_level,omitempty" yaml:"log_level,omitempty"`                   //debug, info (default), warn or error, see LogInfo
+	Batchsize           int           `json:"batchsize" yaml:"batchsize"`
+	Writer_buffer_bytes int           `json:"writer_buffer_bytes,omitempty" yaml:"writer_buffer_bytes,omitempty"` //message log write buffer, defaults to max_batch_bytes so a batch is one write
+	Max_batch_bytes     int           `json:"max_batch_bytes,omitempty" yaml:"max_batch_bytes,omitempty"`         //also flush once the batch payloads add up to this many bytes, off when 0
+	Maxwaitmin          int           `json:"maxwaitmin" yaml:"maxwaitmin"`
+	Maxwaittime         time.Duration `json:"-" yaml:"-"`                                                                   //derived from Maxwaitmin in NewGCPclient
+	Maxwait_jitter      int           `json:"maxwait_jitter_percent,omitempty" yaml:"maxwait_jitter_percent,omitempty"`     //vary each receive cycle by up to this percent of maxwaitmin, see cycleTimeout
+	Connect_attempts    int           `json:"connect_attempts,omitempty" yaml:"connect_attempts,omitempty"`                 //attempts to reach pub/sub on transient errors
+	Open_attempts       int           `json:"open_attempts,omitempty" yaml:"open_attempts,omitempty"`                       //attempts to open the message log when Consume starts, for networked storage, defaults to 1
+	Open_retry_delay    int           `json:"open_retry_delay,omitempty" yaml:"open_retry_delay,omitempty"`                 //seconds before the first retry of open_attempts, doubled with each retry, see DefaultOpenRetryDelay
+	Open_retry_wait     time.Duration `json:"-" yaml:"-"`                                                                   //derived from Open_retry_delay by checkOpenRetry
+	Flush_interval      int           `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"`                     //seconds between flushes of a partial batch, off when 0
+	Flush_every         time.Duration `json:"-" yaml:"-"`                                                                   //derived from Flush_interval in NewGCPclient
+	Heartbeat_interval  int           `json:"heartbeat_interval,omitempty" yaml:"heartbeat_interval,omitempty"`             //minutes between heartbeat lines in the worker log, off when 0
+	Heartbeat_every     time.Duration `json:"-" yaml:"-"`                                                                   //derived from Heartbeat_interval in NewGCPclient
+	Max_outstanding     int           `json:"max_outstanding_messages,omitempty" yaml:"max_outstanding_messages,omitempty"` //pub/sub flow control, unacked messages held at once
+	Max_rate            int           `json:"max_messages_per_second,omitempty" yaml:"max_messages_per_second,omitempty"`   //take at most this many messages a second from pub/sub, unlimited when 0
+	Max_messages        int           `json:"max_messages,omitempty" yaml:"max_messages,omitempty"`                         //stop after this many messages went into the message log, for backfills and tests, off when 0
+	Num_goroutines      int           `json:"num_goroutines,omitempty" yaml:"num_goroutines,omitempty"`                     //pub/sub receive parallelism
+	Manual_pull         bool          `json:"manual_pull,omitempty" yaml:"manual_pull,omitempty"`                           //synchronous pull of one batch at a time instead of streaming pull, see applyReceiveSettings
+	Max_extension       string        `json:"max_extension,omitempty" yaml:"max_extension,omitempty"`                       //how long pub/sub keeps extending the ack deadline of a held message, like "90m", see Maxextension
+	Maxextension        time.Duration `json:"-" yaml:"-"`                                                                   //parsed from Max_extension, 0 keeps the client default of 60m
+	Deadletter_path     string        `json:"deadletter_path,omitempty" yaml:"deadletter_path,omitempty"`                   //file for messages that keep failing, off when empty
+	Deadletter_attempts int           `json:"deadletter_attempts,omitempty" yaml:"deadletter_attempts,omitempty"`           //delivery attempts before a failing message is dead-lettered
+	Max_message_bytes   int           `json:"max_message_bytes,omitempty" yaml:"max_message_bytes,omitempty"`               //payloads over this many bytes get max_message_action, off when 0
+	Max_message_action  string        `json:"max_message_action,omitempty" yaml:"max_message_action,omitempty"`             //truncate (default), deadletter or skip, see OversizeTruncate
+	Attempt_warning     int           `json:"delivery_attempt_warning,omitempty" yaml:"delivery_attempt_warning,omitempty"` //warn about messages on this delivery attempt or later, off when 0
+	Ack_warning         float64       `json:"ack_latency_warning,omitempty" yaml:"ack_latency_warning,omitempty"`           //warn about batches acked after this fraction of the ack deadline like 0.8, off when 0, see observeAck
+	Min_free_disk       int64         `json:"min_free_disk_bytes,omitempty" yaml:"min_free_disk_bytes,omitempty"`           //nack batches instead of writing them while the message log volume has less free, off when 0
+	Write_meta          bool          `json:"write_meta,omitempty" yaml:"write_meta,omitempty"`                             //write a <file>.meta with line count and SHA-256 of each message log file the worker closes
+	Compress_messages   bool          `json:"compress_messages,omitempty" yaml:"compress_messages,omitempty"`               //gzip the message log, written to <subscription>.log.gz
+	One_line_per_event  bool          `json:"one_line_per_event,omitempty" yaml:"one_line_per_event,omitempty"`             //keep payloads with newlines on one line, see newline_encoding
+	Newline_encoding    string        `json:"newline_encoding,omitempty" yaml:"newline_encoding,omitempty"`                 //escape (default) or base64, see NewlineEscape
+	Line_terminator     string        `json:"line_terminator,omitempty" yaml:"line_terminator,omitempty"`                   //lf (default) or crlf
+	Output_format       string        `json:"output_format,omitempty" yaml:"output_format,omitempty"`                       //ndjson (default) or json_array, see OutputNDJSON
+	Timestamp_format    string        `json:"timestamp_format,omitempty" yaml:"timestamp_format,omitempty"`                 //prefix each line with the publish time, rfc3339 or a Go time layout with a zone, off when empty
+	Timestamp_layout    string        `json:"-" yaml:"-"`                                                                   //derived from Timestamp_format in NewGCPclient
+	Rotation            *RotationInfo `json:"rotation,omitempty" yaml:"rotation,omitempty"`                                 //rotate the message log by size with lumberjack or on a schedule
+	Worker_log_maxsize  int           `json:"worker_log_maxsize,omitempty" yaml:"worker_log_maxsize,omitempty"`             //megabytes before the worker log rotates, see DefaultWorkerLogMaxsize
+	Worker_log_backups  *int          `json:"worker_log_maxbackups,omitempty" yaml:"worker_log_maxbackups,omitempty"`       //rotated worker logs to keep, 0 keeps all, see DefaultWorkerLogBackups
+	Worker_log_maxage   *int          `json:"worker_log_maxage,omitempty" yaml:"worker_log_maxage,omitempty"`               //days to keep rotated worker logs, 0 keeps them regardless of age, see DefaultWorkerLogMaxage
+	Worker_log_compress *bool         `json:"worker_log_compress,omitempty" yaml:"worker_log_compress,omitempty"`           //gzip rotated worker logs, defaults to true
+	Metrics_addr        string        `json:"metrics_addr,omitempty" yaml:"metrics_addr,omitempty"`                         //serve prometheus metrics on this address, off when empty
+	Health_addr         string        `json:"health_addr,omitempty" yaml:"health_addr,omitempty"`                           //serve /healthz and /readyz on this address, off when empty
+	HEC                 *HECInfo      `json:"hec,omitempty" yaml:"hec,omitempty"`                                           //post batches to splunk HEC instead of the message log file
+	Sink_type           string        `json:"sink_type,omitempty" yaml:"sink_type,omitempty"`                               //file (default) or fifo to write to a named pipe at the message log path, see SinkFIFO
+	Spool               *SpoolInfo    `json:"spool,omitempty" yaml:"spool,omitempty"`                                       //spool batches HEC does not take to disk and ack them, see SpoolInfo
+	Tee                 []TeeInfo     `json:"tee,omitempty" yaml:"tee,omitempty"`                                           //also write each batch to these sinks, acked only when all of them take it
+	Delivery_mode       string        `json:"delivery_mode,omitempty" yaml:"delivery_mode,omitempty"`                       //at_least_once (default), at_most_once or exactly_once, see AtLeastOnce
+	Dedup_size          int           `json:"dedup_size,omitempty" yaml:"dedup_size,omitempty"`                             //remember this many written messages and skip redeliveries of them, off when 0
+	Dedup_attribute     string        `json:"dedup_attribute,omitempty" yaml:"dedup_attribute,omitempty"`                   //dedup on this attribute instead of the message ID
+	Dry_run             bool          `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`                                   //log a sample of each batch and nack it instead of writing, to preview a subscription
+	Fsync_on_flush      bool          `json:"fsync_on_flush,omitempty" yaml:"fsync_on_flush,omitempty"`                     //fsync the message log before a batch is acked, slower but survives a host crash
+	Async_ack           bool          `json:"async_ack,omitempty" yaml:"async_ack,omitempty"`                               //ack a flushed batch after releasing the batch lock, see ackQueued
+	Dir_mode            string        `json:"dir_mode,omitempty" yaml:"dir_mode,omitempty"`                                 //octal mode for messagelogpath like "0755", set on startup
+	Dirmode             os.FileMode   `json:"-" yaml:"-"`                                                                   //parsed from Dir_mode, 0 leaves the mode alone
+	File_mode           string        `json:"file_mode,omitempty" yaml:"file_mode,omitempty"`                               //octal mode for the message and dead-letter files like "0644"
+	Filemode            os.FileMode   `json:"-" yaml:"-"`                                                                   //parsed from File_mode, 0 leaves the mode alone
+	Worker_logger_debug *log.Logger   //set up by openWorkerLog, nil logs nothing, see debug
 	Worker_logger_info  *log.Logger
 	Worker_logger_error *log.Logger
 }
 
 func NewGCPclient(configfile string) (*GCPInfo, error) {
+	return NewGCPclientWithOverrides(configfile, nil)
+}
+
+// NewGCPclientWithOverrides is NewGCPclient with override run on the parsed config before defaults are filled and the
+// config is validated, so command line flags can take precedence over the file and still get checked with the rest.
+func NewGCPclientWithOverrides(configfile string, override func(gcpinfo *GCPInfo)) (_ *GCPInfo, err error) {
 	//Check the cloud provider and create a struct accordingly
 	gcpinfo := &GCPInfo{}
+	//only errors after the config was read can be reported, reportError needs error_reporting and the project
+	defer func() {
+		if err != nil {
+			gcpinfo.reportError(err)
+		}
+	}()
 
 	//Read the config file and populate the json parameters.
-	content, err := ioutil.ReadFile(configfile)
+	content, err := readConfig(configfile)
 	if err != nil {
-		return nil, errors.New("ERROR: Unable to read the json file")
+		return nil, wrap(ErrConfigRead, "ERROR: Unable to read the config "+configfile, err)
+	}
+
+	//unmarshal json, or yaml for a .yaml/.yml file, to struct object
+	if err = unmarshalConfig(configfile, content, gcpinfo); err != nil {
+		return nil, wrap(ErrConfigParse, "ERROR: Unable to unmarshal config file "+configfile, err)
 	}
 
-	//unmarshal json to struct object
-	if err = json.Unmarshal(content, gcpinfo); err != nil {
-		return nil, errors.New("ERROR: Unable to unmarshal config file contents. Check if valid json or if some parameter missing")
+	//deployment templates pass paths through env vars, expand them before anything uses the values
+	if err = gcpinfo.expandEnv(); err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
+	}
+	if override != nil {
+		override(gcpinfo)
+	}
+	if gcpinfo.Tail_topic {
+		if err = gcpinfo.nameTail(); err != nil {
+			return nil, wrap(ErrConfigInvalid, "", err)
+		}
 	}
 
-	//lumberjack will compress and rotate the worker file. If Json is missing worker log path, then create a tmp path
+	//fill defaults for the optional fields, then check what is left
 
-	if gcpinfo.Worker.Worker_log_path == "" {
-		gcpinfo.Worker.Worker_log_path = "/tmp/"
+	if gcpinfo.Worker.Batchsize == 0 {
+		gcpinfo.Worker.Batchsize = 3
 	}
 
-	l := &lumberjack.Logger{
-		Filename:   gcpinfo.Worker.Worker_log_path + "/" + configfile + ".log",
-		MaxSize:    500,
-		MaxBackups: 3,
-		MaxAge:     18,
-		Compress:   true,
+	if gcpinfo.Worker.Maxwaitmin == 0 {
+		//set default to 10 min
+		gcpinfo.Worker.Maxwaitmin = 10
 	}
+	gcpinfo.Worker.Maxwaittime = time.Duration(gcpinfo.Worker.Maxwaitmin) * time.Minute
 
-	//use this only one goroutine as making copies of logger will duplicate the interface and cause concurrency issues if multiple goroutines are used.
-	gcpinfo.Worker.Worker_logger_error = log.New(l, "ERROR: ", log.Ldate|log.Ltime)
-	gcpinfo.Worker.Worker_logger_info = log.New(l, "INFO: ", log.Ldate|log.Ltime)
+	//size the buffer for a whole batch when the batch has a byte bound, validate keeps an explicit size in range
+	if gcpinfo.Worker.Writer_buffer_bytes == 0 && gcpinfo.Worker.Max_batch_bytes > 0 {
+		gcpinfo.Worker.Writer_buffer_bytes = gcpinfo.Worker.Max_batch_bytes
+		if gcpinfo.Worker.Writer_buffer_bytes < MinWriterBuffer {
+			gcpinfo.Worker.Writer_buffer_bytes = MinWriterBuffer
+		}
+		if gcpinfo.Worker.Writer_buffer_bytes > MaxWriterBuffer {
+			gcpinfo.Worker.Writer_buffer_bytes = MaxWriterBuffer
+		}
+	}
+
+	if gcpinfo.Worker.Connect_attempts == 0 {
+		gcpinfo.Worker.Connect_attempts = 5
+	}
+	gcpinfo.Worker.Flush_every = time.Duration(gcpinfo.Worker.Flush_interval) * time.Second
+	gcpinfo.Worker.Heartbeat_every = time.Duration(gcpinfo.Worker.Heartbeat_interval) * time.Minute
+
+	if gcpinfo.Worker.Deadletter_attempts == 0 {
+		gcpinfo.Worker.Deadletter_attempts = 5
+	}
 
-	//create a message log file
-	if err = CreateMessageLogFiles(gcpinfo.Worker.Message_log_path, gcpinfo.Subscription); err != nil {
-		return nil, errors.New("ERROR: Unable to create message log files. Check permissions")
+	if gcpinfo.Worker.Dirmode, err = parseMode("dir_mode", gcpinfo.Worker.Dir_mode); err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
+	}
+	if gcpinfo.Worker.Filemode, err = parseMode("file_mode", gcpinfo.Worker.File_mode); err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
 	}
 
-	//define the batch
+	if gcpinfo.Worker.Max_extension != "" {
+		if gcpinfo.Worker.Maxextension, err = time.ParseDuration(gcpinfo.Worker.Max_extension); err != nil {
+			return nil, wrap(ErrConfigInvalid, "", fmt.Errorf("ERROR: config field workerinfo.max_extension %q is not a duration like 90m: %v", gcpinfo.Worker.Max_extension, err))
+		}
+	}
 
-	gcpinfo.batch = make([]*pubsub.Message, 0, int(gcpinfo.Worker.Batchsize))
+	if gcpinfo.Worker.Max_outstanding == 0 {
+		gcpinfo.Worker.Max_outstanding = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+		if gcpinfo.Worker.Manual_pull {
+			gcpinfo.Worker.Max_outstanding = gcpinfo.Worker.Batchsize
+		}
+	}
+	if gcpinfo.Worker.Num_goroutines == 0 {
+		gcpinfo.Worker.Num_goroutines = pubsub.DefaultReceiveSettings.NumGoroutines
+	}
 
-	//define default batch size
+	if gcpinfo.Worker.Delivery_mode == "" {
+		gcpinfo.Worker.Delivery_mode = AtLeastOnce
+	}
+	if gcpinfo.Worker.Output_format == "" {
+		gcpinfo.Worker.Output_format = OutputNDJSON
+	}
+	gcpinfo.Worker.Timestamp_layout = gcpinfo.Worker.Timestamp_format
+	if gcpinfo.Worker.Timestamp_format == "rfc3339" {
+		gcpinfo.Worker.Timestamp_layout = time.RFC3339
+	}
 
-	if gcpinfo.Worker.Batchsize == 0 {
-		gcpinfo.Worker.Batchsize = 3
+	if gcpinfo.Include_attr && gcpinfo.Transform == "" {
+		gcpinfo.Transform = "attributes"
+	}
+	if gcpinfo.Route_attr != "" && gcpinfo.Max_routes == 0 {
+		gcpinfo.Max_routes = DefaultMaxRoutes
+	}
+	if gcpinfo.Source_label == "" {
+		gcpinfo.Source_label = gcpinfo.Subscription
+	}
+	if gcpinfo.Inject_label == LabelPrefix && gcpinfo.Label_prefix == "" {
+		gcpinfo.Label_prefix = DefaultLabelPrefix
+	}
+	if gcpinfo.Include_id && gcpinfo.Msgid_prefix == "" {
+		gcpinfo.Msgid_prefix = DefaultMessageIDPrefix
 	}
 
-	if gcpinfo.Worker.Maxwaittime == 0 {
-		//set default to 10 min
-		gcpinfo.Worker.Maxwaittime = time.Duration(10)
+	if err = gcpinfo.validate(); err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
+	}
+
+	if gcpinfo.Transform != "" {
+		gcpinfo.TransformFunc = transforms[gcpinfo.Transform](gcpinfo)
+	}
+	gcpinfo.label = gcpinfo.labelBytes()
+	gcpinfo.filter, _ = ParseFilter(gcpinfo.Filter)
+	if gcpinfo.Worker.Dedup_size > 0 {
+		gcpinfo.seen = newSeenIDs(gcpinfo.Worker.Dedup_size)
+	}
+	if gcpinfo.Worker.Max_rate > 0 {
+		gcpinfo.limiter = rate.NewLimiter(rate.Limit(gcpinfo.Worker.Max_rate), 1)
+	}
+	if gcpinfo.Worker.Spool != nil {
+		if gcpinfo.spool, err = openSpool(gcpinfo.Worker.Spool); err != nil {
+			return nil, wrap(ErrFileOpen, "ERROR: Unable to open the spool "+gcpinfo.Worker.Spool.Path, err)
+		}
+	}
+
+	gcpinfo.workerlog = gcpinfo.Worker.openWorkerLog(configfile, gcpinfo.Subscription)
+
+	//the tail of a batch is flushed when the receive cycle ends, so no message is held much longer than maxwaitmin and
+	//extending its deadline past that buys nothing
+	if e := gcpinfo.Worker.Maxextension; e > gcpinfo.Worker.Maxwaittime {
+		gcpinfo.Worker.Worker_logger_info.Println("max_extension", e, "is longer than maxwaitmin", gcpinfo.Worker.Maxwaittime, "messages are flushed by the end of each receive cycle anyway")
+	}
+
+	if len(gcpinfo.Attr_allow) > 0 && len(gcpinfo.Attr_deny) > 0 {
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING: attribute_allowlist and attribute_denylist are both set, only the allowlist applies")
+	}
+
+	if b := gcpinfo.Worker.Writer_buffer_bytes; b != 0 && b < gcpinfo.Worker.Max_batch_bytes {
+		gcpinfo.Worker.Worker_logger_info.Println("writer_buffer_bytes", b, "is smaller than max_batch_bytes", gcpinfo.Worker.Max_batch_bytes, "a full batch takes several writes")
+	}
+
+	if gcpinfo.Worker.Dry_run {
+		gcpinfo.Worker.Worker_logger_info.Println("DRY RUN is on: messages are logged and nacked, nothing is written to", gcpinfo.Worker.Message_log_path)
+	}
+
+	//create a message log file, or the fifo so the forwarder can open it before the first receive
+	if gcpinfo.Worker.Sink_type == SinkFIFO {
+		err = createFIFO(gcpinfo.Worker.Message_log_path, gcpinfo.messageLogName(), gcpinfo.Worker.Dirmode, gcpinfo.Worker.Filemode)
+	} else {
+		err = createMessageLog(gcpinfo.Worker.Message_log_path, gcpinfo.messageLogName(), gcpinfo.Worker.Dirmode, gcpinfo.Worker.Filemode)
+	}
+	if err != nil {
+		return nil, wrap(ErrFileOpen, "ERROR: Unable to create message log files. Check permissions", err)
+	}
+
+	//define the batch, batchsize has its default by now
+
+	gcpinfo.batch = make([]*pubsub.Message, 0, gcpinfo.Worker.Batchsize)
+
+	//metrics are always counted, the endpoint is only opened when asked for
+	if gcpinfo.Worker.Metrics_addr != "" {
+		gcpinfo.serveMetrics()
+	}
+	if gcpinfo.Worker.Health_addr != "" {
+		gcpinfo.serveHealth()
 	}
 
 	return gcpinfo, nil
 }
 
-//consume messages from the pubsub queue.
+// TmpWorkerLogPath is where the worker log goes when workerlogpath is empty and allow_tmp_fallback is set.
+const TmpWorkerLogPath = "/tmp/"
 
-func (gcpinfo *GCPInfo) Flush() {
+//checkWorkerLogPath rejects an empty workerlogpath. /tmp is usually wiped on reboot and watched by nobody, a worker
+//only logs there when the config says so with allow_tmp_fallback.
 
-	for _, msg := range gcpinfo.batch {
-		_, err := gcpinfo.writer.WriteString(string(msg.Data) + "\n")
-		if err != nil {
-			msg.Nack()
+func (worker *WorkerInfo) checkWorkerLogPath() error {
+	if worker.Worker_log_path == "" && !worker.Allow_tmp_fallback {
+		return fmt.Errorf("ERROR: config field workerinfo.workerlogpath is required, set workerinfo.allow_tmp_fallback to log to %s", TmpWorkerLogPath)
+	}
+	return nil
+}
+
+// Defaults of the worker log rotation, workerinfo.worker_log_maxsize, worker_log_maxbackups and worker_log_maxage.
+// Rotated worker logs are compressed unless worker_log_compress is false.
+const (
+	DefaultWorkerLogMaxsize = 500
+	DefaultWorkerLogBackups = 3
+	DefaultWorkerLogMaxage  = 18
+)
+
+//checkWorkerLogRotation rejects negative worker log rotation values, lumberjack would take them as no limit.
+
+func (worker *WorkerInfo) checkWorkerLogRotation() error {
+	if worker.Worker_log_maxsize < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.worker_log_maxsize %d must not be negative", worker.Worker_log_maxsize)
+	}
+	if b := worker.Worker_log_backups; b != nil && *b < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.worker_log_maxbackups %d must not be negative", *b)
+	}
+	if a := worker.Worker_log_maxage; a != nil && *a < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.worker_log_maxage %d must not be negative", *a)
+	}
+	return nil
+}
+
+//openWorkerLog sets up the worker loggers and returns the lumberjack file behind them. The log is named after the
+//config file, foo.json logs to foo.log, unless worker_log_name says otherwise, a config from stdin logs to <label>.log.
+//label tags json log lines with the subscription or queue. An empty workerlogpath, which checkWorkerLogPath only lets
+//through with allow_tmp_fallback, logs to TmpWorkerLogPath with a warning on top.
+
+func (worker *WorkerInfo) openWorkerLog(configfile string, label string) *lumberjack.Logger {
+	fallback := worker.Worker_log_path == ""
+	if fallback {
+		worker.Worker_log_path = TmpWorkerLogPath
+	}
+
+	name := worker.Worker_log_name
+	if name == "" {
+		base := configName(configfile)
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if name == "" {
+		name = label
+	}
+
+	l := &lumberjack.Logger{
+		Filename:   filepath.Join(worker.Worker_log_path, name+".log"),
+		MaxSize:    DefaultWorkerLogMaxsize,
+		MaxBackups: DefaultWorkerLogBackups,
+		MaxAge:     DefaultWorkerLogMaxage,
+		Compress:   true,
+	}
+	if worker.Worker_log_maxsize > 0 {
+		l.MaxSize = worker.Worker_log_maxsize
+	}
+	if worker.Worker_log_backups != nil {
+		l.MaxBackups = *worker.Worker_log_backups
+	}
+	if worker.Worker_log_maxage != nil {
+		l.MaxAge = *worker.Worker_log_maxage
+	}
+	if worker.Worker_log_compress != nil {
+		l.Compress = *worker.Worker_log_compress
+	}
+
+	//use this only one goroutine as making copies of logger will duplicate the interface and cause concurrency issues if multiple goroutines are used.
+	if worker.Log_format == "json" {
+		worker.Worker_logger_error = log.New(worker.leveled(&jsonLogWriter{out: l, level: "error", subscription: label}, LogError), "", 0)
+		worker.Worker_logger_info = log.New(worker.leveled(&jsonLogWriter{out: l, level: "info", subscription: label}, LogInfo), "", 0)
+		worker.Worker_logger_debug = log.New(worker.leveled(&jsonLogWriter{out: l, level: "debug", subscription: label}, LogDebug), "", 0)
+	} else {
+		worker.Worker_logger_error = log.New(worker.leveled(l, LogError), "ERROR: ", log.Ldate|log.Ltime)
+		worker.Worker_logger_info = log.New(worker.leveled(l, LogInfo), "INFO: ", log.Ldate|log.Ltime)
+		worker.Worker_logger_debug = log.New(worker.leveled(l, LogDebug), "DEBUG: ", log.Ldate|log.Ltime)
+	}
+	if fallback {
+		worker.Worker_logger_error.Println("WARNING: workerinfo.workerlogpath is not set, the worker log is in", l.Filename, "which may not survive a reboot")
+	}
+	return l
+}
+
+//unmarshalConfig picks the format from the file extension, anything but .yaml and .yml is json. The yaml tags on the
+//config structs mirror the json ones, so both formats use the same field names.
+
+func unmarshalConfig(configfile string, content []byte, config interface{}) error {
+	switch strings.ToLower(filepath.Ext(configName(configfile))) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(content, config)
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return locateJSONError(content, err)
+	}
+	return nil
+}
+
+//locateJSONError adds where in the config a json error is, the line and column of a syntax error or the field with the
+//wrong type, keeping err itself wrapped.
+
+func locateJSONError(content []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		if e.Field != "" {
+			return fmt.Errorf("field %s: %w", e.Field, err)
+		}
+		offset = e.Offset
+	default:
+		return err
+	}
+
+	line, column := 1, 1
+	for _, c := range content[:offset] {
+		if c == '\n' {
+			line, column = line+1, 1
 		} else {
-			msg.Ack()
+			column++
 		}
 	}
+	return fmt.Errorf("line %d column %d: %w", line, column, err)
+}
 
-	gcpinfo.writer.Flush()
-	//empty the batch
-	gcpinfo.batch = make([]*pubsub.Message, 0, int(gcpinfo.Worker.Batchsize))
+//validate checks the config once defaults are filled and names the offending field, so a typo in the json is obvious.
 
-}
+func (gcpinfo *GCPInfo) validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"project", gcpinfo.Project},
+		{"subscription", gcpinfo.Subscription},
+		{"workerinfo.messagelogpath", gcpinfo.Worker.Message_log_path},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("ERROR: config field %s is required", field.name)
+		}
+	}
+
+	if gcpinfo.Auto_create && gcpinfo.Topic == "" {
+		return errors.New("ERROR: config field topic is required with auto_create_subscription, the subscription is created on it")
+	}
+	if err := checkAckDeadline(gcpinfo.Ack_deadline); err != nil {
+		return err
+	}
+	if gcpinfo.Update_ack && gcpinfo.Ack_deadline == 0 {
+		return errors.New("ERROR: config field update_ack_deadline needs ack_deadline_seconds")
+	}
 
-func (gcpinfo *GCPInfo) Consume() error {
+	if err := gcpinfo.Worker.checkWorkerLogPath(); err != nil {
+		return err
+	}
 
-	gcpinfo.Worker.Worker_logger_info.Println("Starting Receiver")
-	ctx := context.Background()
+	if strings.ContainsRune(gcpinfo.Worker.Worker_log_name, filepath.Separator) {
+		return fmt.Errorf("ERROR: config field workerinfo.worker_log_name %q must be a file name, not a path", gcpinfo.Worker.Worker_log_name)
+	}
 
-	//Create a new consumer client. Pass the credentials via a file.
+	if err := checkFileNameTemplate(gcpinfo.Worker.File_name_template); err != nil {
+		return fmt.Errorf("ERROR: config field workerinfo.file_name_template %q is not valid: %v", gcpinfo.Worker.File_name_template, err)
+	}
+	if err := gcpinfo.Worker.checkOutputExtension(); err != nil {
+		return err
+	}
 
-	client, err := pubsub.NewClient(ctx, gcpinfo.Project, option.WithCredentialsFile(gcpinfo.Keyfile))
+	if f := gcpinfo.Worker.Log_format; f != "" && f != "text" && f != "json" {
+		return fmt.Errorf("ERROR: config field workerinfo.log_format %q must be text or json", f)
+	}
+	if err := gcpinfo.Worker.checkLogLevel(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkWorkerLogRotation(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkMaxWaitJitter(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkOpenRetry(); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return errors.New("ERROR: Unable to create a pub/sub client. Is the credentials file exported?")
+	if m := gcpinfo.Worker.Delivery_mode; m != AtLeastOnce && m != AtMostOnce && m != ExactlyOnce {
+		return fmt.Errorf("ERROR: config field workerinfo.delivery_mode %q must be %s, %s or %s", m, AtLeastOnce, AtMostOnce, ExactlyOnce)
 	}
 
-	Subscription := client.Subscription(gcpinfo.Subscription)
+	if err := gcpinfo.Worker.checkOutputFormat(); err != nil {
+		return err
+	}
 
-	//Open the target file.
+	//a timestamp without a zone is read in whatever zone the forwarder runs in
+	if layout := gcpinfo.Worker.Timestamp_layout; layout != "" {
+		if !strings.Contains(layout, "Z07") && !strings.Contains(layout, "-07") && !strings.Contains(layout, "MST") {
+			return fmt.Errorf("ERROR: config field workerinfo.timestamp_format %q must include a time zone, e.g. rfc3339", gcpinfo.Worker.Timestamp_format)
+		}
+		if gcpinfo.Worker.Output_format == OutputJSONArray {
+			return errors.New("ERROR: config field workerinfo.timestamp_format cannot be combined with workerinfo.output_format json_array")
+		}
+	}
 
-	file, err := os.OpenFile(gcpinfo.Worker.Message_log_path+"/"+gcpinfo.Subscription+".log", os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		return errors.New("Unable to Open events output log file")
+	if gcpinfo.Worker.Batchsize <= 0 || gcpinfo.Worker.Batchsize > MaxBatchsize {
+		return fmt.Errorf("ERROR: config field workerinfo.batchsize is %d, it must be between 1 and %d", gcpinfo.Worker.Batchsize, MaxBatchsize)
 	}
-	defer file.Close()
 
-	gcpinfo.writer = bufio.NewWriter(file)
+	if _, ok := transforms[gcpinfo.Transform]; gcpinfo.Transform != "" && !ok {
+		return fmt.Errorf("ERROR: config field transform %q is not a known transform", gcpinfo.Transform)
+	}
 
-	//A context to stop receive after a certain time. We will restart the worker eventaully. This is done to keep it consistent with Azure Worker. May not be needed for gcp
-	cctx, cancel := context.WithTimeout(context.Background(), gcpinfo.Worker.Maxwaittime*time.Minute)
-	defer cancel()
-	err = Subscription.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
-		gcpinfo.mu.Lock()
-		gcpinfo.batch = append(gcpinfo.batch, msg)
+	if err := gcpinfo.Worker.checkMeta(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.Worker.checkLines(); err != nil {
+		return err
+	}
+
+	if gcpinfo.Max_routes < 0 {
+		return fmt.Errorf("ERROR: config field max_routes is %d, it must be positive", gcpinfo.Max_routes)
+	}
+	if gcpinfo.Route_attr != "" && gcpinfo.Worker.HEC != nil {
+		return errors.New("ERROR: config field route_by_attribute cannot be combined with workerinfo.hec, it routes to files")
+	}
+	if err := gcpinfo.checkRoutePool(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.checkDecompress(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.checkLabel(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.checkOrderingKey(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.checkMessageID(); err != nil {
+		return err
+	}
+
+	if _, err := ParseFilter(gcpinfo.Filter); err != nil {
+		return fmt.Errorf("ERROR: config field filter %q is not valid: %v", gcpinfo.Filter, err)
+	}
+
+	if gcpinfo.Include_attr && gcpinfo.Transform != "attributes" {
+		return fmt.Errorf("ERROR: config field include_attributes cannot be combined with transform %q", gcpinfo.Transform)
+	}
+	if err := gcpinfo.checkAttributeLists(); err != nil {
+		return err
+	}
+
+	if gcpinfo.Worker.Max_batch_bytes < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_batch_bytes is %d, it must be positive", gcpinfo.Worker.Max_batch_bytes)
+	}
+
+	if gcpinfo.Worker.Min_free_disk < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.min_free_disk_bytes is %d, it must be positive", gcpinfo.Worker.Min_free_disk)
+	}
+
+	if err := gcpinfo.Worker.checkAckWarning(); err != nil {
+		return err
+	}
+	if gcpinfo.Worker.Attempt_warning < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.delivery_attempt_warning is %d, it must be positive", gcpinfo.Worker.Attempt_warning)
+	}
+
+	if gcpinfo.Worker.Max_messages < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_messages is %d, it must be positive", gcpinfo.Worker.Max_messages)
+	}
+
+	if gcpinfo.Worker.Max_rate < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_messages_per_second is %d, it must be positive", gcpinfo.Worker.Max_rate)
+	}
+
+	if b := gcpinfo.Worker.Writer_buffer_bytes; b != 0 && (b < MinWriterBuffer || b > MaxWriterBuffer) {
+		return fmt.Errorf("ERROR: config field workerinfo.writer_buffer_bytes is %d, it must be between %d and %d", b, MinWriterBuffer, MaxWriterBuffer)
+	}
+
+	if gcpinfo.Worker.Maxwaitmin < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.maxwaitmin is %d, it must be positive", gcpinfo.Worker.Maxwaitmin)
+	}
+
+	if gcpinfo.Worker.Flush_interval < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.flush_interval is %d, it must be positive", gcpinfo.Worker.Flush_interval)
+	}
+
+	if gcpinfo.Worker.Dedup_size < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.dedup_size is %d, it must be positive", gcpinfo.Worker.Dedup_size)
+	}
+
+	if gcpinfo.Worker.Heartbeat_interval < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.heartbeat_interval is %d, it must be positive", gcpinfo.Worker.Heartbeat_interval)
+	}
+
+	//a batch is only acked once it is full, so flow control has to let a whole batch through
+	if gcpinfo.Worker.Max_outstanding < gcpinfo.Worker.Batchsize {
+		return fmt.Errorf("ERROR: config field workerinfo.max_outstanding_messages is %d, it must be at least the batchsize %d", gcpinfo.Worker.Max_outstanding, gcpinfo.Worker.Batchsize)
+	}
+	if gcpinfo.Worker.Manual_pull && gcpinfo.Worker.Max_outstanding != gcpinfo.Worker.Batchsize {
+		return fmt.Errorf("ERROR: config field workerinfo.max_outstanding_messages is %d, with workerinfo.manual_pull it must be left out or be the batchsize %d", gcpinfo.Worker.Max_outstanding, gcpinfo.Worker.Batchsize)
+	}
+
+	if gcpinfo.Worker.Num_goroutines < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.num_goroutines is %d, it must be positive", gcpinfo.Worker.Num_goroutines)
+	}
 
-		if len(gcpinfo.batch) > int(gcpinfo.Worker.Batchsize) {
-			gcpinfo.Flush()
+	if gcpinfo.Worker.Maxextension < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_extension is %v, it must be positive", gcpinfo.Worker.Maxextension)
+	}
+
+	if gcpinfo.Worker.Deadletter_attempts < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.deadletter_attempts is %d, it must be positive", gcpinfo.Worker.Deadletter_attempts)
+	}
+
+	if err := gcpinfo.Worker.checkRotation(); err != nil {
+		return err
+	}
+
+	if err := gcpinfo.Worker.checkHEC(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkSpool(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkSinkType(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkOversize(); err != nil {
+		return err
+	}
+	if err := gcpinfo.Worker.checkTee(); err != nil {
+		return err
+	}
+	for _, tee := range gcpinfo.Worker.Tee {
+		if tee.Type == TeeFile && gcpinfo.Route_attr != "" {
+			return errors.New("ERROR: config field workerinfo.tee file does not go with route_by_attribute, every route would append to it")
 		}
-		gcpinfo.mu.Unlock()
-	})
-	if err != nil {
-		return errors.New("ERROR:error to receive messages, is the pub/sub up and does the user logmonitor has view permissions?")
 	}
-	gcpinfo.Worker.Worker_logger_info.Println("Closing GCP Receiver")
+	if gcpinfo.Worker.Sink_type == SinkFIFO && gcpinfo.Route_attr != "" {
+		return errors.New("ERROR: config field workerinfo.sink_type fifo does not go with route_by_attribute, each route would get a fifo of its own")
+	}
+	//HEC is not a file at all
+	if gcpinfo.Worker.Fsync_on_flush && gcpinfo.Worker.HEC != nil {
+		return errors.New("ERROR: config field workerinfo.fsync_on_flush cannot be combined with workerinfo.hec")
+	}
+
+	//at_most_once acks on receive, which a dry run must never do
+	if gcpinfo.Worker.Dry_run && gcpinfo.Worker.Delivery_mode == AtMostOnce {
+		return errors.New("ERROR: config field workerinfo.dry_run cannot be combined with workerinfo.delivery_mode at_most_once")
+	}
+
+	if gcpinfo.Worker.Connect_attempts < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.connect_attempts is %d, it must be positive", gcpinfo.Worker.Connect_attempts)
+	}
+
+	if err := checkWritable(gcpinfo.Worker.Message_log_path, orDefault(gcpinfo.Worker.Dirmode, 0744)); err != nil {
+		return fmt.Errorf("ERROR: config field workerinfo.messagelogpath %q is not writable: %v", gcpinfo.Worker.Message_log_path, err)
+	}
 	return nil
 }
 
-//create a message log file
-func CreateMessageLogFiles(logpath string, filename string) error {
-	//Create the target log file.
-	err := os.MkdirAll(logpath, 0744)
+//checkWritable makes sure dir exists and a file can be created in it.
+
+func checkWritable(dir string, mode os.FileMode) error {
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(dir, ".writecheck")
 	if err != nil {
-		return errors.New("Error: Unable to create target log files path")
+		return err
 	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
 
-	//create a file with topic name as the filename
-	if _, err := os.Stat(logpath + "/" + filename + ".log"); os.IsNotExist(err) {
-		file, err := os.Create(logpath + "/" + filename + ".log")
-		defer file.Close()
-		if err != nil {
-			return errors.New("Error: Unable to create target log file")
+//expandEnv replaces $VAR and ${VAR} in the project and path fields. An unset variable is an error rather than an empty path.
+
+func (gcpinfo *GCPInfo) expandEnv() error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"project", &gcpinfo.Project},
+		{"keyfile", &gcpinfo.Keyfile},
+		{"messagelogpath", &gcpinfo.Worker.Message_log_path},
+		{"workerlogpath", &gcpinfo.Worker.Worker_log_path},
+		{"deadletter_path", &gcpinfo.Worker.Deadletter_path},
+	}
+
+	for _, field := range fields {
+		var missing []string
+		expanded := os.Expand(*field.value, func(name string) string {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("ERROR: config field %s references unset environment variable(s) %s", field.name, strings.Join(missing, ", "))
 		}
+		*field.value = expanded
 	}
 	return nil
 }
+
+func (gcpinfo *GCPInfo) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	gcpinfo.metricsSrv = &http.Server{Addr: gcpinfo.Worker.Metrics_addr, Handler: mux}
+
+	go func() {
+		if err := gcpinfo.metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			gcpinfo.Worker.Worker_logger_error.Println("Metrics endpoint stopped:", err)
+		}
+	}()
+}
+
+// Flush writes the current batch to the sink and acks it, unless delivery_mode at_most_once already acked it on
+// receive. In dry_run it only logs the batch and nacks it. It returns the first write or flush error, the batch is
+// nacked by then. It is safe to call from any goroutine while Consume runs.
+//
+// A batch goes through the same steps every time: all its lines are written into the buffer, the buffer is flushed
+// to the file, the file is fsynced with fsync_on_flush, and only then is every message of the batch acked, once, in
+// one go. Any failure along the way nacks the whole batch instead, nothing of it is acked. With route_concurrency each
+// route of route_by_attribute goes through these steps on its own, a failing route only nacks its own messages.
+func (gcpinfo *GCPInfo) Flush() error {
+	gcpinfo.mu.Lock()
+	if gcpinfo.sink == nil && gcpinfo.handler == nil && !gcpinfo.Worker.Dry_run {
+		//nothing has been received yet
+		gcpinfo.mu.Unlock()
+		return nil
+	}
+	err := gcpinfo.flush()
+	gcpinfo.mu.Unlock()
+	gcpinfo.ackQueued()
+	return err
+}
+
+//flush is Flush for callers already holding gcpinfo.mu. Callers that cannot return the error log it. A batch that is
+//not empty goes through BeforeFlush and AfterFlush on its way.
+
+func (gcpinfo *GCPInfo) flush() error {
+	if len(gcpinfo.batch) == 0 {
+		_, err := gcpinfo.writeBatch()
+		return err
+	}
+	if gcpinfo.Ordered {
+		sortByOrderingKey(gcpinfo.batch)
+	}
+	if gcpinfo.BeforeFlush != nil {
+		gcpinfo.BeforeFlush(append([]*pubsub.Message(nil), gcpinfo.batch...))
+	}
+	n, err := gcpinfo.writeBatch()
+	if gcpinfo.AfterFlush != nil {
+		gcpinfo.AfterFlush(n, err)
+	}
+	return err
+}
+
+//writeBatch writes the batch to the sink or the handler and settles it, returning how many of its messages went out.
+//With route_concurrency only the routes that failed are nacked, the others are acked.
+
+func (gcpinfo *GCPInfo) writeBatch() (int, error) {
+	start := time.Now()
+	if len(gcpinfo.batch) > 0 {
+		gcpinfo.processed += len(gcpinfo.batch)
+		gcpinfo.lastFlush = start
+	}
+	if gcpinfo.Worker.Dry_run {
+		gcpinfo.flushDryRun()
+		return 0, nil
+	}
+	if gcpinfo.handler != nil {
+		return gcpinfo.flushToHandler(start)
+	}
+
+	//render every message first, a message that cannot be rendered is nacked on its own and left out of the batch
+	pending := make([]*pubsub.Message, 0, len(gcpinfo.batch))
+	lines := make([][]byte, 0, len(gcpinfo.batch))
+	held := heldKeys{}
+	copies := batchCopies{}
+	for _, msg := range gcpinfo.batch {
+		if gcpinfo.duplicate(msg, copies) {
+			continue
+		}
+		if held.holds(msg) {
+			gcpinfo.settle(msg, errHeldBack)
+			continue
+		}
+		if gcpinfo.oversize(msg, held) {
+			continue
+		}
+		line, err := gcpinfo.line(msg)
+		if err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to transform", messageID(msg), "nacking:", err)
+			gcpinfo.settle(msg, err)
+			held.hold(gcpinfo, msg)
+			continue
+		}
+		pending = append(pending, msg)
+		lines = append(lines, line)
+	}
+
+	err := gcpinfo.checkDisk(&gcpinfo.Worker)
+	if err == nil {
+		err = gcpinfo.reopenIfGone(&gcpinfo.Worker, gcpinfo.messageLogName())
+	}
+	//only what the sink itself fails is spooled, not a failure from before anything was written
+	spoolable := err == nil && gcpinfo.spool != nil
+	groups := gcpinfo.group(pending, lines)
+	var written int
+	if err == nil && gcpinfo.Route_pool > 1 && len(groups) > 1 {
+		groups, written, err = gcpinfo.writeGroups(groups)
+	} else {
+		for _, group := range groups {
+			if err != nil {
+				break
+			}
+			var n int
+			n, err = gcpinfo.writeGroup(group)
+			written += n
+		}
+		//one route failing nacks the whole batch
+		groups = []*routeGroup{{msgs: pending, lines: lines, err: err}}
+	}
+	if err != nil && spoolable {
+		err = gcpinfo.spoolGroups(groups)
+	}
+	gcpinfo.flushErr = err
+
+	var ok int
+	for _, group := range groups {
+		if group.err != nil && fatalWrite(group.err) {
+			gcpinfo.stopOnFatal(group.err)
+		}
+		if group.err == nil {
+			for _, msg := range group.msgs {
+				gcpinfo.written(msg)
+			}
+			ok += len(group.msgs)
+		}
+		gcpinfo.settleBatch(group.msgs, group.err, gcpinfo.firstAt)
+		for _, msg := range group.msgs {
+			copies.settle(gcpinfo, msg, group.err)
+		}
+	}
+	copies.release(gcpinfo)
+
+	if len(pending) > 0 {
+		if ok > 0 {
+			metrics.BytesWritten.Add(gcpinfo.Subscription, uint64(written))
+			gcpinfo.counts.bytesWritten.Add(uint64(written))
+			gcpinfo.Worker.debug("Flushed", ok, "messages,", written, "bytes")
+		}
+		metrics.Flushes.Inc(gcpinfo.Subscription)
+		gcpinfo.counts.flushes.Add(1)
+		metrics.FlushDuration.Observe(gcpinfo.Subscription, time.Since(start).Seconds())
+	}
+
+	gcpinfo.resetBatch()
+
+	if err != nil {
+		gcpinfo.failed++
+		metrics.FlushFailures.Inc(gcpinfo.Subscription)
+		if ok > 0 {
+			return ok, fmt.Errorf("Unable to write %d of the %d messages of the batch, nacked them, failed flush %d since startup: %w", len(pending)-ok, len(pending), gcpinfo.failed, err)
+		}
+		return 0, fmt.Errorf("Unable to write batch of %d messages, nacked, failed flush %d since startup: %w", len(pending), gcpinfo.failed, err)
+	}
+	return len(pending), nil
+}
+
+//writeGroup writes the lines of a group to the sink of its route and flushes it, returning the bytes written.
+
+func (gcpinfo *GCPInfo) writeGroup(group *routeGroup) (int, error) {
+	sink, err := gcpinfo.routeSink(group.key)
+	if err != nil {
+		return 0, err
+	}
+	return writeLines(sink, group.lines)
+}
+
+//writeLines writes lines to sink and flushes it, returning the bytes written.
+
+func writeLines(sink Sink, lines [][]byte) (int, error) {
+	var written int
+	for _, line := range lines {
+		if err := sink.Write(line); err != nil {
+			return written, err
+		}
+		written += len(line)
+	}
+	return written, sink.Flush()
+}
+
+// FailedFlushes is how many batches failed to write or flush since the worker was created. The count is cumulative for
+// the life of the process, it is never reset, not even by a successful flush or a restarted receive cycle.
+func (gcpinfo *GCPInfo) FailedFlushes() uint64 {
+	gcpinfo.mu.RLock()
+	defer gcpinfo.mu.RUnlock()
+	return gcpinfo.failed
+}
+
+//flushToHandler gives each message of the batch to the ConsumeFunc handler and acks or nacks it on its own. It returns
+//the first handler error.
+
+func (gcpinfo *GCPInfo) flushToHandler(start time.Time) (int, error) {
+	var first error
+	var n int
+	held := heldKeys{}
+	copies := batchCopies{}
+	for _, msg := range gcpinfo.batch {
+		if gcpinfo.duplicate(msg, copies) {
+			continue
+		}
+		if held.holds(msg) {
+			gcpinfo.settle(msg, errHeldBack)
+			continue
+		}
+		if gcpinfo.oversize(msg, held) {
+			continue
+		}
+		err := gcpinfo.handler(msg.Data, msg.Attributes)
+		if err != nil {
+			held.hold(gcpinfo, msg)
+			gcpinfo.Worker.Worker_logger_error.Println("Handler failed for", messageID(msg), "nacking:", err)
+			if first == nil {
+				first = fmt.Errorf("Handler failed for %s: %w", messageID(msg), err)
+			}
+		} else {
+			n++
+			gcpinfo.written(msg)
+			metrics.BytesWritten.Add(gcpinfo.Subscription, uint64(len(msg.Data)))
+			gcpinfo.counts.bytesWritten.Add(uint64(len(msg.Data)))
+		}
+		gcpinfo.settle(msg, err)
+		copies.settle(gcpinfo, msg, err)
+	}
+	copies.release(gcpinfo)
+
+	if len(gcpinfo.batch) > 0 {
+		metrics.Flushes.Inc(gcpinfo.Subscription)
+		gcpinfo.counts.flushes.Add(1)
+		metrics.FlushDuration.Observe(gcpinfo.Subscription, time.Since(start).Seconds())
+	}
+	if gcpinfo.Worker.Delivery_mode != AtMostOnce {
+		gcpinfo.observeAck(gcpinfo.firstAt, n)
+	}
+	gcpinfo.resetBatch()
+	return n, first
+}
+
+//resetBatch empties the batch once it is flushed.
+
+func (gcpinfo *GCPInfo) resetBatch() {
+	gcpinfo.batch = make([]*pubsub.Message, 0, gcpinfo.Worker.Batchsize)
+	gcpinfo.firstAt = time.Time{}
+	gcpinfo.flushed()
+}
+
+//dryRunSample is how many messages of each batch a dry run logs.
+
+const dryRunSample = 5
+
+//flushDryRun logs what flush would write for the first few messages of the batch and nacks all of it. The nack skips
+//the dead-letter file so a dry run leaves no trace anywhere.
+
+func (gcpinfo *GCPInfo) flushDryRun() {
+	for i, msg := range gcpinfo.batch {
+		if i < dryRunSample {
+			if line, err := gcpinfo.line(msg); err != nil {
+				gcpinfo.Worker.Worker_logger_info.Println("DRY RUN: unable to transform", messageID(msg), err)
+			} else {
+				gcpinfo.Worker.Worker_logger_info.Printf("DRY RUN: would write %s: %s", messageID(msg), strings.TrimSuffix(string(line), "\n"))
+			}
+		}
+		nackMessage(msg)
+	}
+	if len(gcpinfo.batch) > 0 {
+		gcpinfo.Worker.Worker_logger_info.Println("DRY RUN: nacked a batch of", len(gcpinfo.batch), "messages")
+		metrics.MessagesNacked.Add(gcpinfo.Subscription, uint64(len(gcpinfo.batch)))
+		gcpinfo.counts.nacked.Add(uint64(len(gcpinfo.batch)))
+	}
+	gcpinfo.resetBatch()
+}
+
+//settleBatch settles the messages of a flushed batch in a tight loop, acking them when err is nil and nacking them
+//otherwise. Flush calls it once per batch, after the buffer flush and the fsync, so no message is acked before it is
+//on disk. The time spent acking goes to metrics.AckDuration. With async_ack or exactly_once the acks are only queued,
+//see ackQueued.
+
+func (gcpinfo *GCPInfo) settleBatch(msgs []*pubsub.Message, err error, received time.Time) {
+	if err == nil && (gcpinfo.Worker.Async_ack || gcpinfo.Worker.Delivery_mode == ExactlyOnce) && gcpinfo.Worker.Delivery_mode != AtMostOnce {
+		gcpinfo.queueAcks(msgs, received)
+		return
+	}
+	gcpinfo.settleNow(msgs, err, received)
+}
+
+//queueAcks queues msgs for ackQueued. received is when the first of them came in, zero leaves it to the next batch.
+
+func (gcpinfo *GCPInfo) queueAcks(msgs []*pubsub.Message, received time.Time) {
+	if gcpinfo.acksFrom.IsZero() {
+		gcpinfo.acksFrom = received
+	}
+	gcpinfo.acks = append(gcpinfo.acks, msgs...)
+}
+
+//settleNow settles msgs right away, see settleBatch. received is when the first of them came in, see observeAck.
+
+func (gcpinfo *GCPInfo) settleNow(msgs []*pubsub.Message, err error, received time.Time) {
+	start := time.Now()
+	if err == nil && gcpinfo.Worker.Delivery_mode == ExactlyOnce {
+		gcpinfo.ackConfirmed(msgs)
+	} else {
+		for _, msg := range msgs {
+			gcpinfo.settle(msg, err)
+		}
+	}
+	if err == nil && len(msgs) > 0 && gcpinfo.Worker.Delivery_mode != AtMostOnce {
+		metrics.AckDuration.Observe(gcpinfo.Subscription, time.Since(start).Seconds())
+		gcpinfo.observeAck(received, len(msgs))
+	}
+}
+
+//ackQueued acks the batches async_ack queued in settleBatch. The callers of flush call it once they released mu, so the
+//acks of one batch no longer hold up the callbacks writing the next one. The queue only ever holds batches that were
+//flushed and fsynced, the guarantee of Flush does not change, only the lock it is kept under. Acking a message is
+//cheap on the client, it is queued for the next ack request, but with many goroutines every callback waits for the
+//whole batch under mu. BenchmarkReceiveAck, 1000 messages in batches of 100 with a sleeping ack, took 1.06s a run
+//with the acks under mu and 0.11s with async_ack, the acks of different batches overlap instead of queueing up behind
+//the lock. Failed batches are still nacked under mu. exactly_once always queues its acks, waiting for pub/sub to
+//confirm them under mu would stop every callback for up to AckResultTimeout.
+
+func (gcpinfo *GCPInfo) ackQueued() {
+	gcpinfo.mu.Lock()
+	acks, received := gcpinfo.acks, gcpinfo.acksFrom
+	gcpinfo.acks, gcpinfo.acksFrom = nil, time.Time{}
+	gcpinfo.mu.Unlock()
+	if len(acks) > 0 {
+		gcpinfo.settleNow(acks, nil, received)
+	}
+}
+
+//settle acks msg once it is written, or nacks it when err says it was not. In at_most_once mode the message was acked
+//on receive and there is nothing left to do, a failed write loses it.
+
+func (gcpinfo *GCPInfo) settle(msg *pubsub.Message, err error) {
+	if gcpinfo.Worker.Delivery_mode == AtMostOnce {
+		if err != nil {
+			metrics.MessagesDropped.Inc(gcpinfo.Subscription)
+		}
+		return
+	}
+	if err != nil {
+		gcpinfo.nack(msg)
+		return
+	}
+	if gcpinfo.Worker.Delivery_mode == ExactlyOnce {
+		gcpinfo.queueAcks([]*pubsub.Message{msg}, time.Time{})
+		return
+	}
+	ackMessage(msg)
+	metrics.MessagesAcked.Inc(gcpinfo.Subscription)
+	gcpinfo.counts.acked.Add(1)
+}
+
+//line renders one message as it is written to the sink, the raw payload unless a transform is set. With
+//timestamp_format the line starts with the publish time in UTC so Splunk can take the event time from it, inject_label
+//adds source_label to it, include_ordering_key the ordering key and include_message_id the message ID.
+//one_line_per_event and line_terminator decide how it fits on one line.
+
+func (gcpinfo *GCPInfo) line(msg *pubsub.Message) ([]byte, error) {
+	out := msg.Data
+	if gcpinfo.TransformFunc != nil {
+		var err error
+		if out, err = gcpinfo.TransformFunc(msg); err != nil {
+			return nil, err
+		}
+	}
+	//field mode falls back to a prefix for lines that are not json objects, see tagLine
+	var labelPrefix, keyPrefix, idPrefix []byte
+	switch gcpinfo.Inject_label {
+	case LabelField:
+		out, labelPrefix = gcpinfo.tagLine(out, gcpinfo.label, []byte(strings.Replace(DefaultLabelPrefix, "{label}", gcpinfo.Source_label, -1)))
+	case LabelPrefix:
+		labelPrefix = gcpinfo.label
+	}
+	if msg.OrderingKey != "" {
+		key := jsonString(msg.OrderingKey)
+		prefix := append(append([]byte(orderingKeyPrefix), key...), ' ')
+		switch gcpinfo.Ordering_key {
+		case LabelField:
+			out, keyPrefix = gcpinfo.tagLine(out, append([]byte(orderingKeyField), key...), prefix)
+		case LabelPrefix:
+			keyPrefix = prefix
+		}
+	}
+	if gcpinfo.Include_id {
+		out, idPrefix = gcpinfo.tagMessageID(out, msg.ID)
+	}
+	out = gcpinfo.Worker.oneLine(out)
+	var line []byte
+	if layout := gcpinfo.Worker.Timestamp_layout; layout != "" {
+		line = append(msg.PublishTime.UTC().AppendFormat(line, layout), ' ')
+	}
+	line = append(line, labelPrefix...)
+	line = append(line, keyPrefix...)
+	line = append(line, idPrefix...)
+	line = append(line, out...)
+	return gcpinfo.Worker.terminate(line), nil
+}
+
+// Consume receives messages from the subscription into the message log until the max wait time expires or ctx is
+// cancelled, whichever comes first. Cancelling ctx stops the receiver straight away, the batch it holds is flushed.
+func (gcpinfo *GCPInfo) Consume(ctx context.Context) error {
+	err := gcpinfo.consume(ctx, nil)
+	if err != nil {
+		gcpinfo.reportError(err)
+	}
+	return err
+}
+
+// ConsumeFunc runs the same receive and batch loop as Consume, but each flushed message goes to handler instead of the
+// message log. A message is acked when handler returns nil and nacked otherwise. Cancelling ctx stops the receiver.
+func (gcpinfo *GCPInfo) ConsumeFunc(ctx context.Context, handler func(data []byte, attrs map[string]string) error) error {
+	if handler == nil {
+		return errors.New("ERROR: ConsumeFunc needs a handler")
+	}
+	err := gcpinfo.consume(ctx, handler)
+	if err != nil {
+		gcpinfo.reportError(err)
+	}
+	return err
+}
+
+//consume connects to the subscription and runs the receive loop, writing to the sink when handler is nil.
+
+func (gcpinfo *GCPInfo) consume(ctx context.Context, handler func(data []byte, attrs map[string]string) error) error {
+
+	gcpinfo.Worker.Worker_logger_info.Println("Starting Receiver")
+
+	gcpinfo.mu.RLock()
+	r := gcpinfo.receiver
+	gcpinfo.mu.RUnlock()
+	if r != nil {
+		gcpinfo.setReady()
+		return gcpinfo.receive(ctx, r, handler)
+	}
+
+	//the client is created once and reused across Run's receive cycles, until Shutdown closes it
+	client, err := gcpinfo.pubsubClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	Subscription := client.Subscription(gcpinfo.Subscription)
+
+	//client.Subscription never talks to the server, so check up front instead of failing vaguely inside Receive
+	switch {
+	case gcpinfo.Tail_topic:
+		err = gcpinfo.createTail(ctx, client)
+	case gcpinfo.Auto_create:
+		err = gcpinfo.ensureSubscription(ctx, client, Subscription)
+	default:
+		err = gcpinfo.checkExists(ctx, "subscription", gcpinfo.Subscription, Subscription.Exists)
+	}
+	if err != nil {
+		return err
+	}
+	if gcpinfo.Ack_deadline > 0 {
+		if err = gcpinfo.applyAckDeadline(ctx, Subscription); err != nil {
+			return err
+		}
+	} else if gcpinfo.Worker.Ack_warning > 0 {
+		if err = gcpinfo.noteAckDeadline(ctx, Subscription); err != nil {
+			return err
+		}
+	}
+	if gcpinfo.Ordered {
+		if err = gcpinfo.checkOrdering(ctx, Subscription); err != nil {
+			return err
+		}
+	}
+	if gcpinfo.Worker.Delivery_mode == ExactlyOnce {
+		if err = gcpinfo.checkExactlyOnce(ctx, Subscription); err != nil {
+			return err
+		}
+	}
+	if gcpinfo.Topic != "" {
+		if err = gcpinfo.checkExists(ctx, "topic", gcpinfo.Topic, client.Topic(gcpinfo.Topic).Exists); err != nil {
+			return err
+		}
+	}
+
+	gcpinfo.setReady()
+
+	gcpinfo.applyReceiveSettings(&Subscription.ReceiveSettings)
+
+	return gcpinfo.receive(ctx, Subscription, handler)
+}
+
+//applyReceiveSettings fills in the receive settings from the config, then runs ReceiveSettingsFunc. manual_pull
+//switches to synchronous pull with max_outstanding_messages at the batchsize: pub/sub hands out one batch, the next is
+//only pulled once it was flushed and acked, so pulls line up with flushes. The streaming default pulls ahead by
+//max_outstanding_messages, and its own flow control decides how bursts come in.
+
+func (gcpinfo *GCPInfo) applyReceiveSettings(settings *pubsub.ReceiveSettings) {
+	settings.MaxOutstandingMessages = gcpinfo.Worker.Max_outstanding
+	settings.NumGoroutines = gcpinfo.Worker.Num_goroutines
+	settings.Synchronous = gcpinfo.Worker.Manual_pull
+	//a slow flush holds the batch past its ack deadline, the client keeps extending it for up to max_extension
+	if gcpinfo.Worker.Maxextension > 0 {
+		settings.MaxExtension = gcpinfo.Worker.Maxextension
+	}
+	if gcpinfo.ReceiveSettingsFunc != nil {
+		gcpinfo.ReceiveSettingsFunc(settings)
+	}
+}
+
+//checkExists turns a missing subscription or topic into an actionable startup error.
+
+func (gcpinfo *GCPInfo) checkExists(ctx context.Context, kind string, name string, exists func(context.Context) (bool, error)) error {
+	var found bool
+	err := gcpinfo.retry(ctx, "check the "+kind, func() (err error) {
+		found, err = exists(ctx)
+		return err
+	})
+	if err != nil {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to check %s %q in project %q. Does the user have view permissions", kind, name, gcpinfo.Project), err)
+	}
+	if !found {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: %s %q not found in project %q", kind, name, gcpinfo.Project), nil)
+	}
+	return nil
+}
+
+//subscriptionConfig reads the config of the subscription, retrying on blips.
+
+func (gcpinfo *GCPInfo) subscriptionConfig(ctx context.Context, sub *pubsub.Subscription) (pubsub.SubscriptionConfig, error) {
+	var config pubsub.SubscriptionConfig
+	err := gcpinfo.retry(ctx, "read the subscription config", func() (err error) {
+		config, err = sub.Config(ctx)
+		return err
+	})
+	if err != nil {
+		return config, wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to read the config of subscription %q in project %q", gcpinfo.Subscription, gcpinfo.Project), err)
+	}
+	return config, nil
+}
+
+//checkOrdering makes sure the subscription delivers in ordering key order, sorting a batch is no use otherwise.
+
+func (gcpinfo *GCPInfo) checkOrdering(ctx context.Context, sub *pubsub.Subscription) error {
+	config, err := gcpinfo.subscriptionConfig(ctx, sub)
+	if err != nil {
+		return err
+	}
+	if !config.EnableMessageOrdering {
+		return wrap(ErrConfigInvalid, fmt.Sprintf("ERROR: config field ordered is set but subscription %q does not have message ordering enabled", gcpinfo.Subscription), nil)
+	}
+	return nil
+}
+
+// RestartBackoff is how long Run waits before starting the next receive cycle.
+var RestartBackoff = 5 * time.Second
+
+// Run keeps the worker going across the Maxwaittime cycles. Each time Consume comes back cleanly it is started again
+// on a fresh subscription handle. An error from Consume is fatal and ends Run, cancelling ctx or calling Shutdown
+// stops it with nil.
+func (gcpinfo *GCPInfo) Run(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	defer gcpinfo.deleteTail()
+	go func() {
+		select {
+		case <-ctx.Done():
+			gcpinfo.Shutdown(context.Background())
+		case <-stop:
+		}
+	}()
+
+	for {
+		if err := gcpinfo.Consume(ctx); err != nil {
+			return err
+		}
+		if gcpinfo.isStopping() {
+			return nil
+		}
+
+		gcpinfo.Worker.Worker_logger_info.Println("Max wait time reached, restarting GCP Receiver in", RestartBackoff)
+		select {
+		case <-time.After(RestartBackoff):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+//take counts a message into max_messages and reports whether it may still go into the batch. The message that
+//reaches max_messages stops the worker like Shutdown does: the receive cycle ends, its batch is flushed on the way out,
+//and Run returns nil instead of starting another cycle.
+
+func (gcpinfo *GCPInfo) take() bool {
+	if gcpinfo.Worker.Max_messages == 0 {
+		return true
+	}
+	gcpinfo.mu.Lock()
+	defer gcpinfo.mu.Unlock()
+
+	if gcpinfo.taken >= gcpinfo.Worker.Max_messages {
+		return false
+	}
+	gcpinfo.taken++
+	if gcpinfo.taken == gcpinfo.Worker.Max_messages {
+		gcpinfo.Worker.Worker_logger_info.Println("Reached max_messages", gcpinfo.taken, "stopping GCP Receiver")
+		gcpinfo.stopping = true
+		if gcpinfo.cancel != nil {
+			gcpinfo.cancel()
+		}
+	}
+	return true
+}
+
+func (gcpinfo *GCPInfo) isStopping() bool {
+	gcpinfo.mu.RLock()
+	defer gcpinfo.mu.RUnlock()
+	return gcpinfo.stopping
+}
+
+// CredentialsJSONEnv holds a service account key as a json string, for environments that cannot mount a key file.
+const CredentialsJSONEnv = "LOGWORKER_CREDENTIALS_JSON"
+
+// EmulatorHostEnv points the pub/sub client library at the emulator, e.g. in CI. It is honored like emulator_host.
+const EmulatorHostEnv = "PUBSUB_EMULATOR_HOST"
+
+//credentials picks the credentials for the pub/sub client and describes where they came from. The emulator, from
+//emulator_host or the PUBSUB_EMULATOR_HOST env var, takes no credentials at all and wins over everything. Otherwise
+//precedence is keyfile, then keyfile_json, then the LOGWORKER_CREDENTIALS_JSON env var. With none of those set the
+//options are nil and the client falls back to Application Default Credentials (workload identity on GKE, gcloud auth
+//locally).
+
+func (gcpinfo *GCPInfo) credentials() ([]option.ClientOption, string) {
+	if host := gcpinfo.Emulator; host != "" {
+		return []option.ClientOption{
+			option.WithEndpoint(host),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		}, "nowhere, emulator " + host
+	}
+	//the client library dials the emulator itself when no credentials are passed
+	if host := os.Getenv(EmulatorHostEnv); host != "" {
+		return nil, "nowhere, emulator " + host + " from " + EmulatorHostEnv
+	}
+	if gcpinfo.Keyfile != "" {
+		return []option.ClientOption{option.WithCredentialsFile(gcpinfo.Keyfile)}, "keyfile " + gcpinfo.Keyfile
+	}
+	if gcpinfo.Keyfile_json != "" {
+		return []option.ClientOption{option.WithCredentialsJSON([]byte(gcpinfo.Keyfile_json))}, "keyfile_json"
+	}
+	if creds := os.Getenv(CredentialsJSONEnv); creds != "" {
+		return []option.ClientOption{option.WithCredentialsJSON([]byte(creds))}, CredentialsJSONEnv
+	}
+	return nil, "application default credentials"
+}
+
+// receiver is the part of *pubsub.Subscription used by the consume loop. Tests supply a fake that synthesizes messages.
+type receiver interface {
+	Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error
+}
+
+//receive mirrors messages from the subscription into the sink, or hands them to handler when it is set, until the max
+//wait time expires or ctx is cancelled.
+
+func (gcpinfo *GCPInfo) receive(ctx context.Context, sub receiver, handler func(data []byte, attrs map[string]string) error) error {
+
+	//A context to stop receive after a certain time. Run restarts the worker after it. This is done to keep it consistent with Azure Worker. May not be needed for gcp
+	timeout := gcpinfo.Worker.cycleTimeout()
+	gcpinfo.Worker.debug("Receive cycle of", timeout)
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	gcpinfo.mu.Lock()
+	if gcpinfo.stopping {
+		gcpinfo.mu.Unlock()
+		return nil
+	}
+	//a dry run only previews and nacks, it may run next to the worker it previews
+	if !gcpinfo.Worker.Dry_run {
+		if err := gcpinfo.lockLog(&gcpinfo.Worker, gcpinfo.Subscription); err != nil {
+			gcpinfo.mu.Unlock()
+			return err
+		}
+	}
+	//the sink outlives a receive cycle, it stays open across restarts until Close. A handler takes its place, and a dry
+	//run writes nothing at all.
+	if handler == nil && !gcpinfo.Worker.Dry_run {
+		err := gcpinfo.openRetrying(ctx, &gcpinfo.Worker, gcpinfo.messageLogName(), &gcpinfo.stopping)
+		if err != nil || gcpinfo.stopping {
+			gcpinfo.mu.Unlock()
+			return err
+		}
+	}
+	gcpinfo.handler = handler
+	gcpinfo.cancel = cancel
+	gcpinfo.done = make(chan struct{})
+	defer close(gcpinfo.done)
+	gcpinfo.receiving = true
+	gcpinfo.mu.Unlock()
+
+	//stop cleanly on SIGINT/SIGTERM instead of losing the in-memory batch
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			gcpinfo.Worker.Worker_logger_info.Println("Received", sig, "shutting down GCP Receiver")
+			gcpinfo.Shutdown(context.Background())
+		case <-cctx.Done():
+		}
+	}()
+
+	//under low traffic a batch can take a long time to fill, flush it on a timer as well
+	var flushers sync.WaitGroup
+	if gcpinfo.Worker.Flush_every > 0 {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			gcpinfo.flushEvery(cctx, &gcpinfo.Worker, gcpinfo.flush, gcpinfo.ackQueued)
+		}()
+	}
+
+	//HEC may be back by now, post what was spooled while it was away
+	if gcpinfo.spool != nil && handler == nil {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			gcpinfo.drainEvery(cctx)
+		}()
+	}
+
+	//an idle worker logs nothing else, the heartbeat tells it apart from a stuck one
+	if gcpinfo.Worker.Heartbeat_every > 0 {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			gcpinfo.heartbeat(cctx, gcpinfo.Worker.Heartbeat_every)
+		}()
+	}
+
+	err := sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
+		metrics.MessagesReceived.Inc(gcpinfo.Subscription)
+		gcpinfo.counts.received.Add(1)
+		gcpinfo.recordAttempt(msg)
+		//a callback held here keeps its message outstanding, so once max_outstanding_messages are waiting flow control
+		//stops pub/sub from handing out more. A message still waiting when the cycle ends is nacked for redelivery.
+		if gcpinfo.limiter != nil {
+			if err := gcpinfo.limiter.Wait(ctx); err != nil {
+				nackMessage(msg)
+				metrics.MessagesNacked.Inc(gcpinfo.Subscription)
+				gcpinfo.counts.nacked.Add(1)
+				return
+			}
+		}
+		if err := gcpinfo.decompress(msg); err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to decompress", messageID(msg), "nacking:", err)
+			if gcpinfo.Worker.Dry_run {
+				nackMessage(msg)
+				metrics.MessagesNacked.Inc(gcpinfo.Subscription)
+				gcpinfo.counts.nacked.Add(1)
+				return
+			}
+			//a dead-lettered message is acked like a written one, exactly_once queues that ack under mu
+			gcpinfo.mu.Lock()
+			gcpinfo.nack(msg)
+			gcpinfo.mu.Unlock()
+			gcpinfo.ackQueued()
+			return
+		}
+		//a message the filter drops is acked straight away and never reaches the batch
+		if gcpinfo.filter != nil && !gcpinfo.filter(msg) {
+			if gcpinfo.Worker.Dry_run {
+				nackMessage(msg)
+			} else {
+				ackMessage(msg)
+			}
+			metrics.MessagesFiltered.Inc(gcpinfo.Subscription)
+			return
+		}
+		//past max_messages the receiver is already being stopped, what it still hands out goes back to pub/sub
+		if !gcpinfo.take() {
+			nackMessage(msg)
+			metrics.MessagesNacked.Inc(gcpinfo.Subscription)
+			gcpinfo.counts.nacked.Add(1)
+			return
+		}
+		if gcpinfo.Worker.Delivery_mode == AtMostOnce {
+			ackMessage(msg)
+			metrics.MessagesAcked.Inc(gcpinfo.Subscription)
+			gcpinfo.counts.acked.Add(1)
+		}
+		gcpinfo.mu.Lock()
+		if len(gcpinfo.batch) == 0 {
+			gcpinfo.firstAt = time.Now()
+		}
+		gcpinfo.batch = append(gcpinfo.batch, msg)
+		if gcpinfo.add(&gcpinfo.Worker, len(gcpinfo.batch), len(msg.Data)) {
+			if err := gcpinfo.flush(); err != nil {
+				gcpinfo.Worker.Worker_logger_error.Println(err)
+			}
+		}
+		gcpinfo.mu.Unlock()
+		gcpinfo.ackQueued()
+	})
+
+	//stop the timed flushes and the heartbeat before the sink is closed under them
+	cancel()
+	flushers.Wait()
+
+	//Receive has returned, so flush whatever is left in the batch. Otherwise the tail is never acked and gets redelivered.
+	gcpinfo.mu.Lock()
+	gcpinfo.receiving = false
+	if ferr := gcpinfo.flush(); ferr != nil {
+		gcpinfo.Worker.Worker_logger_error.Println(ferr)
+	}
+	fatal := gcpinfo.fatal
+	gcpinfo.mu.Unlock()
+	gcpinfo.ackQueued()
+
+	if fatal != nil {
+		return wrap(ErrWriteFatal, "ERROR: Unable to write the message log, stopped consuming instead of nacking every batch", fatal)
+	}
+	if err != nil {
+		return wrap(ErrReceive, "ERROR:error to receive messages, is the pub/sub up and does the user logmonitor has view permissions", err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("Closing GCP Receiver")
+	return nil
+}
+
+//heartbeat logs what the worker has been doing on every tick until ctx is done, idle ticks included.
+
+func (gcpinfo *GCPInfo) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			gcpinfo.mu.Lock()
+			processed, pending, lastFlush := gcpinfo.processed, len(gcpinfo.batch), "never"
+			if !gcpinfo.lastFlush.IsZero() {
+				lastFlush = gcpinfo.lastFlush.Format(time.RFC3339)
+			}
+			gcpinfo.processed = 0
+			gcpinfo.mu.Unlock()
+			gcpinfo.Worker.Worker_logger_info.Println("Heartbeat: processed", processed, "messages since the last heartbeat, batch holds", pending, "last flush", lastFlush)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//open opens the sink unless it is already open. Callers hold gcpinfo.mu.
+
+func (gcpinfo *GCPInfo) open() error {
+	return gcpinfo.batchWriter.open(&gcpinfo.Worker, gcpinfo.messageLogName())
+}
+
+// Close flushes the current batch, closes the sink and the worker log and returns the first error. It is safe to call
+// more than once and without Consume ever running, a later Consume opens the sink again and the worker log reopens on
+// its next line.
+func (gcpinfo *GCPInfo) Close() error {
+	err := gcpinfo.close(gcpinfo.flush)
+	gcpinfo.ackQueued()
+	gcpinfo.mu.Lock()
+	defer gcpinfo.mu.Unlock()
+	if cerr := gcpinfo.closeRoutes(); err == nil {
+		err = cerr
+	}
+	if lerr := closeWorkerLog(gcpinfo.workerlog); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+//closeWorkerLog closes the file behind the worker loggers, l is nil for a consumer built without openWorkerLog.
+
+func closeWorkerLog(l *lumberjack.Logger) error {
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
+
+//openSink opens the output for flushed batches configured in workerinfo, behind a tee when workerinfo.tee is set.
+
+func (worker *WorkerInfo) openSink(name string) (Sink, error) {
+	sink, err := worker.openOutput(name)
+	if err != nil || len(worker.Tee) == 0 {
+		return sink, err
+	}
+	return worker.openTee(sink)
+}
+
+//openOutput opens the sink of workerinfo, HEC when configured, the fifo with sink_type fifo and the message log file
+//name inside messagelogpath otherwise.
+
+func (worker *WorkerInfo) openOutput(name string) (Sink, error) {
+	if worker.HEC != nil {
+		if worker.HEC.Insecure {
+			worker.Worker_logger_error.Println("WARNING: workerinfo.hec.insecure_skip_verify is set, the certificate of", worker.HEC.URL, "is not checked")
+		}
+		return NewHECSink(*worker.HEC)
+	}
+	if worker.Sink_type == SinkFIFO {
+		if err := createFIFO(worker.Message_log_path, name, worker.Dirmode, worker.Filemode); err != nil {
+			return nil, err
+		}
+		sink, err := NewFIFOSink(worker.Message_log_path + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+	if worker.Rotation.byTime() {
+		return newTimeSink(name, worker.Rotation.every(), worker.openFileSink), nil
+	}
+	sink, err := worker.openFileSink(name)
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+//openFileSink opens the message log file name inside messagelogpath, creating it first.
+
+func (worker *WorkerInfo) openFileSink(name string) (*FileSink, error) {
+	//a {date} in the template or a time rotation period can name a file NewGCPclient did not create
+	if err := createMessageLog(worker.Message_log_path, name, worker.Dirmode, worker.Filemode); err != nil {
+		return nil, err
+	}
+	path := worker.Message_log_path + "/" + name
+	if worker.Rotation != nil && !worker.Rotation.byTime() {
+		sink := NewRotatingFileSink(path, *worker.Rotation)
+		if worker.Writer_buffer_bytes > 0 {
+			sink.SetBufferSize(worker.Writer_buffer_bytes)
+		}
+		if worker.Output_format == OutputJSONArray {
+			if err := sink.JSONArray(); err != nil {
+				return nil, err
+			}
+		}
+		return sink, nil
+	}
+	newSink := NewFileSink
+	if worker.Compress_messages {
+		newSink = NewGzipFileSink
+	}
+	sink, err := newSink(path)
+	if err != nil {
+		return nil, err
+	}
+	if worker.Writer_buffer_bytes > 0 {
+		sink.SetBufferSize(worker.Writer_buffer_bytes)
+	}
+	if worker.Fsync_on_flush {
+		if err = sink.SyncOnFlush(); err != nil {
+			sink.Close()
+			return nil, err
+		}
+	}
+	if worker.Output_format == OutputJSONArray {
+		if err = sink.JSONArray(); err != nil {
+			sink.Close()
+			return nil, err
+		}
+	}
+	if worker.Write_meta {
+		if err = sink.MetaOnClose(); err != nil {
+			sink.Close()
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+// DefaultFileNameTemplate names the message log when file_name_template is not set, with output_extension in place of
+// .log when that is set.
+const DefaultFileNameTemplate = "{subscription}.log"
+
+// DefaultOutputExtension ends the message log name when output_extension is not set.
+const DefaultOutputExtension = ".log"
+
+//checkOutputExtension checks workerinfo.output_extension. A file_name_template carries its own extension, the two
+//together would leave it unclear which one wins.
+
+func (worker *WorkerInfo) checkOutputExtension() error {
+	ext := worker.Output_extension
+	if ext == "" {
+		return nil
+	}
+	if ext[0] != '.' || len(ext) == 1 || strings.ContainsAny(ext, `/\`) {
+		return fmt.Errorf("ERROR: config field workerinfo.output_extension %q must be a dot and a file name extension like .json", ext)
+	}
+	if worker.File_name_template != "" {
+		return errors.New("ERROR: config field workerinfo.output_extension does not go with workerinfo.file_name_template, end the template with the extension instead")
+	}
+	return nil
+}
+
+//outputExtension is output_extension or DefaultOutputExtension.
+
+func (worker *WorkerInfo) outputExtension() string {
+	if worker.Output_extension == "" {
+		return DefaultOutputExtension
+	}
+	return worker.Output_extension
+}
+
+//fileNamePlaceholders are what file_name_template can use. {date} is the day the message log is opened, the file is
+//not switched at midnight while a receive cycle runs.
+
+var fileNamePlaceholders = map[string]func(gcpinfo *GCPInfo) string{
+	"subscription": func(gcpinfo *GCPInfo) string { return gcpinfo.Subscription },
+	"project":      func(gcpinfo *GCPInfo) string { return gcpinfo.Project },
+	"hostname": func(gcpinfo *GCPInfo) string {
+		hostname, _ := os.Hostname()
+		return hostname
+	},
+	"date": func(gcpinfo *GCPInfo) string { return time.Now().Format("2006-01-02") },
+}
+
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+//checkFileNameTemplate rejects placeholders messageLogName does not know and templates that are a path.
+
+func checkFileNameTemplate(template string) error {
+	if strings.ContainsRune(template, filepath.Separator) {
+		return errors.New("it must be a file name, not a path")
+	}
+	for _, p := range placeholder.FindAllString(template, -1) {
+		if _, ok := fileNamePlaceholders[p[1:len(p)-1]]; !ok {
+			return fmt.Errorf("unknown placeholder %s", p)
+		}
+	}
+	return nil
+}
+
+//messageLogName is the message log file name inside Message_log_path, file_name_template expanded. A compressed log
+//gets .gz on the end.
+
+func (gcpinfo *GCPInfo) messageLogName() string {
+	template := gcpinfo.Worker.File_name_template
+	if template == "" {
+		template = strings.TrimSuffix(DefaultFileNameTemplate, DefaultOutputExtension) + gcpinfo.Worker.outputExtension()
+	}
+	name := placeholder.ReplaceAllStringFunc(template, func(p string) string {
+		return fileNamePlaceholders[p[1:len(p)-1]](gcpinfo)
+	})
+	if gcpinfo.Worker.Compress_messages {
+		return name + ".gz"
+	}
+	return name
+}
+
+// Shutdown stops a running Consume. The receive loop is cancelled, the current batch is flushed and the message log is closed.
+// It returns once that is done or when ctx expires, and is safe to call more than once. The temporary subscription of
+// tail_topic is deleted before the client is closed, the lock file taken by the first receive cycle is released last,
+// see LockSuffix.
+func (gcpinfo *GCPInfo) Shutdown(ctx context.Context) error {
+	gcpinfo.mu.Lock()
+	gcpinfo.stopping = true
+	cancel, done := gcpinfo.cancel, gcpinfo.done
+	gcpinfo.mu.Unlock()
+
+	if gcpinfo.metricsSrv != nil {
+		gcpinfo.metricsSrv.Close()
+	}
+	if gcpinfo.healthSrv != nil {
+		gcpinfo.healthSrv.Close()
+	}
+
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err := gcpinfo.Close()
+	if terr := gcpinfo.deleteTail(); err == nil {
+		err = terr
+	}
+	if cerr := gcpinfo.closeClient(); err == nil {
+		err = cerr
+	}
+	gcpinfo.mu.Lock()
+	defer gcpinfo.mu.Unlock()
+	if cerr := gcpinfo.unlockLog(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// create a message log file, filename with DefaultOutputExtension
+func CreateMessageLogFiles(logpath string, filename string) error {
+	return createMessageLog(logpath, filename+".log", 0, 0)
+}
+
+//createMessageLog creates logpath/name unless it already exists. A non-zero dirMode or fileMode is applied to the
+//directory and the file even when they exist, so the forwarder user can read them whatever the umask is.
+
+func createMessageLog(logpath string, name string, dirMode os.FileMode, fileMode os.FileMode) error {
+	//Create the target log file.
+	err := os.MkdirAll(logpath, orDefault(dirMode, 0744))
+	if err != nil {
+		return wrap(ErrFileOpen, "Error: Unable to create target log files path", err)
+	}
+	if dirMode != 0 {
+		if err = os.Chmod(logpath, dirMode); err != nil {
+			return wrap(ErrFileOpen, "Error: Unable to set the mode of target log files path", err)
+		}
+	}
+
+	//create a file with topic name as the filename
+	if _, err := os.Stat(logpath + "/" + name); os.IsNotExist(err) {
+		file, err := os.OpenFile(logpath+"/"+name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, orDefault(fileMode, 0666))
+		if err != nil {
+			return wrap(ErrFileOpen, "Error: Unable to create target log file", err)
+		}
+		file.Close()
+	}
+	if fileMode != 0 {
+		if err = os.Chmod(logpath+"/"+name, fileMode); err != nil {
+			return wrap(ErrFileOpen, "Error: Unable to set the mode of target log file", err)
+		}
+	}
+	return nil
+}
+
+func orDefault(mode os.FileMode, def os.FileMode) os.FileMode {
+	if mode == 0 {
+		return def
+	}
+	return mode
+}
+
+//parseMode reads an octal mode like "0755" from the config field name, empty is 0.
+
+func parseMode(name string, value string) (os.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("ERROR: config field workerinfo.%s %q must be an octal mode like \"0755\"", name, value)
+	}
+	return os.FileMode(mode), nil
+}
@@ -1,33 +1,1447 @@
 package consumers
 
 import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var subscription string = "AllEvents-Sriram-Test"
 var topic string = "AllEvents"
 var project string = "box-all-events-pub-sub"
-var gcp_log_path string = "/tmp/"
-var workerlog string = "/tmp/workerlogtest.log"
-var file *os.File
 
 func TestNewGCPclient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{
+		"project": "`+project+`",
+		"topic": "`+topic+`",
+		"subscription": "`+subscription+`",
+		"keyfile": "key.json",
+		"workerinfo": {
+			"messagelogpath": "`+dir+`/messages",
+			"workerlogpath": "`+dir+`",
+			"batchsize": 10,
+			"maxwaitmin": 2
+		}
+	}`)
+
+	client, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	if client.Project != project || client.Topic != topic || client.Subscription != subscription || client.Keyfile != "key.json" {
+		t.Errorf("unexpected parsed fields %+v", client)
+	}
+	if client.Worker.Message_log_path != dir+"/messages" || client.Worker.Worker_log_path != dir {
+		t.Errorf("unexpected parsed paths %+v", client.Worker)
+	}
+	if client.Worker.Batchsize != 10 || client.Worker.Maxwaittime != 2*time.Minute {
+		t.Errorf("unexpected batchsize %d or max wait time %v", client.Worker.Batchsize, client.Worker.Maxwaittime)
+	}
+	if client.Worker.Worker_logger_info == nil || client.Worker.Worker_logger_error == nil {
+		t.Error("expected the worker loggers to be set up")
+	}
+	if _, err := os.Stat(dir + "/messages/" + subscription + ".log"); err != nil {
+		t.Errorf("expected the message log file to be created: %v", err)
+	}
+}
+
+//newTestGCPInfo builds a client writing into a fresh temp dir without reading a config file.
+
+func newTestGCPInfo(t testing.TB, batchsize int) *GCPInfo {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+
+	gcpinfo := &GCPInfo{
+		Subscription: subscription,
+		Project:      project,
+		Worker: WorkerInfo{
+			Message_log_path:    dir,
+			Batchsize:           batchsize,
+			Maxwaittime:         time.Minute,
+			Worker_logger_info:  log.New(ioutil.Discard, "INFO: ", 0),
+			Worker_logger_error: log.New(ioutil.Discard, "ERROR: ", 0),
+		},
+	}
+	gcpinfo.batch = make([]*pubsub.Message, 0, batchsize)
+
+	if err = CreateMessageLogFiles(dir, subscription); err != nil {
+		t.Fatal(err)
+	}
+	return gcpinfo
+}
+
+func readMessageLog(t *testing.T, gcpinfo *GCPInfo) []string {
+	content, err := ioutil.ReadFile(gcpinfo.Worker.Message_log_path + "/" + gcpinfo.Subscription + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestReceiveFlushesTailOnTimeout(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+	}}
+
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readMessageLog(t, gcpinfo)
+	if len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+		t.Errorf("expected both messages in the log, got %q", lines)
+	}
+	if len(gcpinfo.batch) != 0 {
+		t.Errorf("expected empty batch after receive, got %d", len(gcpinfo.batch))
+	}
+}
+
+func TestReceiveFlushesAtBatchsize(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+	}}
+	fake.delivered = func(ctx context.Context) {
+		//the tail flush has not run yet, so anything on disk came from the size based flush
+		if len(gcpinfo.batch) != 0 {
+			t.Errorf("expected a flush at batchsize 2, batch still holds %d", len(gcpinfo.batch))
+		}
+		if lines := readMessageLog(t, gcpinfo); len(lines) != 2 {
+			t.Errorf("expected 2 lines after the flush, got %q", lines)
+		}
+	}
+
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveFlushesAtMaxBatchBytes(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 100)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Max_batch_bytes = 6
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: []byte("3")},
+	}}
+	fake.delivered = func(ctx context.Context) {
+		//one and two reach 6 bytes long before the batchsize of 100
+		if len(gcpinfo.batch) != 1 || gcpinfo.batchBytes != 1 {
+			t.Errorf("expected a flush at 6 bytes, batch still holds %d messages and %d bytes", len(gcpinfo.batch), gcpinfo.batchBytes)
+		}
+		if lines := readMessageLog(t, gcpinfo); len(lines) != 2 {
+			t.Errorf("expected 2 lines after the flush, got %q", lines)
+		}
+	}
+
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewGCPclientYAMLMatchesJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	jsonfile := dir + "/worker.json"
+	if err = ioutil.WriteFile(jsonfile, []byte(`{
+		"project": "`+project+`",
+		"subscription": "`+subscription+`",
+		"transform": "envelope",
+		"workerinfo": {
+			"messagelogpath": "`+dir+`",
+			"workerlogpath": "`+dir+`",
+			"batchsize": 10,
+			"maxwaitmin": 2,
+			"flush_interval": 30,
+			"file_mode": "0640",
+			"rotation": {"maxsize": 100, "compress": true},
+			"hec": {"url": "https://splunk:8088/services/collector/event", "token": "t"}
+		}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yamlfile := dir + "/worker.yaml"
+	if err = ioutil.WriteFile(yamlfile, []byte(`
+project: `+project+`
+subscription: `+subscription+`
+transform: envelope
+workerinfo:
+  messagelogpath: `+dir+`
+  workerlogpath: `+dir+`
+  batchsize: 10
+  maxwaitmin: 2
+  flush_interval: 30
+  file_mode: "0640"
+  rotation:
+    maxsize: 100
+    compress: true
+  hec:
+    url: https://splunk:8088/services/collector/event
+    token: t
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fromJSON, err := NewGCPclient(jsonfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := NewGCPclient(yamlfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fromYAML.Project != fromJSON.Project || fromYAML.Subscription != fromJSON.Subscription || fromYAML.Transform != fromJSON.Transform {
+		t.Errorf("expected the same top level fields, got %+v and %+v", fromYAML, fromJSON)
+	}
+	//the loggers write to different files, everything else should match
+	jsonWorker, yamlWorker := fromJSON.Worker, fromYAML.Worker
+	jsonWorker.Worker_logger_debug, jsonWorker.Worker_logger_info, jsonWorker.Worker_logger_error = nil, nil, nil
+	yamlWorker.Worker_logger_debug, yamlWorker.Worker_logger_info, yamlWorker.Worker_logger_error = nil, nil, nil
+	if !reflect.DeepEqual(jsonWorker, yamlWorker) {
+		t.Errorf("expected the same workerinfo, got %+v and %+v", yamlWorker, jsonWorker)
+	}
+}
+
+//writeTestConfig writes a json config into dir and returns its path.
+
+func writeTestConfig(t *testing.T, dir string, config string) string {
+	path := dir + "/config.json"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMaxwaitminIsMinutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{
+		"project": "`+project+`",
+		"subscription": "`+subscription+`",
+		"keyfile": "key.json",
+		"workerinfo": {
+			"messagelogpath": "`+dir+`",
+			"workerlogpath": "`+dir+`",
+			"maxwaitmin": 5
+		}
+	}`)
+
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Worker.Maxwaittime != 5*time.Minute {
+		t.Errorf("expected 5m max wait time, got %v", gcpinfo.Worker.Maxwaittime)
+	}
+
+	start := time.Now()
+	fake := &fakeReceiver{}
+	fake.delivered = func(ctx context.Context) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Fatal("expected receive context to have a deadline")
+		}
+		if d := deadline.Sub(start); d < 5*time.Minute-time.Second || d > 5*time.Minute+time.Second {
+			t.Errorf("expected a deadline 5m out, got %v", d)
+		}
+	}
+
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewGCPclientRejectsBadBatchsize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	for _, batchsize := range []string{"-1", "1000000", "2.5"} {
+		configfile := writeTestConfig(t, dir, `{
+			"project": "`+project+`",
+			"subscription": "`+subscription+`",
+			"keyfile": "key.json",
+			"workerinfo": {
+				"messagelogpath": "`+dir+`",
+				"workerlogpath": "`+dir+`",
+				"batchsize": `+batchsize+`
+			}
+		}`)
+		if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "batchsize") {
+			t.Errorf("expected a batchsize error for %s, got %v", batchsize, err)
+		}
+	}
+}
+
+func TestFlushAcksWholeBatch(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*acked) != 2 || len(*nacked) != 0 {
+		t.Errorf("expected 2 acks and no nacks, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestFlushNacksWholeBatchOnWriteFailure(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("one")},
+		&pubsub.Message{ID: "2", Data: []byte("two")},
+	)
+	if err := gcpinfo.Flush(); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("expected Flush to return the write error, got %v", err)
+	}
+
+	if len(*acked) != 0 || len(*nacked) != 2 {
+		t.Errorf("expected the whole batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if len(gcpinfo.batch) != 0 {
+		t.Errorf("expected empty batch after flush, got %d", len(gcpinfo.batch))
+	}
+}
+
+func TestShutdownFlushesAndStopsReceive(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	delivered := make(chan struct{})
+	fake := &fakeReceiver{
+		msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}},
+		wait: true,
+	}
+	fake.delivered = func(ctx context.Context) { close(delivered) }
+
+	result := make(chan error)
+	go func() { result <- gcpinfo.receive(context.Background(), fake, nil) }()
+	<-delivered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gcpinfo.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	//a second call must not block or fail
+	if err := gcpinfo.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "one" {
+		t.Errorf("expected the batch flushed on shutdown, got %q", lines)
+	}
+}
+
+func TestNewGCPclientExpandsEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LOGWORKER_TEST_DIR", dir)
+	defer os.Unsetenv("LOGWORKER_TEST_DIR")
+
+	configfile := writeTestConfig(t, dir, `{
+		"project": "`+project+`",
+		"subscription": "`+subscription+`",
+		"keyfile": "key.json",
+		"workerinfo": {
+			"messagelogpath": "${LOGWORKER_TEST_DIR}/messages",
+			"workerlogpath": "$LOGWORKER_TEST_DIR"
+		}
+	}`)
+
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Worker.Message_log_path != dir+"/messages" {
+		t.Errorf("expected expanded message log path, got %q", gcpinfo.Worker.Message_log_path)
+	}
+	if _, err := os.Stat(dir + "/messages/" + subscription + ".log"); err != nil {
+		t.Errorf("expected message log under the expanded path: %v", err)
+	}
+
+	//an unset variable names the field instead of falling back to an empty path
+	os.Unsetenv("LOGWORKER_TEST_DIR")
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "messagelogpath") {
+		t.Errorf("expected an error naming messagelogpath, got %v", err)
+	}
+}
+
+func TestNewGCPclientNamesMissingField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{
+		"subscription": "`+subscription+`",
+		"keyfile": "key.json",
+		"workerinfo": {
+			"messagelogpath": "`+dir+`",
+			"workerlogpath": "`+dir+`"
+		}
+	}`)
+
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "project") {
+		t.Errorf("expected an error naming project, got %v", err)
+	}
+}
+
+func TestCredentialsPrecedence(t *testing.T) {
+	os.Setenv(CredentialsJSONEnv, `{"type":"service_account"}`)
+	defer os.Unsetenv(CredentialsJSONEnv)
+
+	gcpinfo := &GCPInfo{Keyfile: "key.json", Keyfile_json: `{"type":"service_account"}`}
+	for _, want := range []string{"keyfile key.json", "keyfile_json", CredentialsJSONEnv} {
+		if _, source := gcpinfo.credentials(); source != want {
+			t.Errorf("expected credentials from %s, got %s", want, source)
+		}
+		//drop the winning source and check the next one takes over
+		switch {
+		case gcpinfo.Keyfile != "":
+			gcpinfo.Keyfile = ""
+		case gcpinfo.Keyfile_json != "":
+			gcpinfo.Keyfile_json = ""
+		default:
+			os.Unsetenv(CredentialsJSONEnv)
+		}
+	}
+
+	if opt, source := gcpinfo.credentials(); opt != nil || source != "application default credentials" {
+		t.Errorf("expected a fall back to ADC, got %s", source)
+	}
+}
+
+func TestCredentialsSkippedForEmulator(t *testing.T) {
+	gcpinfo := &GCPInfo{Keyfile: "key.json", Emulator: "localhost:8085"}
+	if opts, source := gcpinfo.credentials(); len(opts) == 0 || source != "nowhere, emulator localhost:8085" {
+		t.Errorf("expected emulator_host to win over keyfile, got %s", source)
+	}
+
+	gcpinfo.Emulator = ""
+	os.Setenv(EmulatorHostEnv, "localhost:8085")
+	defer os.Unsetenv(EmulatorHostEnv)
+	if opts, _ := gcpinfo.credentials(); opts != nil {
+		t.Errorf("expected no credentials with %s set, got %d options", EmulatorHostEnv, len(opts))
+	}
+}
+
+func TestReceiveFlushesOnInterval(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 100)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Flush_every = 10 * time.Millisecond
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}}
+	fake.delivered = func(ctx context.Context) {
+		//the batch is far from full, only the ticker can write it out
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if content, _ := ioutil.ReadFile(gcpinfo.Worker.Message_log_path + "/" + subscription + ".log"); string(content) == "one\n" {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("expected the partial batch flushed by the interval")
+	}
+
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeartbeatLogsWhileIdle(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 100)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	var out bytes.Buffer
+	gcpinfo.Worker.Worker_logger_info = log.New(&out, "INFO: ", 0)
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+
+	//heartbeat returns once ctx is done, so out is safe to read after it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	gcpinfo.heartbeat(ctx, 10*time.Millisecond)
+
+	if !strings.Contains(out.String(), "Heartbeat: processed 0 messages since the last heartbeat, batch holds 1 last flush never") {
+		t.Errorf("expected idle heartbeats, got %q", out.String())
+	}
+}
+
+//run with -race to check the locking.
+
+func TestReceiveConcurrentCallbacks(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 7)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Flush_every = time.Millisecond
+
+	fake := &concurrentReceiver{}
+	for i := 0; i < 500; i++ {
+		fake.msgs = append(fake.msgs, &pubsub.Message{ID: strconv.Itoa(i), Data: []byte(strconv.Itoa(i))})
+	}
+
+	//flushes from outside the receive loop must be safe too
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				gcpinfo.Flush()
+			}
+		}
+	}()
+
+	err := gcpinfo.receive(context.Background(), fake, nil)
+	close(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readMessageLog(t, gcpinfo)
+	seen := map[string]bool{}
+	for _, line := range lines {
+		seen[line] = true
+	}
+	if len(lines) != 500 || len(seen) != 500 {
+		t.Errorf("expected all 500 messages written once, got %d lines, %d distinct", len(lines), len(seen))
+	}
+}
+
+func TestReceiveWithHandler(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	var handled []string
+	handler := func(data []byte, attrs map[string]string) error {
+		if attrs["fail"] == "yes" {
+			return errors.New("handler failed")
+		}
+		handled = append(handled, string(data))
+		return nil
+	}
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two"), Attributes: map[string]string{"fail": "yes"}},
+		{ID: "3", Data: []byte("three")},
+	}}, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handled) != 2 || handled[0] != "one" || handled[1] != "three" {
+		t.Errorf("expected the handler to get one and three, got %q", handled)
+	}
+	if len(*acked) != 2 || len(*nacked) != 1 || (*nacked)[0] != "2" {
+		t.Errorf("expected just the failed message nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	//nothing goes to the message log when a handler is set
+	if content, _ := ioutil.ReadFile(gcpinfo.Worker.Message_log_path + "/" + subscription + ".log"); len(content) != 0 {
+		t.Errorf("expected an empty message log, got %q", content)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	//never consumed
+	if err := gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	//the file stays open after a receive cycle and is only closed here
+	if gcpinfo.sink == nil {
+		t.Fatal("expected the sink to outlive the receive cycle")
+	}
+	if err := gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a flush after close must not touch the closed file
+	gcpinfo.Flush()
+
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "one" {
+		t.Errorf("expected the message written before close, got %q", lines)
+	}
+}
+
+func TestCloseClosesWorkerLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("before close")
+	if err = gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a closed worker log opens its path again on the next line instead of writing on into the moved file
+	path := gcpinfo.workerlog.Filename
+	if err = os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("after close")
+	gcpinfo.Close()
+	if content, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(content), "after close") || strings.Contains(string(content), "before close") {
+		t.Errorf("expected only the line after close in a reopened %s, got %q %v", path, content, err)
+	}
+}
+
+func TestWorkerLogNamedAfterConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	nested := dir + "/etc/worker"
+	if err = os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := `{
+		"project": "` + project + `",
+		"subscription": "` + subscription + `",
+		"workerinfo": {
+			"messagelogpath": "` + dir + `",
+			"workerlogpath": "` + dir + `/logs"
+		}
+	}`
+	configfile := nested + "/foo.json"
+	if err = ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dir + "/logs/foo.log"; gcpinfo.workerlog.Filename != want {
+		t.Errorf("expected worker log %s, got %s", want, gcpinfo.workerlog.Filename)
+	}
+}
+
+func TestWorkerLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := gcpinfo.workerlog; l.MaxSize != 500 || l.MaxBackups != 3 || l.MaxAge != 18 || !l.Compress {
+		t.Errorf("expected the default rotation 500/3/18/compressed, got %d/%d/%d/%v", l.MaxSize, l.MaxBackups, l.MaxAge, l.Compress)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`",
+		"worker_log_maxsize":50,"worker_log_maxbackups":0,"worker_log_maxage":90,"worker_log_compress":false}}`)
+	if gcpinfo, err = NewGCPclient(configfile); err != nil {
+		t.Fatal(err)
+	}
+	if l := gcpinfo.workerlog; l.MaxSize != 50 || l.MaxBackups != 0 || l.MaxAge != 90 || l.Compress {
+		t.Errorf("expected the configured rotation 50/0/90/uncompressed, got %d/%d/%d/%v", l.MaxSize, l.MaxBackups, l.MaxAge, l.Compress)
+	}
+
+	for _, field := range []string{"worker_log_maxsize", "worker_log_maxbackups", "worker_log_maxage"} {
+		configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","`+field+`":-1}}`)
+		if _, err = NewGCPclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected a negative %s to be rejected, got %v", field, err)
+		}
+	}
+}
+
+func TestConsumeWithFakeReceiver(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.receiver = &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: []byte("three")},
+	}}
+
+	if err := gcpinfo.Consume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 3 {
+		t.Errorf("expected all 3 messages written, got %q", lines)
+	}
+	if len(*acked) != 3 || len(*nacked) != 0 {
+		t.Errorf("expected 3 acks, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestConsumeStopsWhenParentIsCancelled(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.receiver = &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}, wait: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := gcpinfo.Consume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected Consume to stop on cancel, it ran for %v of a %v max wait", elapsed, gcpinfo.Worker.Maxwaittime)
+	}
+	if len(*acked) != 1 {
+		t.Errorf("expected the held batch flushed and acked, got %v", *acked)
+	}
+}
+
+func TestRunStopsAfterMaxMessages(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Max_messages = 3
+	var msgs []*pubsub.Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, &pubsub.Message{ID: strconv.Itoa(i), Data: []byte("m" + strconv.Itoa(i))})
+	}
+	gcpinfo.receiver = &fakeReceiver{msgs: msgs, wait: true}
+
+	if err := gcpinfo.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"m0", "m1", "m2"}) {
+		t.Errorf("expected exactly 3 messages written, got %q", lines)
+	}
+	if len(*acked) != 3 || len(*nacked) != 2 {
+		t.Errorf("expected 3 acks and the rest nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestAtLeastOnceAcksAfterWrite(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = AtLeastOnce
+
+	//look at the message log at the moment each message is acked
+	var written []int
+	ackMessage = func(msg *pubsub.Message) { written = append(written, len(readMessageLog(t, gcpinfo))) }
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
 
-	if _, err := os.Stat(workerlog); os.IsNotExist(err) {
-		file, err := os.Create(workerlog)
-		defer file.Close()
+	if len(written) != 2 || written[0] != 2 || written[1] != 2 {
+		t.Errorf("expected both messages acked after the batch was written, got log lengths %v", written)
+	}
+}
+
+func TestAtMostOnceAcksOnReceive(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Delivery_mode = AtMostOnce
+
+	//the flush fails, the messages are gone either way
+	gcpinfo.sink = failingSink{}
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*acked) != 2 || len(*nacked) != 0 {
+		t.Errorf("expected both messages acked on receive and none nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestNewGCPclientRejectsBadDeliveryMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","delivery_mode":"exactly_twice"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "delivery_mode") {
+		t.Errorf("expected an error naming delivery_mode, got %v", err)
+	}
+}
+
+func TestFlushNacksWholeBatchOnSyncFailure(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	file := &unsyncableFile{}
+	sink := &FileSink{file: file, writer: bufio.NewWriter(file)}
+	sink.out = sink.writer
+	if err := sink.SyncOnFlush(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.sink = sink
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("one")},
+		&pubsub.Message{ID: "2", Data: []byte("two")},
+	)
+	gcpinfo.Flush()
+
+	if file.Len() == 0 {
+		t.Error("expected the batch written before the fsync")
+	}
+	if len(*acked) != 0 || len(*nacked) != 2 {
+		t.Errorf("expected the whole batch nacked when fsync fails, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestNewGCPclientAppliesModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logdir := dir + "/logs"
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+logdir+`","workerlogpath":"`+dir+`","dir_mode":"0750","file_mode":"0640"}}`)
+	if _, err = NewGCPclient(configfile); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, mode := range map[string]os.FileMode{logdir: 0750, logdir + "/s.log": 0640} {
+		info, err := os.Stat(path)
 		if err != nil {
-			t.Error("Not able to create file")
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected %s with mode %v, got %v", path, mode, info.Mode().Perm())
+		}
+	}
+}
+
+func TestNewGCPclientRejectsBadMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, field := range []string{"dir_mode", "file_mode"} {
+		configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","`+field+`":"0789"}}`)
+		if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected an error naming %s, got %v", field, err)
+		}
+	}
+}
+
+func TestDryRunLogsAndNacks(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Dry_run = true
+	var out bytes.Buffer
+	gcpinfo.Worker.Worker_logger_info = log.New(&out, "INFO: ", 0)
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: []byte("three")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(gcpinfo.Worker.Message_log_path + "/" + subscription + ".log"); len(content) != 0 {
+		t.Errorf("expected nothing written in a dry run, got %q", content)
+	}
+	if len(*acked) != 0 || len(*nacked) != 3 {
+		t.Errorf("expected every message nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if !strings.Contains(out.String(), "DRY RUN: would write message_id=3: three") {
+		t.Errorf("expected the messages logged, got %q", out.String())
+	}
+}
+
+func TestFileNameTemplate(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.File_name_template = "{subscription}-{hostname}-{date}.log"
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Close()
+
+	hostname, _ := os.Hostname()
+	path := gcpinfo.Worker.Message_log_path + "/" + subscription + "-" + hostname + "-" + time.Now().Format("2006-01-02") + ".log"
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "one\n" {
+		t.Errorf("expected the message in %s, got %q %v", path, content, err)
+	}
+}
+
+func TestOutputExtension(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Output_extension = ".json"
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Close()
+
+	path := gcpinfo.Worker.Message_log_path + "/" + subscription + ".json"
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "one\n" {
+		t.Errorf("expected the message in %s, got %q %v", path, content, err)
+	}
+}
+
+func TestCheckOutputExtension(t *testing.T) {
+	for _, tc := range []struct {
+		ext, template string
+		ok            bool
+	}{
+		{"", "", true},
+		{".json", "", true},
+		{".tar.log", "", true},
+		{"json", "", false},
+		{".", "", false},
+		{"./x", "", false},
+		{".json", "{subscription}-{date}.log", false},
+	} {
+		worker := &WorkerInfo{Output_extension: tc.ext, File_name_template: tc.template}
+		if err := worker.checkOutputExtension(); (err == nil) != tc.ok {
+			t.Errorf("output_extension %q with template %q: expected ok %v, got %v", tc.ext, tc.template, tc.ok, err)
+		}
+	}
+}
+
+func TestNewGCPclientRejectsUnknownPlaceholder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","file_name_template":"{subscription}-{region}.log"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "{region}") {
+		t.Errorf("expected an error naming {region}, got %v", err)
+	}
+}
+
+func TestNewGCPclientRejectsBadWriterBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, size := range []string{"1024", "1073741824"} {
+		configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","writer_buffer_bytes":`+size+`}}`)
+		if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "writer_buffer_bytes") {
+			t.Errorf("expected writer_buffer_bytes %s rejected, got %v", size, err)
+		}
+	}
+}
+
+func TestNewGCPclientRejectsJSONArrayWithCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","output_format":"json_array","compress_messages":true}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "output_format") {
+		t.Errorf("expected an error naming output_format, got %v", err)
+	}
+}
+
+func TestLinePrefixesPublishTime(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Timestamp_layout = time.RFC3339
+
+	published := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	line, err := gcpinfo.line(&pubsub.Message{Data: []byte("one"), PublishTime: published})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != "2020-01-02T02:04:05Z one\n" {
+		t.Errorf("expected the publish time in UTC before the payload, got %q", line)
+	}
+}
+
+func TestNewGCPclientRejectsTimestampWithoutZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","timestamp_format":"2006-01-02 15:04:05"}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "timestamp_format") {
+		t.Errorf("expected an error naming timestamp_format, got %v", err)
+	}
+}
+
+func TestReceiveIsPacedByMaxRate(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.limiter = rate.NewLimiter(rate.Limit(20), 1)
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: []byte("three")},
+	}}
+	start := time.Now()
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+	//the first message goes straight through, the other two wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected 3 messages at 20 a second to take about 100ms, took %v", elapsed)
+	}
+	if len(*acked) != 3 || len(*nacked) != 0 {
+		t.Errorf("expected all 3 messages acked, got %v acked and %v nacked", *acked, *nacked)
+	}
+}
+
+func TestNewGCPclientWithOverridesValidatesOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//a dry run flag on an at_most_once config has to fail the same way the config file would
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","delivery_mode":"at_most_once"}}`)
+	_, err = NewGCPclientWithOverrides(configfile, func(gcpinfo *GCPInfo) { gcpinfo.Worker.Dry_run = true })
+	if err == nil || !strings.Contains(err.Error(), "dry_run") {
+		t.Errorf("expected an error naming dry_run, got %v", err)
+	}
+}
+
+func TestNewGCPclientParsesMaxExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","max_extension":"90m"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Worker.Maxextension != 90*time.Minute {
+		t.Errorf("expected max_extension of 90m, got %v", gcpinfo.Worker.Maxextension)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","max_extension":"ninety"}}`)
+	if _, err = NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "max_extension") {
+		t.Errorf("expected an error naming max_extension, got %v", err)
+	}
+}
+
+func TestFailedFlushesCountsAcrossFlushes(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	gcpinfo.sink = failingSink{}
+	for i := 0; i < 2; i++ {
+		gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: strconv.Itoa(i), Data: []byte("one")})
+		gcpinfo.Flush()
+	}
+	if n := gcpinfo.FailedFlushes(); n != 2 {
+		t.Fatalf("expected 2 failed flushes, got %d", n)
+	}
+
+	//a good flush does not reset the count
+	gcpinfo.sink = nil
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "2", Data: []byte("two")})
+	gcpinfo.Flush()
+	if n := gcpinfo.FailedFlushes(); n != 2 {
+		t.Errorf("expected the count to stay at 2 after a good flush, got %d", n)
+	}
+}
+
+func TestFlushReturnsNilOnSuccess(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if err := gcpinfo.Flush(); err != nil {
+		t.Errorf("expected nil before anything was received, got %v", err)
+	}
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Errorf("expected a clean flush, got %v", err)
+	}
+}
+
+func TestFlushReopensRemovedMessageLog(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "0", Data: []byte("before")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(gcpinfo.Worker.Message_log_path + "/" + gcpinfo.Subscription + ".log"); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("after")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "after" {
+		t.Errorf("expected the batch after the removal in a recreated message log, got %q", lines)
+	}
+}
+
+func TestNewGCPclientNeedsWorkerLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`"}}`)
+	if _, err = NewGCPclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "workerlogpath") {
+		t.Fatalf("expected an empty workerlogpath to be rejected, got %v", err)
+	}
+
+	name := filepath.Base(dir)
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","allow_tmp_fallback":true,"worker_log_name":"`+name+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(TmpWorkerLogPath, name+".log"))
+	if gcpinfo.Worker.Worker_log_path != TmpWorkerLogPath {
+		t.Errorf("expected the worker log in %s, got %s", TmpWorkerLogPath, gcpinfo.Worker.Worker_log_path)
+	}
+}
+
+func TestFlushAcksOnceAfterBufferFlush(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+	var events []string
+	ackMessage = func(msg *pubsub.Message) { events = append(events, "ack "+msg.ID) }
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.sink = eventSink{&events}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")}, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"write", "write", "flush", "ack 1", "ack 2"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("expected %v, got %v", want, events)
+	}
+}
+
+func TestNewGCPclientWithOptionsKeepsOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclientWithOptions(configfile, option.WithQuotaProject("billing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gcpinfo.clientOpts) != 1 {
+		t.Errorf("expected the option kept for the client, got %d options", len(gcpinfo.clientOpts))
+	}
+	if _, err = NewGCPclientWithOptions(dir + "/missing.json"); !errors.Is(err, ErrConfigRead) {
+		t.Errorf("expected the config error of NewGCPclient, got %v", err)
+	}
+}
+
+func TestFlushAsyncAckAcksAfterUnlock(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Async_ack = true
+	var events []string
+	gcpinfo.sink = eventSink{&events}
+	ackMessage = func(msg *pubsub.Message) {
+		if !gcpinfo.mu.TryLock() {
+			t.Error("expected the ack outside the batch lock")
+			return
+		}
+		gcpinfo.mu.Unlock()
+		events = append(events, "ack "+msg.ID)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")}, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"write", "write", "flush", "ack 1", "ack 2"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("expected %v, got %v", want, events)
+	}
+	if len(gcpinfo.acks) != 0 {
+		t.Errorf("expected no acks left queued, got %d", len(gcpinfo.acks))
+	}
+}
+
+func TestFlushAsyncAckNacksFailedBatch(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Async_ack = true
+	gcpinfo.sink = failingSink{}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err == nil {
+		t.Fatal("expected the flush error")
+	}
+	if len(*acked) != 0 || !reflect.DeepEqual(*nacked, []string{"1"}) {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+//BenchmarkReceiveAck compares acking under the batch lock with async_ack. The ack sleeps, standing in for a client
+//whose ack queue is contended, so the numbers only compare the two modes.
+
+func BenchmarkReceiveAck(b *testing.B) {
+	for _, async := range []bool{false, true} {
+		name := "sync"
+		if async {
+			name = "async"
 		}
+		b.Run(name, func(b *testing.B) {
+			_, _, restore := recordAcks()
+			defer restore()
+			ackMessage = func(msg *pubsub.Message) { time.Sleep(20 * time.Microsecond) }
+
+			gcpinfo := newTestGCPInfo(b, 100)
+			defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+			gcpinfo.Worker.Async_ack = async
+
+			fake := &concurrentReceiver{}
+			for i := 0; i < 1000; i++ {
+				fake.msgs = append(fake.msgs, &pubsub.Message{ID: strconv.Itoa(i), Data: []byte(strconv.Itoa(i))})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			gcpinfo.Close()
+		})
+	}
+}
+
+func TestFlushRunsHooksAroundBatch(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	var events []string
+	gcpinfo.sink = eventSink{&events}
+	gcpinfo.BeforeFlush = func(batch []*pubsub.Message) {
+		events = append(events, "before "+strconv.Itoa(len(batch)))
+		//the hook gets a copy, dropping a message from it must not keep it from being acked
+		batch[0] = nil
+	}
+	gcpinfo.AfterFlush = func(n int, err error) { events = append(events, fmt.Sprint("after ", n, " failed ", err != nil)) }
+
+	//an empty flush still flushes the sink, but runs no hooks
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")}, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
 	}
+	gcpinfo.sink = failingSink{}
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "3", Data: []byte("three")})
+	gcpinfo.Flush()
 
-	client, err := NewGCPclient(subscription, project, topic, gcp_log_path, file)
+	want := []string{"flush", "before 2", "write", "write", "flush", "after 2 failed false", "before 1", "after 0 failed true"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("expected %q, got %q", want, events)
+	}
+	if !reflect.DeepEqual(*acked, []string{"1", "2"}) {
+		t.Errorf("expected the batch acked despite the hook, got %v", *acked)
+	}
+}
 
+func TestManualPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
 	if err != nil {
-		t.Error("Error creating client")
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":50,"manual_pull":true}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var settings pubsub.ReceiveSettings
+	gcpinfo.applyReceiveSettings(&settings)
+	if !settings.Synchronous || settings.MaxOutstandingMessages != 50 {
+		t.Errorf("expected a synchronous pull of one batch of 50, got %+v", settings)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":50}}`)
+	if gcpinfo, err = NewGCPclient(configfile); err != nil {
+		t.Fatal(err)
+	}
+	settings = pubsub.ReceiveSettings{}
+	gcpinfo.applyReceiveSettings(&settings)
+	if settings.Synchronous || settings.MaxOutstandingMessages != pubsub.DefaultReceiveSettings.MaxOutstandingMessages {
+		t.Errorf("expected streaming pull by default, got %+v", settings)
+	}
 
-	} else {
-		t.Log("Client created successfully")
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","batchsize":50,"manual_pull":true,"max_outstanding_messages":100}}`)
+	if _, err = NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "manual_pull") {
+		t.Errorf("expected max_outstanding_messages past the batch rejected with manual_pull, got %v", err)
 	}
 }
@@ -0,0 +1,57 @@
+package consumers
+
+import (
+	"net/http"
+)
+
+//serveHealth opens the probe endpoints on health_addr, for kubernetes liveness and readiness checks.
+
+func (gcpinfo *GCPInfo) serveHealth() {
+	gcpinfo.healthSrv = &http.Server{Addr: gcpinfo.Worker.Health_addr, Handler: gcpinfo.healthHandler()}
+
+	go func() {
+		if err := gcpinfo.healthSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			gcpinfo.Worker.Worker_logger_error.Println("Health endpoint stopped:", err)
+		}
+	}()
+}
+
+//healthHandler serves /healthz, 200 while the receive loop runs and the last flush went through, and /readyz, 200 once
+//the client is created and the subscription was found. Run's restart backoff is a short window with the receiver
+//stopped, so a liveness probe should allow a few failures in a row.
+
+func (gcpinfo *GCPInfo) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		gcpinfo.mu.RLock()
+		receiving, flushErr := gcpinfo.receiving, gcpinfo.flushErr
+		gcpinfo.mu.RUnlock()
+
+		switch {
+		case flushErr != nil:
+			http.Error(w, "last flush failed: "+flushErr.Error(), http.StatusServiceUnavailable)
+		case !receiving:
+			http.Error(w, "receiver is not running", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok\n"))
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		gcpinfo.mu.RLock()
+		ready := gcpinfo.ready
+		gcpinfo.mu.RUnlock()
+
+		if !ready {
+			http.Error(w, "not connected to the subscription yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+func (gcpinfo *GCPInfo) setReady() {
+	gcpinfo.mu.Lock()
+	gcpinfo.ready = true
+	gcpinfo.mu.Unlock()
+}
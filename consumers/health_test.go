@@ -0,0 +1,67 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func probe(gcpinfo *GCPInfo, path string) int {
+	rec := httptest.NewRecorder()
+	gcpinfo.healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestHealthz(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if code := probe(gcpinfo, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before receive starts, got %d", code)
+	}
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}}
+	fake.delivered = func(ctx context.Context) {
+		if code := probe(gcpinfo, "/healthz"); code != http.StatusOK {
+			t.Errorf("expected 200 while receiving, got %d", code)
+		}
+		//the next flush fails
+		gcpinfo.mu.Lock()
+		gcpinfo.sink = failingSink{}
+		gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "2", Data: []byte("two")})
+		gcpinfo.flush()
+		gcpinfo.mu.Unlock()
+		if code := probe(gcpinfo, "/healthz"); code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 after a failed flush, got %d", code)
+		}
+	}
+	_, _, restore := recordAcks()
+	defer restore()
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := probe(gcpinfo, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the receiver exited, got %d", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if code := probe(gcpinfo, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before the subscription is checked, got %d", code)
+	}
+
+	gcpinfo.receiver = &fakeReceiver{}
+	if err := gcpinfo.Consume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := probe(gcpinfo, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected 200 once consuming, got %d", code)
+	}
+}
@@ -0,0 +1,190 @@
+package consumers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// HECInfo configures posting batches straight to a Splunk HTTP Event Collector instead of the message log file.
+type HECInfo struct {
+	URL         string `json:"url" yaml:"url"` //full collector endpoint, e.g. https://splunk:8088/services/collector/event
+	Token       string `json:"token" yaml:"token"`
+	Index       string `json:"index,omitempty" yaml:"index,omitempty"`
+	Timeoutsec  int    `json:"timeout_sec,omitempty" yaml:"timeout_sec,omitempty"`
+	Maxattempts int    `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`                 //attempts per batch when HEC answers 5xx
+	Tls_cert    string `json:"tls_cert,omitempty" yaml:"tls_cert,omitempty"`                         //client certificate PEM file for mutual TLS, needs tls_key
+	Tls_key     string `json:"tls_key,omitempty" yaml:"tls_key,omitempty"`                           //private key PEM file of tls_cert
+	Tls_ca      string `json:"tls_ca,omitempty" yaml:"tls_ca,omitempty"`                             //CA PEM file the HEC certificate is checked against, the system roots when empty
+	Insecure    bool   `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"` //do not check the HEC certificate at all, for lab setups only
+}
+
+// HECSink collects a batch of events and posts them to HEC in a single request on Flush.
+type HECSink struct {
+	info   HECInfo
+	client *http.Client
+	body   bytes.Buffer
+	//backoff is the wait before the nth retry
+	backoff func(attempt int) time.Duration
+}
+
+type hecEvent struct {
+	Event json.RawMessage `json:"event"`
+	Index string          `json:"index,omitempty"`
+}
+
+func NewHECSink(info HECInfo) (*HECSink, error) {
+	if info.URL == "" || info.Token == "" {
+		return nil, wrap(ErrConfigInvalid, "ERROR: hec url and token are required", nil)
+	}
+	if info.Timeoutsec == 0 {
+		info.Timeoutsec = 10
+	}
+	if info.Maxattempts == 0 {
+		info.Maxattempts = 3
+	}
+
+	client := &http.Client{Timeout: time.Duration(info.Timeoutsec) * time.Second}
+	config, err := info.tlsConfig()
+	if err != nil {
+		return nil, wrap(ErrConfigInvalid, "", err)
+	}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client.Transport = transport
+	}
+
+	return &HECSink{
+		info:   info,
+		client: client,
+		backoff: func(attempt int) time.Duration {
+			return time.Duration(attempt) * 500 * time.Millisecond
+		},
+	}, nil
+}
+
+//checkHEC checks the TLS files of workerinfo.hec, see tlsConfig.
+
+func (worker *WorkerInfo) checkHEC() error {
+	if worker.HEC == nil {
+		return nil
+	}
+	_, err := worker.HEC.tlsConfig()
+	return err
+}
+
+//tlsConfig loads the certificates of tls_cert, tls_key and tls_ca, nil when none of them nor insecure_skip_verify is
+//set and the client keeps the default transport. checkHEC runs it in validate, so a missing or bad file stops the worker
+//at startup instead of failing every flush.
+
+func (info *HECInfo) tlsConfig() (*tls.Config, error) {
+	if info.Tls_cert == "" && info.Tls_key == "" && info.Tls_ca == "" && !info.Insecure {
+		return nil, nil
+	}
+	if (info.Tls_cert == "") != (info.Tls_key == "") {
+		return nil, errors.New("ERROR: config fields workerinfo.hec.tls_cert and tls_key go together")
+	}
+
+	config := &tls.Config{InsecureSkipVerify: info.Insecure}
+	if info.Tls_cert != "" {
+		cert, err := tls.LoadX509KeyPair(info.Tls_cert, info.Tls_key)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: config fields workerinfo.hec.tls_cert %q and tls_key %q do not load: %v", info.Tls_cert, info.Tls_key, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if info.Tls_ca != "" {
+		pem, err := ioutil.ReadFile(info.Tls_ca)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: config field workerinfo.hec.tls_ca %q is not readable: %v", info.Tls_ca, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ERROR: config field workerinfo.hec.tls_ca %q holds no PEM certificate", info.Tls_ca)
+		}
+	}
+	return config, nil
+}
+
+// Write wraps one event in the HEC envelope. JSON payloads are embedded as objects, anything else as a string.
+func (s *HECSink) Write(p []byte) error {
+	p = bytes.TrimSuffix(p, []byte("\n"))
+
+	event := hecEvent{Event: json.RawMessage(p), Index: s.info.Index}
+	if !json.Valid(p) {
+		quoted, err := json.Marshal(string(p))
+		if err != nil {
+			return err
+		}
+		event.Event = quoted
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.body.Write(line)
+	s.body.WriteByte('\n')
+	return nil
+}
+
+// Flush posts the collected events, retrying on 5xx. The events are dropped either way, a failed batch is nacked and
+// comes back through Write on redelivery.
+func (s *HECSink) Flush() error {
+	if s.body.Len() == 0 {
+		return nil
+	}
+	defer s.body.Reset()
+
+	var err error
+	for attempt := 1; attempt <= s.info.Maxattempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(s.backoff(attempt - 1))
+		}
+
+		var retry bool
+		if retry, err = s.post(s.body.Bytes()); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+//post sends one request and reports whether a failure is worth retrying.
+
+func (s *HECSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", s.info.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.info.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("ERROR: hec returned %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("ERROR: hec returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Close has nothing to release, Flush leaves nothing behind.
+func (s *HECSink) Close() error {
+	return nil
+}
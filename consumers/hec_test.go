@@ -0,0 +1,248 @@
+package consumers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHECSink(t *testing.T, url string) *HECSink {
+	sink, err := NewHECSink(HECInfo{URL: url, Token: "secret", Index: "main", Maxattempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.backoff = func(int) time.Duration { return 0 }
+	return sink
+}
+
+func TestHECSinkPostsBatch(t *testing.T) {
+	var requests int
+	var auth, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		auth = r.Header.Get("Authorization")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer srv.Close()
+
+	sink := newTestHECSink(t, srv.URL)
+	sink.Write([]byte(`{"user":"a"}` + "\n"))
+	sink.Write([]byte("plain text\n"))
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 1 {
+		t.Errorf("expected one request per batch, got %d", requests)
+	}
+	if auth != "Splunk secret" {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+	want := `{"event":{"user":"a"},"index":"main"}` + "\n" + `{"event":"plain text","index":"main"}` + "\n"
+	if body != want {
+		t.Errorf("unexpected body\n got %q\nwant %q", body, want)
+	}
+}
+
+func TestHECSinkRetriesServerErrors(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	sink := newTestHECSink(t, srv.URL)
+	sink.Write([]byte("one\n"))
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 attempts, got %d", requests)
+	}
+}
+
+func TestHECSinkGivesUp(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	sink := newTestHECSink(t, srv.URL)
+	sink.Write([]byte("one\n"))
+	if err := sink.Flush(); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the 500 to surface, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected attempts bounded at 3, got %d", requests)
+	}
+
+	//client errors are not retried
+	requests = 0
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	})
+	sink.Write([]byte("one\n"))
+	if err := sink.Flush(); err == nil || requests != 1 {
+		t.Errorf("expected a single failed attempt on 403, got %d attempts and %v", requests, err)
+	}
+}
+
+//testPKI is a CA with a server certificate for 127.0.0.1 and a client certificate, the client side written to dir as
+//PEM files.
+
+type testPKI struct {
+	pool             *x509.CertPool
+	server           tls.Certificate
+	cert, key, caPEM string
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	pki := &testPKI{pool: x509.NewCertPool()}
+	pki.pool.AddCert(ca)
+	serverDER, serverKey := issue(2, x509.ExtKeyUsageServerAuth)
+	pki.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+	clientDER, clientKey := issue(3, x509.ExtKeyUsageClientAuth)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.cert = writePEM("client.pem", "CERTIFICATE", clientDER)
+	pki.key = writePEM("client-key.pem", "EC PRIVATE KEY", keyDER)
+	pki.caPEM = writePEM("ca.pem", "CERTIFICATE", caDER)
+	return pki
+}
+
+func TestHECSinkMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pki := newTestPKI(t, dir)
+
+	var requests int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { requests++ }))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pki.server}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pki.pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	sink, err := NewHECSink(HECInfo{URL: srv.URL, Token: "secret", Maxattempts: 1, Tls_cert: pki.cert, Tls_key: pki.key, Tls_ca: pki.caPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("one\n"))
+	if err = sink.Flush(); err != nil || requests != 1 {
+		t.Fatalf("expected the batch posted with the client certificate, got %d requests and %v", requests, err)
+	}
+
+	//without the client certificate the server refuses the handshake
+	sink, err = NewHECSink(HECInfo{URL: srv.URL, Token: "secret", Maxattempts: 1, Tls_ca: pki.caPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("one\n"))
+	if err = sink.Flush(); err == nil || requests != 1 {
+		t.Errorf("expected the handshake to fail without a client certificate, got %d requests and %v", requests, err)
+	}
+}
+
+func TestHECSinkInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, insecure := range []bool{false, true} {
+		sink, err := NewHECSink(HECInfo{URL: srv.URL, Token: "secret", Maxattempts: 1, Insecure: insecure})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Write([]byte("one\n"))
+		if err = sink.Flush(); (err == nil) != insecure {
+			t.Errorf("insecure_skip_verify %v: unexpected flush result %v", insecure, err)
+		}
+	}
+}
+
+func TestNewHECSinkRejectsBadTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pki := newTestPKI(t, dir)
+
+	for _, info := range []HECInfo{
+		{URL: "https://hec", Token: "secret", Tls_cert: pki.cert},
+		{URL: "https://hec", Token: "secret", Tls_cert: pki.cert, Tls_key: filepath.Join(dir, "missing.pem")},
+		{URL: "https://hec", Token: "secret", Tls_cert: pki.cert, Tls_key: pki.cert},
+		{URL: "https://hec", Token: "secret", Tls_ca: pki.key},
+		{URL: "https://hec", Token: "secret", Tls_ca: filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := NewHECSink(info); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "workerinfo.hec.tls_") {
+			t.Errorf("expected a config error naming the tls field for %+v, got %v", info, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package consumers
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// MaxWaitJitterLimit is the largest workerinfo.maxwait_jitter_percent, more would let a cycle end right after it began.
+const MaxWaitJitterLimit = 50
+
+//checkMaxWaitJitter checks workerinfo.maxwait_jitter_percent.
+
+func (worker *WorkerInfo) checkMaxWaitJitter() error {
+	if j := worker.Maxwait_jitter; j < 0 || j > MaxWaitJitterLimit {
+		return fmt.Errorf("ERROR: config field workerinfo.maxwait_jitter_percent is %d, it must be between 0 and %d", j, MaxWaitJitterLimit)
+	}
+	return nil
+}
+
+//cycleTimeout is how long the next receive cycle runs: maxwaitmin moved by up to maxwait_jitter_percent either way,
+//drawn anew each cycle. Workers that were started together, by a deploy or a node pool coming up, otherwise end their
+//cycles and reconnect to pub/sub in step for as long as they run. For a fleet of tens of workers 10 to 20 percent
+//spreads the reconnects over minutes, the default 0 keeps every cycle exactly maxwaitmin.
+
+func (worker *WorkerInfo) cycleTimeout() time.Duration {
+	wait := worker.Maxwaittime
+	if worker.Maxwait_jitter == 0 || wait <= 0 {
+		return wait
+	}
+	spread := int64(wait) * int64(worker.Maxwait_jitter) / 100
+	return wait + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
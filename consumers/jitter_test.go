@@ -0,0 +1,35 @@
+package consumers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCycleTimeoutJitter(t *testing.T) {
+	worker := WorkerInfo{Maxwaittime: 10 * time.Minute}
+	if d := worker.cycleTimeout(); d != 10*time.Minute {
+		t.Errorf("expected no jitter by default, got %s", d)
+	}
+
+	worker.Maxwait_jitter = 20
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := worker.cycleTimeout()
+		if d < 8*time.Minute || d > 12*time.Minute {
+			t.Fatalf("expected a cycle within 20%% of 10m, got %s", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected the cycles to vary, got %v", seen)
+	}
+}
+
+func TestCheckMaxWaitJitter(t *testing.T) {
+	for _, j := range []int{-1, MaxWaitJitterLimit + 1} {
+		worker := WorkerInfo{Maxwait_jitter: j}
+		if err := worker.checkMaxWaitJitter(); err == nil {
+			t.Errorf("expected maxwait_jitter_percent %d to be rejected", j)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package consumers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Values for inject_label, how source_label is added to each line so events from several subscriptions in one Splunk
+// index can be told apart. LabelField adds a "_source" field to json object lines and starts any other line with the
+// label as DefaultLabelPrefix would, LabelPrefix starts every line with label_prefix.
+const (
+	LabelField  = "field"
+	LabelPrefix = "prefix"
+)
+
+// DefaultLabelPrefix is the label_prefix of LabelPrefix when it is not set, {label} is replaced with source_label.
+const DefaultLabelPrefix = "{label} "
+
+//labelFieldName is the field LabelField adds.
+
+const labelFieldName = "_source"
+
+//checkLabel checks inject_label and the fields that go with it.
+
+func (gcpinfo *GCPInfo) checkLabel() error {
+	switch gcpinfo.Inject_label {
+	case "", LabelField:
+		if gcpinfo.Label_prefix != "" {
+			return fmt.Errorf("ERROR: config field label_prefix needs inject_label %s", LabelPrefix)
+		}
+	case LabelPrefix:
+		if !strings.Contains(gcpinfo.Label_prefix, "{label}") {
+			return fmt.Errorf("ERROR: config field label_prefix %q must contain {label}", gcpinfo.Label_prefix)
+		}
+		//a prefix in front of an array element is not json any more
+		if gcpinfo.Worker.Output_format == OutputJSONArray {
+			return fmt.Errorf("ERROR: config field inject_label %s cannot be combined with workerinfo.output_format json_array", LabelPrefix)
+		}
+	default:
+		return fmt.Errorf("ERROR: config field inject_label %q must be %s or %s", gcpinfo.Inject_label, LabelField, LabelPrefix)
+	}
+	return nil
+}
+
+//labelField returns out with the _source field added in front when it is a json object. Anything else is returned
+//unchanged, adding a field to a string or an array would change what the payload is. A payload with a _source of its
+//own keeps it, json decoders take the last of duplicate keys.
+
+func labelField(out []byte, field []byte) []byte {
+	if !jsonObject(out) {
+		return out
+	}
+	trimmed := bytes.TrimSpace(out)
+	rest := bytes.TrimSpace(trimmed[1:])
+	labelled := make([]byte, 0, len(field)+len(trimmed)+1)
+	labelled = append(append(labelled, '{'), field...)
+	if rest[0] != '}' {
+		labelled = append(labelled, ',')
+	}
+	return append(labelled, rest...)
+}
+
+//tagLine adds field to out when it is a json object. Anything else is left as is and gets prefix back to put in front
+//of the line instead, so field mode tags every line. With output_format json_array there is no prefix, it would break
+//the array.
+
+func (gcpinfo *GCPInfo) tagLine(out []byte, field []byte, prefix []byte) ([]byte, []byte) {
+	if jsonObject(out) {
+		return labelField(out, field), nil
+	}
+	if gcpinfo.Worker.Output_format == OutputJSONArray {
+		return out, nil
+	}
+	return out, prefix
+}
+
+//jsonObject reports whether out, give or take surrounding space, is a json object.
+
+func jsonObject(out []byte) bool {
+	trimmed := bytes.TrimSpace(out)
+	return len(trimmed) >= 2 && trimmed[0] == '{' && json.Valid(trimmed)
+}
+
+//jsonString quotes s as a json string, so an ordering key or message ID with spaces or quotes stays one value both in
+//a field and in a prefix.
+
+func jsonString(s string) []byte {
+	value, _ := json.Marshal(s)
+	return value
+}
+
+//labelBytes renders what inject_label adds to each line once, in NewGCPclient.
+
+func (gcpinfo *GCPInfo) labelBytes() []byte {
+	switch gcpinfo.Inject_label {
+	case LabelField:
+		name, _ := json.Marshal(labelFieldName)
+		value, _ := json.Marshal(gcpinfo.Source_label)
+		return append(append(name, ':'), value...)
+	case LabelPrefix:
+		return []byte(strings.Replace(gcpinfo.Label_prefix, "{label}", gcpinfo.Source_label, -1))
+	}
+	return nil
+}
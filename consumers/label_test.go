@@ -0,0 +1,93 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLabelField(t *testing.T) {
+	field := []byte(`"_source":"sub"`)
+	cases := []struct {
+		in, out string
+	}{
+		{`{"user":"a"}`, `{"_source":"sub","user":"a"}`},
+		{` { "user":"a"} `, `{"_source":"sub","user":"a"}`},
+		{`{}`, `{"_source":"sub"}`},
+		{`[1,2]`, `[1,2]`},
+		{`"text"`, `"text"`},
+		{`not json`, `not json`},
+		{`{"broken"`, `{"broken"`},
+	}
+	for _, c := range cases {
+		if out := string(labelField([]byte(c.in), field)); out != c.out {
+			t.Errorf("labelField(%q) = %q, want %q", c.in, out, c.out)
+		}
+	}
+}
+
+func TestLineInjectsLabel(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Source_label = `prod "a"`
+
+	gcpinfo.Inject_label = LabelField
+	gcpinfo.label = gcpinfo.labelBytes()
+	line, err := gcpinfo.line(&pubsub.Message{Data: []byte(`{"user":"a"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != `{"_source":"prod \"a\"","user":"a"}`+"\n" {
+		t.Errorf("expected an escaped _source field, got %q", line)
+	}
+
+	//a line that is not a json object gets the label in front instead of losing it
+	if line, err = gcpinfo.line(&pubsub.Message{Data: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != `prod "a" one`+"\n" {
+		t.Errorf("expected field mode to fall back to the default prefix, got %q", line)
+	}
+
+	gcpinfo.Inject_label, gcpinfo.Label_prefix = LabelPrefix, "[{label}] "
+	gcpinfo.label = gcpinfo.labelBytes()
+	if line, err = gcpinfo.line(&pubsub.Message{Data: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != `[prod "a"] one`+"\n" {
+		t.Errorf("expected the prefix before the payload, got %q", line)
+	}
+}
+
+func TestNewGCPclientDefaultsSourceLabel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	gcpinfo, err := NewGCPclient(writeTestConfig(t, dir, `{
+		"project": "`+project+`",
+		"subscription": "`+subscription+`",
+		"inject_label": "prefix",
+		"workerinfo": {"messagelogpath": "`+dir+`", "workerlogpath": "`+dir+`", "maxwaitmin": 1}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Source_label != subscription || string(gcpinfo.label) != subscription+" " {
+		t.Errorf("expected the subscription with the default prefix, got %q and %q", gcpinfo.Source_label, gcpinfo.label)
+	}
+
+	_, err = NewGCPclient(writeTestConfig(t, dir, `{
+		"project": "`+project+`",
+		"subscription": "`+subscription+`",
+		"label_prefix": "{label}: ",
+		"workerinfo": {"messagelogpath": "`+dir+`", "workerlogpath": "`+dir+`", "maxwaitmin": 1}
+	}`))
+	if !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("expected label_prefix without inject_label prefix to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package consumers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Values for workerinfo.newline_encoding, how one_line_per_event keeps a payload with newlines in it on one line.
+// NewlineEscape, the default, writes them as a literal \n and \r, a json payload is compacted instead so it stays
+// json. NewlineBase64 writes every payload base64 encoded, newlines or not, so the reader can always decode it.
+const (
+	NewlineEscape = "escape"
+	NewlineBase64 = "base64"
+)
+
+// Values for workerinfo.line_terminator, what ends each line of the message log. TerminatorLF is the default.
+const (
+	TerminatorLF   = "lf"
+	TerminatorCRLF = "crlf"
+)
+
+//checkLines checks one_line_per_event, newline_encoding and line_terminator.
+
+func (worker *WorkerInfo) checkLines() error {
+	switch worker.Newline_encoding {
+	case "", NewlineEscape:
+	case NewlineBase64:
+		if worker.Output_format == OutputJSONArray {
+			return fmt.Errorf("ERROR: config field workerinfo.newline_encoding %s cannot be combined with workerinfo.output_format json_array", NewlineBase64)
+		}
+	default:
+		return fmt.Errorf("ERROR: config field workerinfo.newline_encoding %q must be %s or %s", worker.Newline_encoding, NewlineEscape, NewlineBase64)
+	}
+	if worker.Newline_encoding != "" && !worker.One_line_per_event {
+		return errors.New("ERROR: config field workerinfo.newline_encoding needs workerinfo.one_line_per_event")
+	}
+
+	switch worker.Line_terminator {
+	case "", TerminatorLF:
+	case TerminatorCRLF:
+		//both split what they are given on \n and would keep the \r
+		if worker.Output_format == OutputJSONArray || worker.HEC != nil {
+			return fmt.Errorf("ERROR: config field workerinfo.line_terminator %s cannot be combined with workerinfo.output_format json_array or workerinfo.hec", TerminatorCRLF)
+		}
+	default:
+		return fmt.Errorf("ERROR: config field workerinfo.line_terminator %q must be %s or %s", worker.Line_terminator, TerminatorLF, TerminatorCRLF)
+	}
+	return nil
+}
+
+//terminate ends a line with line_terminator.
+
+func (worker *WorkerInfo) terminate(line []byte) []byte {
+	if worker.Line_terminator == TerminatorCRLF {
+		return append(line, '\r', '\n')
+	}
+	return append(line, '\n')
+}
+
+//oneLine keeps a payload on one line as newline_encoding says, when one_line_per_event is set. Splunk takes every line
+//for an event of its own, a payload with a newline in it would be split in two.
+
+func (worker *WorkerInfo) oneLine(out []byte) []byte {
+	if !worker.One_line_per_event {
+		return out
+	}
+	if worker.Newline_encoding == NewlineBase64 {
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(out)))
+		base64.StdEncoding.Encode(encoded, out)
+		return encoded
+	}
+	if bytes.IndexAny(out, "\r\n") < 0 {
+		return out
+	}
+	//a newline in json is whitespace between tokens, inside a string it is already escaped
+	if json.Valid(out) {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, out); err == nil {
+			return compact.Bytes()
+		}
+	}
+	escaped := bytes.Replace(out, []byte("\r"), []byte(`\r`), -1)
+	return bytes.Replace(escaped, []byte("\n"), []byte(`\n`), -1)
+}
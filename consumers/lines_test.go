@@ -0,0 +1,69 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOneLine(t *testing.T) {
+	cases := []struct {
+		encoding string
+		in, out  string
+	}{
+		{"", "one", "one"},
+		{"", "two\nlines\r\n", `two\nlines\r\n`},
+		{"", "{\n  \"a\": \"b\\nc\"\n}", `{"a":"b\nc"}`},
+		{NewlineEscape, "{\"broken\n", `{"broken\n`},
+		{NewlineBase64, "two\nlines", "dHdvCmxpbmVz"},
+		{NewlineBase64, "one", "b25l"},
+	}
+	for _, c := range cases {
+		worker := WorkerInfo{One_line_per_event: true, Newline_encoding: c.encoding}
+		if out := string(worker.oneLine([]byte(c.in))); out != c.out {
+			t.Errorf("oneLine(%q) with %q = %q, want %q", c.in, c.encoding, out, c.out)
+		}
+	}
+
+	worker := WorkerInfo{}
+	if out := string(worker.oneLine([]byte("two\nlines"))); out != "two\nlines" {
+		t.Errorf("expected the payload as is without one_line_per_event, got %q", out)
+	}
+}
+
+func TestLineEndsWithLineTerminator(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.One_line_per_event = true
+	gcpinfo.Worker.Line_terminator = TerminatorCRLF
+
+	line, err := gcpinfo.line(&pubsub.Message{Data: []byte("two\nlines")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != "two\\nlines\r\n" {
+		t.Errorf("expected one escaped line ending in CRLF, got %q", line)
+	}
+}
+
+func TestNewGCPclientRejectsBadLineSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fields := range []string{
+		`"newline_encoding":"base64"`,
+		`"one_line_per_event":true,"newline_encoding":"rot13"`,
+		`"line_terminator":"cr"`,
+		`"line_terminator":"crlf","output_format":"json_array"`,
+	} {
+		configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`",`+fields+`}}`)
+		if _, err = NewGCPclient(configfile); !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("expected %s to be rejected, got %v", fields, err)
+		}
+	}
+}
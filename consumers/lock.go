@@ -0,0 +1,70 @@
+package consumers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockSuffix names the lock file a worker holds in messagelogpath while it consumes, <subscription>.lock or
+// <queue>.lock. It is named after the subscription rather than the message log, whose name can change with {date}.
+const LockSuffix = ".lock"
+
+//lockLog takes the lock of name in messagelogpath, unless this worker already holds it. A second worker started with
+//the same config would append to the same message log and compete for the same messages, it gets ErrLocked instead.
+//The lock is advisory and goes away with the process, a crashed worker leaves a stale file but not a stale lock. The
+//file holds the pid of the worker for the error message. Callers hold mu.
+
+func (w *batchWriter) lockLog(worker *WorkerInfo, name string) error {
+	if w.lock != nil {
+		return nil
+	}
+	path := filepath.Join(worker.Message_log_path, name+LockSuffix)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return wrap(ErrFileOpen, "ERROR: Unable to open the lock file "+path, err)
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		if err == errLockHeld {
+			return wrap(ErrLocked, fmt.Sprintf("ERROR: another worker%s is already consuming into %s, it holds %s", lockHolder(path), worker.Message_log_path, path), nil)
+		}
+		return wrap(ErrFileOpen, "ERROR: Unable to lock "+path, err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		worker.Worker_logger_error.Println("Unable to write the pid into", path+":", err)
+	}
+	w.lock = f
+	return nil
+}
+
+//lockHolder names the pid written into a held lock file, empty when it cannot be read.
+
+func lockHolder(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if pid := strings.TrimSpace(string(content)); pid != "" {
+		return " (pid " + pid + ")"
+	}
+	return ""
+}
+
+//unlockLog releases the lock taken by lockLog. The file stays, removing it would race with a worker about to lock it.
+//Callers hold mu.
+
+func (w *batchWriter) unlockLog() error {
+	if w.lock == nil {
+		return nil
+	}
+	err := w.lock.Close()
+	w.lock = nil
+	return err
+}
@@ -0,0 +1,69 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReceiveRejectsSecondWorkerOnSameLog(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	first := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(first.Worker.Message_log_path)
+	msg := &pubsub.Message{ID: "1", Data: []byte("one")}
+	if err := first.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{msg}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(second.Worker.Message_log_path)
+	second.Worker.Message_log_path = first.Worker.Message_log_path
+	err := second.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{msg}}, nil)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected the error to name the pid holding the lock, got %v", err)
+	}
+	if lines := readMessageLog(t, first); len(lines) != 1 {
+		t.Errorf("expected only the first worker's line, got %q", lines)
+	}
+
+	//the lock goes with Shutdown, the file stays behind
+	if err = first.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(first.Worker.Message_log_path, subscription+LockSuffix)); err != nil {
+		t.Errorf("expected the lock file kept, got %v", err)
+	}
+	if err = second.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{msg}}, nil); err != nil {
+		t.Errorf("expected the lock free after Shutdown, got %v", err)
+	}
+	second.Shutdown(context.Background())
+}
+
+func TestDryRunTakesNoLock(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Dry_run = true
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(gcpinfo.Worker.Message_log_path)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), LockSuffix) {
+			t.Errorf("expected no lock file in a dry run, got %s", f.Name())
+		}
+	}
+}
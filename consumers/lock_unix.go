@@ -0,0 +1,18 @@
+//go:build !windows
+
+package consumers
+
+import (
+	"os"
+	"syscall"
+)
+
+//lockFile takes an exclusive flock on f without waiting, errLockHeld when another open file holds it.
+
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
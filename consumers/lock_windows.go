@@ -0,0 +1,11 @@
+package consumers
+
+import (
+	"os"
+)
+
+//lockFile is not implemented on windows, the lock file is written but two workers are not kept apart.
+
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//messageID tags a worker log line with the message it is about. In text logs it reads message_id=<id>, in json logs
+//it becomes the message_id field.
+
+func messageID(msg *pubsub.Message) string {
+	return "message_id=" + msg.ID
+}
+
+var messageIDField = regexp.MustCompile(`\s*message_id=(\S+)`)
+
+type jsonLogEntry struct {
+	Timestamp    string `json:"timestamp"`
+	Level        string `json:"level"`
+	Msg          string `json:"msg"`
+	Subscription string `json:"subscription"`
+	MessageID    string `json:"message_id,omitempty"`
+}
+
+//jsonLogWriter sits under a *log.Logger created without prefix or flags and turns each line into a json object, so
+//log_format json needs no change at the call sites.
+
+type jsonLogWriter struct {
+	out          io.Writer
+	level        string
+	subscription string
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	entry := jsonLogEntry{
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:        w.level,
+		Subscription: w.subscription,
+	}
+	if m := messageIDField.FindStringSubmatch(line); m != nil {
+		entry.MessageID = m[1]
+		line = strings.Replace(line, m[0], "", 1)
+	}
+	entry.Msg = line
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,29 @@
+package consumers
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&jsonLogWriter{out: &buf, level: "error", subscription: subscription}, "", 0)
+	logger.Println("Unable to transform", messageID(&pubsub.Message{ID: "42"}), "nacking:", "bad json")
+
+	var entry jsonLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a json line, got %q: %v", buf.String(), err)
+	}
+	if entry.Level != "error" || entry.Subscription != subscription || entry.MessageID != "42" {
+		t.Errorf("unexpected fields %+v", entry)
+	}
+	if entry.Msg != "Unable to transform nacking: bad json" {
+		t.Errorf("unexpected msg %q", entry.Msg)
+	}
+	if entry.Timestamp == "" {
+		t.Error("expected a timestamp")
+	}
+}
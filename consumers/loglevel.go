@@ -0,0 +1,71 @@
+package consumers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+// Levels for workerinfo.log_level. A level emits its own lines and every level after it, LogInfo, the default, logs
+// everything but the debug lines. Warnings go through Worker_logger_error with a WARNING: message, LogError drops them.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+var logLevels = map[string]int{LogDebug: 0, LogInfo: 1, LogWarn: 2, LogError: 3}
+
+//checkLogLevel checks workerinfo.log_level, empty is LogInfo.
+
+func (worker *WorkerInfo) checkLogLevel() error {
+	if _, ok := logLevels[worker.Log_level]; !ok && worker.Log_level != "" {
+		return fmt.Errorf("ERROR: config field workerinfo.log_level %q must be %s, %s, %s or %s", worker.Log_level, LogDebug, LogInfo, LogWarn, LogError)
+	}
+	return nil
+}
+
+//leveled returns what a logger of level writes into: out, or ioutil.Discard when log_level is above level. The
+//loggers stay plain *log.Logger, so the call sites do not change.
+
+func (worker *WorkerInfo) leveled(out io.Writer, level string) io.Writer {
+	floor := logLevels[LogInfo]
+	if worker.Log_level != "" {
+		floor = logLevels[worker.Log_level]
+	}
+	if logLevels[level] < floor {
+		return ioutil.Discard
+	}
+	if level == LogError && floor > logLevels[LogWarn] {
+		return dropWarnings{out}
+	}
+	return out
+}
+
+//warningLine matches a warning as Worker_logger_error writes it, WARNING: right after the ERROR: prefix and the date
+//of text logs, or at the start of the bare message json logs get. An error that only quotes a warning is not one.
+
+var warningLine = regexp.MustCompile(`^(ERROR: )?(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} )?WARNING: `)
+
+//dropWarnings sits under Worker_logger_error with log_level error and drops the warnings it carries.
+
+type dropWarnings struct {
+	out io.Writer
+}
+
+func (w dropWarnings) Write(p []byte) (int, error) {
+	if warningLine.Match(p) {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+//debug logs to Worker_logger_debug, which is only set up by openWorkerLog. A worker built without it logs nothing.
+
+func (worker *WorkerInfo) debug(v ...interface{}) {
+	if worker.Worker_logger_debug != nil {
+		worker.Worker_logger_debug.Println(v...)
+	}
+}
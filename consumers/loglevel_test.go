@@ -0,0 +1,70 @@
+package consumers
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLeveledDropsLinesBelowLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level string
+		want  []string
+	}{
+		{"", []string{"INFO: started", "ERROR: WARNING: slow disk", "ERROR: failed"}},
+		{LogDebug, []string{"DEBUG: flushed", "INFO: started", "ERROR: WARNING: slow disk", "ERROR: failed"}},
+		{LogWarn, []string{"ERROR: WARNING: slow disk", "ERROR: failed"}},
+		{LogError, []string{"ERROR: failed"}},
+	} {
+		var buf bytes.Buffer
+		worker := WorkerInfo{Log_level: tc.level}
+		worker.Worker_logger_debug = log.New(worker.leveled(&buf, LogDebug), "DEBUG: ", 0)
+		worker.Worker_logger_info = log.New(worker.leveled(&buf, LogInfo), "INFO: ", 0)
+		worker.Worker_logger_error = log.New(worker.leveled(&buf, LogError), "ERROR: ", 0)
+
+		worker.debug("flushed")
+		worker.Worker_logger_info.Println("started")
+		worker.Worker_logger_error.Println("WARNING: slow disk")
+		worker.Worker_logger_error.Println("failed")
+
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("log_level %q: expected %q, got %q", tc.level, tc.want, got)
+		}
+	}
+}
+
+func TestLogLevelErrorKeepsErrorsQuotingWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	worker := WorkerInfo{Log_level: LogError}
+	worker.Worker_logger_error = log.New(worker.leveled(&buf, LogError), "ERROR: ", log.Ldate|log.Ltime)
+
+	worker.Worker_logger_error.Println("WARNING: slow disk")
+	worker.Worker_logger_error.Println("Unable to transform message_id=1 nacking: payload WARNING: not json")
+
+	if out := buf.String(); strings.Contains(out, "slow disk") || !strings.Contains(out, "payload WARNING: not json") {
+		t.Errorf("expected only the warning dropped, got %q", out)
+	}
+}
+
+func TestNewGCPclientRejectsBadLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","log_level":"verbose"}}`)
+	if _, err := NewGCPclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "log_level") {
+		t.Errorf("expected an error naming log_level, got %v", err)
+	}
+}
+
+func TestDebugWithoutLoggerIsSilent(t *testing.T) {
+	var worker WorkerInfo
+	worker.debug("nothing to see")
+}
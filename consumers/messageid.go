@@ -0,0 +1,40 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultMessageIDPrefix is the message_id_prefix of include_message_id when it is not set, {id} is replaced with the
+// pub/sub message ID.
+const DefaultMessageIDPrefix = "message_id={id} "
+
+//messageIDFieldName is the field include_message_id adds to json object lines.
+
+const messageIDFieldName = "_message_id"
+
+//checkMessageID checks include_message_id and message_id_prefix.
+
+func (gcpinfo *GCPInfo) checkMessageID() error {
+	if gcpinfo.Msgid_prefix == "" {
+		return nil
+	}
+	if !gcpinfo.Include_id {
+		return errors.New("ERROR: config field message_id_prefix needs include_message_id")
+	}
+	if !strings.Contains(gcpinfo.Msgid_prefix, "{id}") {
+		return fmt.Errorf("ERROR: config field message_id_prefix %q must contain {id}", gcpinfo.Msgid_prefix)
+	}
+	return nil
+}
+
+//tagMessageID tags out with the ID of the message for include_message_id, so an event in Splunk can be traced back to
+//its delivery. A json object gets a _message_id field, anything else message_id_prefix, see tagLine.
+
+func (gcpinfo *GCPInfo) tagMessageID(out []byte, id string) ([]byte, []byte) {
+	if id == "" {
+		return out, nil
+	}
+	return gcpinfo.tagLine(out, append([]byte(`"`+messageIDFieldName+`":`), jsonString(id)...), []byte(strings.Replace(gcpinfo.Msgid_prefix, "{id}", id, -1)))
+}
@@ -0,0 +1,64 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLineIncludesMessageID(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Include_id, gcpinfo.Msgid_prefix = true, DefaultMessageIDPrefix
+
+	cases := []struct {
+		id, data, out string
+	}{
+		{"42", `{"a":1}`, `{"_message_id":"42","a":1}`},
+		{"42", `{}`, `{"_message_id":"42"}`},
+		{"42", "plain text", "message_id=42 plain text"},
+		{"42", `[1,2]`, "message_id=42 [1,2]"},
+		{"", "plain text", "plain text"},
+	}
+	for _, c := range cases {
+		line, err := gcpinfo.line(&pubsub.Message{ID: c.id, Data: []byte(c.data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != c.out+"\n" {
+			t.Errorf("message %q %q: expected %q, got %q", c.id, c.data, c.out+"\n", line)
+		}
+	}
+
+	//the prefix has no place in a json array, only objects get the ID there
+	gcpinfo.Worker.Output_format = OutputJSONArray
+	if out, prefix := gcpinfo.tagMessageID([]byte("1"), "42"); string(out) != "1" || prefix != nil {
+		t.Errorf("expected a json_array element left alone, got %q and prefix %q", out, prefix)
+	}
+}
+
+func TestNewGCPclientMessageIDPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","include_message_id":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcpinfo.Msgid_prefix != DefaultMessageIDPrefix {
+		t.Errorf("expected the default message_id_prefix, got %q", gcpinfo.Msgid_prefix)
+	}
+
+	for _, fields := range []string{`"message_id_prefix":"id "`, `"include_message_id":true,"message_id_prefix":"id "`} {
+		configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s",`+fields+`,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+		if _, err = NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "message_id_prefix") {
+			t.Errorf("expected %s rejected, got %v", fields, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package consumers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MetaSuffix is appended to the name of a message log for its sidecar, see FileSink.MetaOnClose.
+const MetaSuffix = ".meta"
+
+// Meta is the content of a .meta sidecar, what a downstream job needs to reconcile what it ingested from the file.
+type Meta struct {
+	File   string    `json:"file"`   //name of the message log, without its directory
+	Lines  int64     `json:"lines"`  //newlines in the file, a payload with newlines of its own counts each
+	Bytes  int64     `json:"bytes"`  //size of the file, compressed for a gzipped message log
+	SHA256 string    `json:"sha256"` //hex SHA-256 of the file as it is on disk
+	Closed time.Time `json:"closed"` //when the sink closed the file
+}
+
+//fileMeta sits between the write buffer and the file, so it sees exactly the bytes that reach the file.
+
+type fileMeta struct {
+	hash  hash.Hash
+	bytes int64
+	lines int64
+}
+
+func (m *fileMeta) Write(p []byte) (int, error) {
+	m.hash.Write(p)
+	m.bytes += int64(len(p))
+	return len(p), nil
+}
+
+// MetaOnClose makes Close write a <file>.meta sidecar with the line count and SHA-256 of the file it closed. A file
+// left by an earlier sink is read once here, so the sidecar covers the whole file and not just what this sink added.
+// It has to be called before the first Write. It fails for a lumberjack or json_array sink, both rewrite the file
+// behind the sink's back.
+func (s *FileSink) MetaOnClose() error {
+	if _, ok := s.file.(*lumberjack.Logger); ok || s.array {
+		return errors.New("Unable to keep a .meta of the events output log file, it is rotated by size or a json array")
+	}
+	m := &fileMeta{hash: sha256.New()}
+	if err := m.seed(s.path, s.gz != nil); err != nil {
+		return wrap(ErrFileOpen, "Unable to read events output log file for its .meta", err)
+	}
+	s.meta = m
+	s.writer.Reset(io.MultiWriter(s.file, m))
+	return nil
+}
+
+//seed adds what is already in the file at path, counting its lines through gzip for a gzipped file.
+
+func (m *fileMeta) seed(path string, gzipped bool) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m.Write(content)
+	if !gzipped {
+		m.lines = int64(bytes.Count(content, []byte("\n")))
+		return nil
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.lines = int64(bytes.Count(plain, []byte("\n")))
+	return nil
+}
+
+//write writes the sidecar of the file at path, through a rename so a reader never sees half of it.
+
+func (m *fileMeta) write(path string) error {
+	content, err := json.Marshal(Meta{
+		File:   filepath.Base(path),
+		Lines:  m.lines,
+		Bytes:  m.bytes,
+		SHA256: hex.EncodeToString(m.hash.Sum(nil)),
+		Closed: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := path + MetaSuffix + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(content, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+MetaSuffix)
+}
+
+//checkMeta checks write_meta. The sidecar is written when the sink closes a file, so it needs a sink that knows when
+//a file is done: lumberjack rotates on its own and HEC has no file.
+
+func (worker *WorkerInfo) checkMeta() error {
+	if !worker.Write_meta {
+		return nil
+	}
+	if worker.HEC != nil {
+		return errors.New("ERROR: config field workerinfo.write_meta cannot be combined with workerinfo.hec")
+	}
+	if worker.Rotation != nil && !worker.Rotation.byTime() {
+		return errors.New("ERROR: config field workerinfo.write_meta needs workerinfo.rotation.mode time, size rotation renames files without the worker knowing")
+	}
+	if worker.Output_format == OutputJSONArray {
+		return errors.New("ERROR: config field workerinfo.write_meta cannot be combined with workerinfo.output_format json_array")
+	}
+	return nil
+}
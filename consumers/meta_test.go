@@ -0,0 +1,156 @@
+package consumers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readMeta(t *testing.T, path string) Meta {
+	content, err := ioutil.ReadFile(path + MetaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta Meta
+	if err = json.Unmarshal(content, &meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func TestMetaOnCloseCoversWholeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, gzipped := range []bool{false, true} {
+		path := filepath.Join(dir, "sub.log")
+		newSink := NewFileSink
+		if gzipped {
+			path += ".gz"
+			newSink = NewGzipFileSink
+		}
+		if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		//two sinks in a row, the second has to count what the first left
+		for _, lines := range [][]string{{"one"}, {"two", "three"}} {
+			sink, err := newSink(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = sink.MetaOnClose(); err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				if err = sink.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(content)
+		meta := readMeta(t, path)
+		if meta.File != filepath.Base(path) || meta.Lines != 3 || meta.Bytes != int64(len(content)) || meta.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("gzip %v: expected 3 lines, %d bytes and sha256 %x, got %+v", gzipped, len(content), sum, meta)
+		}
+	}
+}
+
+func TestMetaCountsFlushedNewlines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub.log")
+	if err = ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.MetaOnClose(); err != nil {
+		t.Fatal(err)
+	}
+	//a payload with a newline of its own is two lines in the file, the same as seed counts them
+	if err = sink.Write([]byte("one\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.meta.lines != 3 {
+		t.Errorf("expected 3 lines after the flush, got %d", sink.meta.lines)
+	}
+
+	//a batch whose flush fails is not in the count
+	sink.file.Close()
+	if err = sink.Write([]byte("three\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Flush(); err == nil {
+		t.Fatal("expected the flush to a closed file to fail")
+	}
+	if sink.meta.lines != 3 {
+		t.Errorf("expected the failed flush left out, got %d lines", sink.meta.lines)
+	}
+}
+
+func TestMetaWrittenForEachTimeRotatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	worker := &WorkerInfo{Message_log_path: dir, Write_meta: true, Rotation: &RotationInfo{Mode: RotateTime, Interval: 60}}
+	sink, err := worker.openSink("sub.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := sink.(*timeSink)
+	hour := ts.now().UTC().Truncate(ts.every)
+	ts.now = func() time.Time { return hour }
+	ts.Write([]byte("one\n"))
+	ts.Flush()
+	ts.now = func() time.Time { return hour.Add(time.Hour) }
+	ts.Write([]byte("two\n"))
+	ts.Write([]byte("three\n"))
+	ts.Flush()
+
+	//the first file is closed by the rotation, the second by Close
+	if meta := readMeta(t, filepath.Join(dir, periodName("sub.log", hour))); meta.Lines != 1 {
+		t.Errorf("expected 1 line in the first period, got %+v", meta)
+	}
+	if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if meta := readMeta(t, filepath.Join(dir, periodName("sub.log", hour.Add(time.Hour)))); meta.Lines != 2 {
+		t.Errorf("expected 2 lines in the second period, got %+v", meta)
+	}
+}
+
+func TestCheckMetaRejectsSizeRotation(t *testing.T) {
+	worker := &WorkerInfo{Write_meta: true, Output_format: OutputNDJSON, Rotation: &RotationInfo{Maxsize: 10}}
+	if err := worker.checkMeta(); err == nil {
+		t.Error("expected write_meta with size rotation to be rejected")
+	}
+}
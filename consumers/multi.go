@@ -0,0 +1,82 @@
+package consumers
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Errors is what NewGCPclientsFromDir and RunAll return when some of their workers failed. Each error names the config
+// file or subscription it belongs to and still matches the sentinel errors with errors.Is.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// NewGCPclientsFromDir builds a client for every *.json, *.yaml and *.yml config in dir, one per subscription. A config
+// that fails does not stop the others, the clients that were built are returned together with an Errors naming each
+// file that failed.
+func NewGCPclientsFromDir(dir string) ([]*GCPInfo, error) {
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, wrap(ErrConfigRead, "ERROR: Unable to list config files in "+dir, err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, wrap(ErrConfigRead, "ERROR: No *.json, *.yaml or *.yml config files in "+dir, nil)
+	}
+	sort.Strings(files)
+
+	var clients []*GCPInfo
+	var errs Errors
+	for _, file := range files {
+		gcpinfo, err := NewGCPclient(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		clients = append(clients, gcpinfo)
+	}
+	if len(errs) > 0 {
+		return clients, errs
+	}
+	return clients, nil
+}
+
+// RunAll runs every client's Run on its own goroutine, so each keeps its own restart loop and a fatal error in one
+// leaves the others running. It returns once all of them have stopped, cancelling ctx stops them all, with an Errors
+// naming each subscription that failed.
+func RunAll(ctx context.Context, clients []*GCPInfo) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs Errors
+	for _, gcpinfo := range clients {
+		wg.Add(1)
+		go func(gcpinfo *GCPInfo) {
+			defer wg.Done()
+			if err := gcpinfo.Run(ctx); err != nil {
+				gcpinfo.Worker.Worker_logger_error.Println("Worker stopped:", err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", gcpinfo.Subscription, err))
+				mu.Unlock()
+			}
+		}(gcpinfo)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package consumers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewGCPclientsFromDirKeepsGoodConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		"a.json":    `{"project":"p","subscription":"a","workerinfo":{"messagelogpath":"` + dir + `","workerlogpath":"` + dir + `"}}`,
+		"b.json":    `{"project":"p","subscription":"b","workerinfo":{"messagelogpath":"` + dir + `","workerlogpath":"` + dir + `","batchsize":-1}}`,
+		"c.json":    `{"project":"p","subscription":"c","workerinfo":{"messagelogpath":"` + dir + `","workerlogpath":"` + dir + `"}}`,
+		"d.yaml":    "project: p\nsubscription: d\nworkerinfo:\n  messagelogpath: " + dir + "\n  workerlogpath: " + dir + "\n",
+		"e.yml":     "project: p\nsubscription: e\nworkerinfo:\n  messagelogpath: " + dir + "\n  workerlogpath: " + dir + "\n",
+		"notes.txt": `not a config`,
+	}
+	for name, content := range configs {
+		if err = ioutil.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clients, err := NewGCPclientsFromDir(dir)
+	var subs []string
+	for _, gcpinfo := range clients {
+		subs = append(subs, gcpinfo.Subscription)
+	}
+	if !reflect.DeepEqual(subs, []string{"a", "c", "d", "e"}) {
+		t.Errorf("expected clients for a, c, d and e, got %v", subs)
+	}
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 || !strings.Contains(errs[0].Error(), "b.json") {
+		t.Fatalf("expected one error naming b.json, got %v", err)
+	}
+	if !errors.Is(errs[0], ErrConfigInvalid) {
+		t.Errorf("expected the b.json error to be ErrConfigInvalid, got %v", errs[0])
+	}
+}
@@ -0,0 +1,69 @@
+package consumers
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// DefaultOpenRetryDelay is the wait before the first retry of workerinfo.open_attempts when open_retry_delay is not set.
+const DefaultOpenRetryDelay = time.Second
+
+//checkOpenRetry checks open_attempts and open_retry_delay and fills in their defaults, a single attempt without a
+//retry like before they existed.
+
+func (worker *WorkerInfo) checkOpenRetry() error {
+	if worker.Open_attempts < 0 || worker.Open_retry_delay < 0 {
+		return errors.New("ERROR: config fields workerinfo.open_attempts and workerinfo.open_retry_delay must not be negative")
+	}
+	if worker.Open_attempts == 0 {
+		worker.Open_attempts = 1
+	}
+	worker.Open_retry_wait = time.Duration(worker.Open_retry_delay) * time.Second
+	if worker.Open_retry_wait == 0 {
+		worker.Open_retry_wait = DefaultOpenRetryDelay
+	}
+	return nil
+}
+
+//openDelay is the wait before the given retry of open_attempts, open_retry_delay doubled with each retry up to
+//retryMaxDelay.
+
+func (worker *WorkerInfo) openDelay(retry int) time.Duration {
+	delay := worker.Open_retry_wait
+	for ; retry > 1 && delay < retryMaxDelay; retry-- {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+//openRetrying opens the sink like open, up to open_attempts times while it fails with ErrFileOpen, so a message log
+//on an NFS mount that is away for a moment does not fail Consume. A HEC or tee that does not open is not retried.
+//Callers hold mu, it is released while waiting so a Shutdown is not held up. stopping is the consumer's shutdown
+//flag, once Shutdown set it openRetrying gives up and returns nil with the sink closed.
+
+func (w *batchWriter) openRetrying(ctx context.Context, worker *WorkerInfo, name string, stopping *bool) error {
+	for attempt := 1; ; attempt++ {
+		err := w.open(worker, name)
+		if err == nil || !errors.Is(err, ErrFileOpen) || attempt >= worker.Open_attempts {
+			return err
+		}
+
+		delay := worker.openDelay(attempt)
+		worker.Worker_logger_error.Println("Attempt", attempt, "to open message log", name, "failed, retrying in", delay, ":", err)
+		w.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			w.mu.Lock()
+			return err
+		}
+		w.mu.Lock()
+		if *stopping {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package consumers
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//blockedLogPath points messagelogpath below a regular file so creating the message log fails until it is removed.
+
+func blockedLogPath(t *testing.T, gcpinfo *GCPInfo) string {
+	blocker := gcpinfo.Worker.Message_log_path + "/mount"
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.Worker.Message_log_path = blocker + "/logs"
+	return blocker
+}
+
+func TestOpenRetryingRidesOutMissingMount(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	blocker := blockedLogPath(t, gcpinfo)
+	gcpinfo.Worker.Open_attempts, gcpinfo.Worker.Open_retry_wait = 10, 10*time.Millisecond
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.Remove(blocker)
+	}()
+	gcpinfo.mu.Lock()
+	err := gcpinfo.openRetrying(context.Background(), &gcpinfo.Worker, gcpinfo.messageLogName(), &gcpinfo.stopping)
+	opened := gcpinfo.sink != nil
+	gcpinfo.mu.Unlock()
+	defer gcpinfo.Close()
+	if err != nil || !opened {
+		t.Fatalf("expected the message log opened once the mount is back, got %v", err)
+	}
+}
+
+func TestOpenRetryingGivesUp(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	blockedLogPath(t, gcpinfo)
+	gcpinfo.Worker.Open_attempts, gcpinfo.Worker.Open_retry_wait = 3, time.Millisecond
+	var out bytes.Buffer
+	gcpinfo.Worker.Worker_logger_error = log.New(&out, "", 0)
+
+	gcpinfo.mu.Lock()
+	err := gcpinfo.openRetrying(context.Background(), &gcpinfo.Worker, gcpinfo.messageLogName(), &gcpinfo.stopping)
+	gcpinfo.mu.Unlock()
+	if !errors.Is(err, ErrFileOpen) {
+		t.Fatalf("expected ErrFileOpen after the last attempt, got %v", err)
+	}
+	if n := strings.Count(out.String(), "retrying in"); n != 2 {
+		t.Errorf("expected 2 retries logged, got %d in %q", n, out.String())
+	}
+}
+
+func TestOpenRetryingStopsOnShutdown(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	blockedLogPath(t, gcpinfo)
+	gcpinfo.Worker.Open_attempts, gcpinfo.Worker.Open_retry_wait = 100, 10*time.Millisecond
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		gcpinfo.Shutdown(context.Background())
+	}()
+	gcpinfo.mu.Lock()
+	err := gcpinfo.openRetrying(context.Background(), &gcpinfo.Worker, gcpinfo.messageLogName(), &gcpinfo.stopping)
+	opened := gcpinfo.sink != nil
+	gcpinfo.mu.Unlock()
+	if err != nil || opened {
+		t.Errorf("expected a Shutdown to end the retries without a sink, got %v, opened %v", err, opened)
+	}
+}
+
+func TestCheckOpenRetry(t *testing.T) {
+	worker := &WorkerInfo{}
+	if err := worker.checkOpenRetry(); err != nil || worker.Open_attempts != 1 || worker.Open_retry_wait != DefaultOpenRetryDelay {
+		t.Errorf("expected a single attempt and the default delay, got %d %v %v", worker.Open_attempts, worker.Open_retry_wait, err)
+	}
+	worker = &WorkerInfo{Open_attempts: 5, Open_retry_delay: 2}
+	if err := worker.checkOpenRetry(); err != nil {
+		t.Fatal(err)
+	}
+	for retry, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 4: 16 * time.Second, 10: retryMaxDelay} {
+		if got := worker.openDelay(retry); got != want {
+			t.Errorf("openDelay(%d) = %v, want %v", retry, got, want)
+		}
+	}
+	if err := (&WorkerInfo{Open_attempts: -1}).checkOpenRetry(); err == nil {
+		t.Error("expected negative open_attempts rejected")
+	}
+}
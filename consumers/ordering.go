@@ -0,0 +1,63 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errHeldBack settles a message that comes after a failed one with the same ordering key. Acking it would move the key
+// past the failed message, so it is nacked and both are redelivered in order.
+var errHeldBack = errors.New("an earlier message with the same ordering key failed")
+
+//orderingKeyField and orderingKeyPrefix come before the quoted ordering key that include_ordering_key adds to a line,
+//as a json field or in front of the line.
+
+const (
+	orderingKeyField  = `"_ordering_key":`
+	orderingKeyPrefix = "ordering_key="
+)
+
+//checkOrderingKey checks include_ordering_key, it takes the values of inject_label. It only records the key, ordered
+//is what keeps the order.
+
+func (gcpinfo *GCPInfo) checkOrderingKey() error {
+	switch gcpinfo.Ordering_key {
+	case "", LabelField:
+	case LabelPrefix:
+		//a prefix in front of an array element is not json any more
+		if gcpinfo.Worker.Output_format == OutputJSONArray {
+			return fmt.Errorf("ERROR: config field include_ordering_key %s cannot be combined with workerinfo.output_format json_array", LabelPrefix)
+		}
+	default:
+		return fmt.Errorf("ERROR: config field include_ordering_key %q must be %s or %s", gcpinfo.Ordering_key, LabelField, LabelPrefix)
+	}
+	return nil
+}
+
+//sortByOrderingKey groups a batch by ordering key and puts each key in publish order. Messages received with the
+//same key keep their receive order when publish times tie.
+
+func sortByOrderingKey(batch []*pubsub.Message) {
+	sort.SliceStable(batch, func(i, j int) bool {
+		if batch[i].OrderingKey != batch[j].OrderingKey {
+			return batch[i].OrderingKey < batch[j].OrderingKey
+		}
+		return batch[i].PublishTime.Before(batch[j].PublishTime)
+	})
+}
+
+//heldKeys are the ordering keys of a batch that had a failed message, only tracked when ordered is set.
+
+type heldKeys map[string]bool
+
+func (h heldKeys) hold(gcpinfo *GCPInfo, msg *pubsub.Message) {
+	if gcpinfo.Ordered && msg.OrderingKey != "" {
+		h[msg.OrderingKey] = true
+	}
+}
+
+func (h heldKeys) holds(msg *pubsub.Message) bool {
+	return msg.OrderingKey != "" && h[msg.OrderingKey]
+}
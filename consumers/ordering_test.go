@@ -0,0 +1,112 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOrderedFlushWritesPerKeyPublishOrder(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Ordered = true
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now()
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("b2"), OrderingKey: "b", PublishTime: base.Add(2 * time.Second)},
+		&pubsub.Message{ID: "2", Data: []byte("a1"), OrderingKey: "a", PublishTime: base.Add(time.Second)},
+		&pubsub.Message{ID: "3", Data: []byte("b1"), OrderingKey: "b", PublishTime: base},
+		&pubsub.Message{ID: "4", Data: []byte("a2"), OrderingKey: "a", PublishTime: base.Add(3 * time.Second)},
+	)
+	gcpinfo.Flush()
+	gcpinfo.Close()
+
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"a1", "a2", "b1", "b2"}) {
+		t.Errorf("expected each key in publish order, got %q", lines)
+	}
+}
+
+func TestOrderedFlushHoldsBackKeyAfterFailure(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Ordered = true
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.TransformFunc = func(msg *pubsub.Message) ([]byte, error) {
+		if msg.ID == "a1" {
+			return nil, errors.New("bad payload")
+		}
+		return msg.Data, nil
+	}
+
+	base := time.Now()
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "a1", OrderingKey: "a", PublishTime: base},
+		&pubsub.Message{ID: "a2", OrderingKey: "a", PublishTime: base.Add(time.Second)},
+		&pubsub.Message{ID: "b1", OrderingKey: "b", PublishTime: base},
+	)
+	gcpinfo.Flush()
+
+	if !reflect.DeepEqual(*acked, []string{"b1"}) || !reflect.DeepEqual(*nacked, []string{"a1", "a2"}) {
+		t.Errorf("expected key a held back behind its failed message, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestLineIncludesOrderingKey(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	cases := []struct {
+		mode, key, data, out string
+	}{
+		{LabelField, "user-1", `{"a":1}`, `{"_ordering_key":"user-1","a":1}`},
+		{LabelField, "user-1", "text", `ordering_key="user-1" text`},
+		{LabelField, "", `{"a":1}`, `{"a":1}`},
+		{LabelPrefix, `a "b"`, "one", `ordering_key="a \"b\"" one`},
+		{LabelPrefix, "", "one", "one"},
+		{"", "user-1", "one", "one"},
+	}
+	for _, c := range cases {
+		gcpinfo.Ordering_key = c.mode
+		line, err := gcpinfo.line(&pubsub.Message{Data: []byte(c.data), OrderingKey: c.key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != c.out+"\n" {
+			t.Errorf("include_ordering_key %q with key %q: expected %q, got %q", c.mode, c.key, c.out+"\n", line)
+		}
+	}
+}
+
+func TestCheckOrderingKey(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	for _, mode := range []string{"", LabelField, LabelPrefix} {
+		gcpinfo.Ordering_key = mode
+		if err := gcpinfo.checkOrderingKey(); err != nil {
+			t.Errorf("expected include_ordering_key %q accepted, got %v", mode, err)
+		}
+	}
+	gcpinfo.Ordering_key = "suffix"
+	if err := gcpinfo.checkOrderingKey(); err == nil {
+		t.Error("expected an unknown include_ordering_key rejected")
+	}
+	gcpinfo.Ordering_key, gcpinfo.Worker.Output_format = LabelPrefix, OutputJSONArray
+	if err := gcpinfo.checkOrderingKey(); err == nil {
+		t.Error("expected include_ordering_key prefix rejected with json_array")
+	}
+}
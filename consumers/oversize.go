@@ -0,0 +1,82 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Actions for workerinfo.max_message_action, what a flush does with a message whose payload is over max_message_bytes.
+// OversizeTruncate, the default, cuts the payload to max_message_bytes ending in TruncatedMarker and writes it.
+// OversizeDeadLetter writes the whole message to deadletter_path and acks it, OversizeSkip only acks it.
+const (
+	OversizeTruncate   = "truncate"
+	OversizeDeadLetter = "deadletter"
+	OversizeSkip       = "skip"
+)
+
+// TruncatedMarker ends a payload cut down by max_message_action truncate.
+const TruncatedMarker = "...[truncated]"
+
+//checkOversize checks max_message_bytes and max_message_action and fills in the default action.
+
+func (worker *WorkerInfo) checkOversize() error {
+	if worker.Max_message_bytes < 0 {
+		return fmt.Errorf("ERROR: config field workerinfo.max_message_bytes is %d, it must be positive", worker.Max_message_bytes)
+	}
+	if worker.Max_message_bytes == 0 {
+		if worker.Max_message_action != "" {
+			return errors.New("ERROR: config field workerinfo.max_message_action needs workerinfo.max_message_bytes")
+		}
+		return nil
+	}
+	switch worker.Max_message_action {
+	case "":
+		worker.Max_message_action = OversizeTruncate
+	case OversizeTruncate, OversizeSkip:
+	case OversizeDeadLetter:
+		if worker.Deadletter_path == "" {
+			return errors.New("ERROR: config field workerinfo.max_message_action deadletter needs workerinfo.deadletter_path")
+		}
+	default:
+		return fmt.Errorf("ERROR: config field workerinfo.max_message_action %q must be %s, %s or %s", worker.Max_message_action, OversizeTruncate, OversizeDeadLetter, OversizeSkip)
+	}
+	if worker.Max_message_action == OversizeTruncate && worker.Max_message_bytes <= len(TruncatedMarker) {
+		return fmt.Errorf("ERROR: config field workerinfo.max_message_bytes %d leaves no room for the payload before %q", worker.Max_message_bytes, TruncatedMarker)
+	}
+	return nil
+}
+
+//oversize applies max_message_action to a message of the batch whose payload is over max_message_bytes, before it is
+//rendered. It reports whether the message was settled and is out of the batch. A truncated message stays in the batch
+//with the shorter payload, the cut backs off to the start of a UTF-8 sequence so the line stays valid text.
+
+func (gcpinfo *GCPInfo) oversize(msg *pubsub.Message, held heldKeys) bool {
+	limit := gcpinfo.Worker.Max_message_bytes
+	if limit == 0 || len(msg.Data) <= limit {
+		return false
+	}
+	gcpinfo.Worker.Worker_logger_error.Println("WARNING: message", messageID(msg), "is", len(msg.Data), "bytes, over max_message_bytes", limit, "applying", gcpinfo.Worker.Max_message_action)
+
+	switch gcpinfo.Worker.Max_message_action {
+	case OversizeDeadLetter:
+		err := gcpinfo.deadLetter(msg)
+		if err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to dead-letter", messageID(msg), "nacking:", err)
+			held.hold(gcpinfo, msg)
+		}
+		gcpinfo.settle(msg, err)
+		return true
+	case OversizeSkip:
+		gcpinfo.settle(msg, nil)
+		return true
+	}
+
+	cut := limit - len(TruncatedMarker)
+	for cut > 0 && !utf8.RuneStart(msg.Data[cut]) {
+		cut--
+	}
+	msg.Data = append(msg.Data[:cut:cut], TruncatedMarker...)
+	return false
+}
@@ -0,0 +1,89 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFlushTruncatesOversizeMessage(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Max_message_bytes = 20
+	gcpinfo.Worker.Max_message_action = OversizeTruncate
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the cut at 6 bytes falls inside the é, it backs off to keep the payload valid UTF-8
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("short")},
+		&pubsub.Message{ID: "2", Data: []byte("abcdeé" + strings.Repeat("x", 30))})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := readMessageLog(t, gcpinfo)
+	if len(lines) != 2 || lines[0] != "short" || lines[1] != "abcde"+TruncatedMarker {
+		t.Errorf("expected the long payload truncated, got %q", lines)
+	}
+	if len(*acked) != 2 {
+		t.Errorf("expected both messages acked, got %v", *acked)
+	}
+}
+
+func TestFlushSkipsOrDeadLettersOversizeMessage(t *testing.T) {
+	for _, action := range []string{OversizeSkip, OversizeDeadLetter} {
+		acked, nacked, restore := recordAcks()
+
+		gcpinfo := newTestGCPInfo(t, 3)
+		gcpinfo.Worker.Max_message_bytes = 20
+		gcpinfo.Worker.Max_message_action = action
+		gcpinfo.Worker.Deadletter_path = gcpinfo.Worker.Message_log_path + "/deadletter.log"
+		if err := gcpinfo.open(); err != nil {
+			t.Fatal(err)
+		}
+
+		long := strings.Repeat("x", 30)
+		gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("short")}, &pubsub.Message{ID: "2", Data: []byte(long)})
+		if err := gcpinfo.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "short" {
+			t.Errorf("%s: expected only the short message in the message log, got %q", action, lines)
+		}
+		if len(*acked) != 2 || len(*nacked) != 0 {
+			t.Errorf("%s: expected both messages acked, got acked %v nacked %v", action, *acked, *nacked)
+		}
+		content, _ := ioutil.ReadFile(gcpinfo.Worker.Deadletter_path)
+		if want := map[string]string{OversizeSkip: "", OversizeDeadLetter: long + "\n"}[action]; string(content) != want {
+			t.Errorf("%s: expected dead-letter file %q, got %q", action, want, content)
+		}
+
+		restore()
+		os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	}
+}
+
+func TestCheckOversize(t *testing.T) {
+	bad := []WorkerInfo{
+		{Max_message_bytes: -1},
+		{Max_message_action: OversizeSkip},
+		{Max_message_bytes: 100, Max_message_action: "drop"},
+		{Max_message_bytes: 100, Max_message_action: OversizeDeadLetter},
+		{Max_message_bytes: len(TruncatedMarker)},
+	}
+	for _, worker := range bad {
+		if err := worker.checkOversize(); err == nil {
+			t.Errorf("expected max_message_bytes %d with action %q to be rejected", worker.Max_message_bytes, worker.Max_message_action)
+		}
+	}
+	worker := WorkerInfo{Max_message_bytes: 100}
+	if err := worker.checkOversize(); err != nil || worker.Max_message_action != OversizeTruncate {
+		t.Errorf("expected max_message_action to default to %s, got %q %v", OversizeTruncate, worker.Max_message_action, err)
+	}
+}
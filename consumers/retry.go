@@ -0,0 +1,57 @@
+package consumers
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"time"
+)
+
+// retry delays for connecting to pub/sub. The nth retry waits up to retryBaseDelay*2^(n-1), capped at retryMaxDelay.
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+//retryable reports whether a pub/sub error is a blip worth riding out. Everything else, e.g. PermissionDenied or
+//NotFound, is misconfiguration and fails fast.
+
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+//backoff is the wait before the given retry, exponential with full jitter so restarted workers do not reconnect in step.
+
+func backoff(retry int) time.Duration {
+	delay := retryMaxDelay
+	if retry < 30 {
+		if d := retryBaseDelay << uint(retry-1); d < retryMaxDelay {
+			delay = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+//retry runs f up to Connect_attempts times while it fails with a retryable error, and returns the last error.
+
+func (gcpinfo *GCPInfo) retry(ctx context.Context, what string, f func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !retryable(err) || attempt >= gcpinfo.Worker.Connect_attempts {
+			return err
+		}
+
+		delay := backoff(attempt)
+		gcpinfo.Worker.Worker_logger_error.Println("Attempt", attempt, "to", what, "failed, retrying in", delay, ":", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
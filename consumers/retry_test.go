@@ -0,0 +1,71 @@
+package consumers
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "blip"), true},
+		{status.Error(codes.DeadlineExceeded, "slow"), true},
+		{status.Error(codes.PermissionDenied, "no"), false},
+		{status.Error(codes.NotFound, "typo"), false},
+		{errors.New("plain"), false},
+	} {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond
+	defer func() { retryBaseDelay, retryMaxDelay = time.Second, 30*time.Second }()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.Connect_attempts = 3
+
+	//transient errors are retried until attempts run out, returning the last one
+	var calls int
+	last := status.Error(codes.Unavailable, "still down")
+	err := gcpinfo.retry(context.Background(), "connect", func() error {
+		calls++
+		return last
+	})
+	if calls != 3 || err != last {
+		t.Errorf("expected 3 calls ending in the last error, got %d calls and %v", calls, err)
+	}
+
+	//permanent errors fail on the first call
+	calls = 0
+	gcpinfo.retry(context.Background(), "connect", func() error {
+		calls++
+		return status.Error(codes.PermissionDenied, "no")
+	})
+	if calls != 1 {
+		t.Errorf("expected no retry on PermissionDenied, got %d calls", calls)
+	}
+
+	//success after a blip
+	calls = 0
+	err = gcpinfo.retry(context.Background(), "connect", func() error {
+		calls++
+		if calls == 1 {
+			return status.Error(codes.Unavailable, "blip")
+		}
+		return nil
+	})
+	if calls != 2 || err != nil {
+		t.Errorf("expected success on the second call, got %d calls and %v", calls, err)
+	}
+}
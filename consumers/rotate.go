@@ -0,0 +1,151 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Rotation modes for workerinfo.rotation.mode. RotateSize, the default, has lumberjack rotate the message log once it
+// reaches rotation.maxsize. RotateTime starts a new file every rotation.interval minutes regardless of size, named after
+// the start of its period, e.g. sub-2020-01-02T03-00.log for hourly files.
+const (
+	RotateSize = "size"
+	RotateTime = "time"
+)
+
+//defaultRotationInterval is the rotation.interval of time rotation when it is not set, hourly files.
+
+const defaultRotationInterval = 60
+
+//periodLayout stamps the start of a time rotation period into the file name, in UTC.
+
+const periodLayout = "2006-01-02T15-04"
+
+//checkRotation checks workerinfo.rotation. The settings of one mode make no sense with the other, so mixing them is an
+//error rather than silently ignored.
+
+func (worker *WorkerInfo) checkRotation() error {
+	rotation := worker.Rotation
+	if rotation == nil {
+		return nil
+	}
+	if rotation.Maxsize < 0 || rotation.Maxbackups < 0 || rotation.Maxage < 0 || rotation.Interval < 0 {
+		return errors.New("ERROR: config field workerinfo.rotation must not have negative values")
+	}
+
+	switch rotation.Mode {
+	case "", RotateSize:
+		if rotation.Interval != 0 {
+			return errors.New("ERROR: config field workerinfo.rotation.interval needs workerinfo.rotation.mode time")
+		}
+		//a rotation in the middle of a gzip stream would leave both files unreadable, use rotation.compress instead
+		if worker.Compress_messages {
+			return errors.New("ERROR: config field workerinfo.compress_messages cannot be combined with workerinfo.rotation, use rotation.compress")
+		}
+		//lumberjack does not expose its file
+		if worker.Fsync_on_flush {
+			return errors.New("ERROR: config field workerinfo.fsync_on_flush cannot be combined with workerinfo.rotation")
+		}
+	case RotateTime:
+		if rotation.Maxsize != 0 || rotation.Maxbackups != 0 || rotation.Maxage != 0 || rotation.Compress {
+			return errors.New("ERROR: config field workerinfo.rotation.mode time cannot be combined with rotation.maxsize, maxbackups, maxage or compress, those are for size rotation")
+		}
+	default:
+		return fmt.Errorf("ERROR: config field workerinfo.rotation.mode %q must be %s or %s", rotation.Mode, RotateSize, RotateTime)
+	}
+	return nil
+}
+
+//byTime reports whether the message log rotates on a schedule rather than through lumberjack.
+
+func (rotation *RotationInfo) byTime() bool {
+	return rotation != nil && rotation.Mode == RotateTime
+}
+
+//every is the length of a time rotation period.
+
+func (rotation *RotationInfo) every() time.Duration {
+	if rotation.Interval == 0 {
+		return defaultRotationInterval * time.Minute
+	}
+	return time.Duration(rotation.Interval) * time.Minute
+}
+
+//timeSink is the message log with time rotation. Each period gets its own file sink, opened on the first write of the
+//period, so an idle worker leaves no empty files behind. A batch always goes into a single file: the period is only
+//checked at the first write after a Flush, a batch that runs over the end of its period finishes in the old file.
+
+type timeSink struct {
+	name    string //message log name, each file gets the period start inserted before its extension
+	every   time.Duration
+	open    func(name string) (*FileSink, error)
+	now     func() time.Time
+	current *FileSink
+	period  time.Time
+	writing bool //a batch is being written into current
+}
+
+func newTimeSink(name string, every time.Duration, open func(name string) (*FileSink, error)) *timeSink {
+	return &timeSink{name: name, every: every, open: open, now: time.Now}
+}
+
+func (s *timeSink) Write(p []byte) error {
+	if !s.writing {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		s.writing = true
+	}
+	return s.current.Write(p)
+}
+
+//rotate closes the file of an earlier period and opens the one for the current period.
+
+func (s *timeSink) rotate() error {
+	period := s.now().UTC().Truncate(s.every)
+	if s.current != nil && period.Equal(s.period) {
+		return nil
+	}
+	if s.current != nil {
+		err := s.current.Close()
+		s.current = nil
+		if err != nil {
+			return err
+		}
+	}
+	current, err := s.open(periodName(s.name, period))
+	if err != nil {
+		return err
+	}
+	s.current, s.period = current, period
+	return nil
+}
+
+func (s *timeSink) Flush() error {
+	s.writing = false
+	if s.current == nil {
+		return nil
+	}
+	return s.current.Flush()
+}
+
+func (s *timeSink) Close() error {
+	s.writing = false
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func (s *timeSink) gone() bool {
+	return s.current != nil && s.current.gone()
+}
+
+//periodName inserts the period start into a message log name, before .log.gz or .log.
+
+func periodName(name string, period time.Time) string {
+	return insertSuffix(name, "-"+period.Format(periodLayout))
+}
@@ -0,0 +1,75 @@
+package consumers
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeSinkKeepsBatchInOneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	worker := &WorkerInfo{Message_log_path: dir, Rotation: &RotationInfo{Mode: RotateTime}}
+	sink := newTimeSink(subscription+".log", worker.Rotation.every(), worker.openFileSink)
+	now := time.Date(2020, 1, 2, 3, 59, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+
+	sink.Write([]byte("one\n"))
+	//the hour ends in the middle of the batch, it still finishes in the 03:00 file
+	now = now.Add(2 * time.Minute)
+	sink.Write([]byte("two\n"))
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("three\n"))
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		subscription + "-2020-01-02T03-00.log": "one\ntwo\n",
+		subscription + "-2020-01-02T04-00.log": "three\n",
+	} {
+		content, err := ioutil.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("expected %q in %s, got %q", want, name, content)
+		}
+	}
+}
+
+func TestPeriodName(t *testing.T) {
+	period := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	for name, want := range map[string]string{
+		"sub.log":    "sub-2020-01-02T03-00.log",
+		"sub.log.gz": "sub-2020-01-02T03-00.log.gz",
+		"a.b.json":   "a.b-2020-01-02T03-00.json",
+	} {
+		if got := periodName(name, period); got != want {
+			t.Errorf("expected %s for %s, got %s", want, name, got)
+		}
+	}
+}
+
+func TestCheckRotationRejectsMixedModes(t *testing.T) {
+	worker := &WorkerInfo{Rotation: &RotationInfo{Mode: RotateTime, Maxsize: 10}}
+	if err := worker.checkRotation(); err == nil {
+		t.Error("expected maxsize with time rotation to be rejected")
+	}
+	worker.Rotation = &RotationInfo{Interval: 30}
+	if err := worker.checkRotation(); err == nil {
+		t.Error("expected interval with size rotation to be rejected")
+	}
+	worker.Rotation = &RotationInfo{Mode: RotateTime, Interval: 30}
+	worker.Compress_messages = true
+	if err := worker.checkRotation(); err != nil {
+		t.Errorf("expected compress_messages to go with time rotation, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxRoutes is the max_routes of route_attribute when it is not set.
+const DefaultMaxRoutes = 64
+
+//routeGroup is the part of a batch that goes to one route, in batch order. key is empty for the default file.
+
+type routeGroup struct {
+	key   string
+	msgs  []*pubsub.Message
+	lines [][]byte
+	err   error //what writing the group failed with, set by writeGroups
+}
+
+//group splits the rendered messages of a batch by their route. Without route_attribute it is a single group for the
+//message log itself.
+
+func (gcpinfo *GCPInfo) group(msgs []*pubsub.Message, lines [][]byte) []*routeGroup {
+	if gcpinfo.Route_attr == "" {
+		return []*routeGroup{{msgs: msgs, lines: lines}}
+	}
+	var groups []*routeGroup
+	byKey := map[string]*routeGroup{}
+	for i, msg := range msgs {
+		key := routeKey(msg.Attributes[gcpinfo.Route_attr])
+		g := byKey[key]
+		if g == nil {
+			g = &routeGroup{key: key}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.msgs = append(g.msgs, msg)
+		g.lines = append(g.lines, lines[i])
+	}
+	return groups
+}
+
+//routeKey makes an attribute value safe to put in a file name, anything but letters, digits, dot, dash and underscore
+//becomes an underscore, so a value cannot name a path outside messagelogpath.
+
+func routeKey(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+//routeName is the file of a route, the message log name with -<key> before its extension.
+
+func (gcpinfo *GCPInfo) routeName(key string) string {
+	return insertSuffix(gcpinfo.messageLogName(), "-"+key)
+}
+
+//routeSink returns the sink of a route, opening its file the first time the route is used and again when it was
+//removed. The empty key is the message log itself. A new route past max_routes also goes to the message log, an
+//attribute with unbounded values would otherwise open a file for each. Callers hold mu.
+
+func (gcpinfo *GCPInfo) routeSink(key string) (Sink, error) {
+	if key == "" {
+		return gcpinfo.sink, nil
+	}
+	sink, ok := gcpinfo.routes[key]
+	if ok {
+		if v, isVanishing := sink.(vanishing); !isVanishing || !v.gone() {
+			return sink, nil
+		}
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING: message log", gcpinfo.routeName(key), "was removed, reopening it")
+		if err := sink.Close(); err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to close removed message log", gcpinfo.routeName(key)+":", err)
+		}
+		delete(gcpinfo.routes, key)
+	} else if len(gcpinfo.routes) >= gcpinfo.Max_routes {
+		if !gcpinfo.routesFull {
+			gcpinfo.Worker.Worker_logger_error.Println("WARNING: max_routes", gcpinfo.Max_routes, "reached, messages with new", gcpinfo.Route_attr, "values like", key, "go to", gcpinfo.messageLogName())
+			gcpinfo.routesFull = true
+		}
+		return gcpinfo.sink, nil
+	}
+
+	sink, err := gcpinfo.Worker.openSink(gcpinfo.routeName(key))
+	if err != nil {
+		return nil, err
+	}
+	if gcpinfo.routes == nil {
+		gcpinfo.routes = map[string]Sink{}
+	}
+	gcpinfo.routes[key] = sink
+	return sink, nil
+}
+
+//checkRoutePool checks route_concurrency. A route that fails is nacked while the others are acked, with ordered that
+//would let messages of an ordering key in one route overtake a failed one in another.
+
+func (gcpinfo *GCPInfo) checkRoutePool() error {
+	if gcpinfo.Route_pool < 0 {
+		return fmt.Errorf("ERROR: config field route_concurrency is %d, it must be positive", gcpinfo.Route_pool)
+	}
+	if gcpinfo.Route_pool > 0 && gcpinfo.Route_attr == "" {
+		return errors.New("ERROR: config field route_concurrency needs route_by_attribute")
+	}
+	if gcpinfo.Route_pool > 1 && gcpinfo.Ordered {
+		return errors.New("ERROR: config field route_concurrency cannot be combined with ordered, routes are acked on their own")
+	}
+	return nil
+}
+
+//writeGroups writes the groups of a batch on up to route_concurrency goroutines and records in each group how it
+//went, so each route is settled on its own. The sinks are looked up beforehand, groups that share one, like the routes
+//past max_routes going to the message log, are merged so no sink is written from two goroutines. It returns the
+//merged groups, the bytes written by the ones that succeeded and the first error in batch order. Callers hold mu.
+
+func (gcpinfo *GCPInfo) writeGroups(groups []*routeGroup) ([]*routeGroup, int, error) {
+	var merged []*routeGroup
+	bySink := map[Sink]*routeGroup{}
+	sinks := map[*routeGroup]Sink{}
+	for _, group := range groups {
+		sink, err := gcpinfo.routeSink(group.key)
+		if err != nil {
+			group.err = err
+			merged = append(merged, group)
+			continue
+		}
+		if into := bySink[sink]; into != nil {
+			into.msgs = append(into.msgs, group.msgs...)
+			into.lines = append(into.lines, group.lines...)
+			continue
+		}
+		bySink[sink] = group
+		sinks[group] = sink
+		merged = append(merged, group)
+	}
+
+	written := make([]int, len(merged))
+	pool := make(chan struct{}, gcpinfo.Route_pool)
+	var wg sync.WaitGroup
+	for i, group := range merged {
+		if group.err != nil {
+			continue
+		}
+		wg.Add(1)
+		pool <- struct{}{}
+		go func(i int, group *routeGroup) {
+			defer wg.Done()
+			defer func() { <-pool }()
+			written[i], group.err = writeLines(sinks[group], group.lines)
+		}(i, group)
+	}
+	wg.Wait()
+
+	var total int
+	var first error
+	for i, group := range merged {
+		if group.err != nil {
+			name := gcpinfo.routeName(group.key)
+			if sinks[group] == gcpinfo.sink {
+				name = gcpinfo.messageLogName()
+			}
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to write", len(group.msgs), "messages to", name, "nacking them:", group.err)
+			if first == nil {
+				first = group.err
+			}
+			continue
+		}
+		total += written[i]
+	}
+	return merged, total, first
+}
+
+//closeRoutes closes the sinks of every route and returns the first error. Callers hold mu.
+
+func (gcpinfo *GCPInfo) closeRoutes() error {
+	var err error
+	for key, sink := range gcpinfo.routes {
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+		delete(gcpinfo.routes, key)
+	}
+	gcpinfo.routesFull = false
+	return err
+}
+
+//insertSuffix puts suffix into a message log name before .log.gz or .log, or whatever the extension is.
+
+func insertSuffix(name string, suffix string) string {
+	gz := ""
+	if strings.HasSuffix(name, ".gz") {
+		name, gz = strings.TrimSuffix(name, ".gz"), ".gz"
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + suffix + ext + gz
+}
@@ -0,0 +1,188 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readRoute(t *testing.T, gcpinfo *GCPInfo, key string) []string {
+	content, err := ioutil.ReadFile(gcpinfo.Worker.Message_log_path + "/" + gcpinfo.routeName(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestFlushRoutesByAttribute(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Route_attr, gcpinfo.Max_routes = "type", 2
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("login 1"), Attributes: map[string]string{"type": "login"}},
+		&pubsub.Message{ID: "2", Data: []byte("untyped")},
+		&pubsub.Message{ID: "3", Data: []byte("audit"), Attributes: map[string]string{"type": "../audit"}},
+		&pubsub.Message{ID: "4", Data: []byte("login 2"), Attributes: map[string]string{"type": "login"}},
+		&pubsub.Message{ID: "5", Data: []byte("over the limit"), Attributes: map[string]string{"type": "billing"}},
+	)
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := readRoute(t, gcpinfo, "login"); !reflect.DeepEqual(lines, []string{"login 1", "login 2"}) {
+		t.Errorf("expected both logins in their route, got %q", lines)
+	}
+	if lines := readRoute(t, gcpinfo, ".._audit"); !reflect.DeepEqual(lines, []string{"audit"}) {
+		t.Errorf("expected the audit route named without its slash, got %q", lines)
+	}
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"untyped", "over the limit"}) {
+		t.Errorf("expected the message log to get messages without the attribute and past max_routes, got %q", lines)
+	}
+	if len(*acked) != 5 {
+		t.Errorf("expected all 5 acked, got %v", *acked)
+	}
+}
+
+func TestFlushNacksAllRoutesOnFailure(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Route_attr, gcpinfo.Max_routes = "type", DefaultMaxRoutes
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.routes = map[string]Sink{"login": failingSink{}}
+
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("untyped")},
+		&pubsub.Message{ID: "2", Data: []byte("login"), Attributes: map[string]string{"type": "login"}},
+	)
+	if err := gcpinfo.Flush(); err == nil {
+		t.Fatal("expected the failing route to fail the flush")
+	}
+	if len(*acked) != 0 || len(*nacked) != 2 {
+		t.Errorf("expected the whole batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestConcurrentRoutesSettleOnTheirOwn(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Route_attr, gcpinfo.Max_routes, gcpinfo.Route_pool = "type", DefaultMaxRoutes, 4
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+	gcpinfo.routes = map[string]Sink{"login": failingSink{}}
+
+	gcpinfo.batch = append(gcpinfo.batch,
+		&pubsub.Message{ID: "1", Data: []byte("untyped")},
+		&pubsub.Message{ID: "2", Data: []byte("login 1"), Attributes: map[string]string{"type": "login"}},
+		&pubsub.Message{ID: "3", Data: []byte("audit"), Attributes: map[string]string{"type": "audit"}},
+		&pubsub.Message{ID: "4", Data: []byte("login 2"), Attributes: map[string]string{"type": "login"}},
+		&pubsub.Message{ID: "5", Data: []byte("billing"), Attributes: map[string]string{"type": "billing"}},
+	)
+	err := gcpinfo.Flush()
+	if err == nil || !strings.Contains(err.Error(), "2 of the 5") {
+		t.Fatalf("expected the login route to fail the flush, got %v", err)
+	}
+	if err = gcpinfo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(*acked)
+	if !reflect.DeepEqual(*acked, []string{"1", "3", "5"}) || !reflect.DeepEqual(*nacked, []string{"2", "4"}) {
+		t.Errorf("expected only the login route nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if lines := readRoute(t, gcpinfo, "audit"); !reflect.DeepEqual(lines, []string{"audit"}) {
+		t.Errorf("expected the audit route written, got %q", lines)
+	}
+	if lines := readRoute(t, gcpinfo, "billing"); !reflect.DeepEqual(lines, []string{"billing"}) {
+		t.Errorf("expected the billing route written, got %q", lines)
+	}
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"untyped"}) {
+		t.Errorf("expected the message log written, got %q", lines)
+	}
+}
+
+//slowSink takes a while to flush and records how many flushes of all slowSinks overlapped at most.
+
+type slowSink struct{ active, peak *int32 }
+
+func (s slowSink) Write(p []byte) error { return nil }
+func (s slowSink) Close() error         { return nil }
+func (s slowSink) Flush() error {
+	n := atomic.AddInt32(s.active, 1)
+	for {
+		peak := atomic.LoadInt32(s.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(s.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(s.active, -1)
+	return nil
+}
+
+func TestConcurrentRoutesBoundedByPool(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 10)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Route_attr, gcpinfo.Max_routes, gcpinfo.Route_pool = "type", DefaultMaxRoutes, 2
+	var active, peak int32
+	gcpinfo.sink = slowSink{&active, &peak}
+	gcpinfo.routes = map[string]Sink{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		//a pointer each, equal sinks would be merged into one group
+		gcpinfo.routes[key] = &slowSink{&active, &peak}
+		gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: key, Data: []byte(key), Attributes: map[string]string{"type": key}})
+	}
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if peak != 2 {
+		t.Errorf("expected 2 routes flushed at once, got %d", peak)
+	}
+	if len(*acked) != 4 {
+		t.Errorf("expected all 4 acked, got %v", *acked)
+	}
+}
+
+func TestCheckRoutePool(t *testing.T) {
+	for _, c := range []struct {
+		gcpinfo *GCPInfo
+		ok      bool
+	}{
+		{&GCPInfo{}, true},
+		{&GCPInfo{Route_attr: "type", Route_pool: 8}, true},
+		{&GCPInfo{Route_attr: "type", Route_pool: -1}, false},
+		{&GCPInfo{Route_pool: 8}, false},
+		{&GCPInfo{Route_attr: "type", Route_pool: 8, Ordered: true}, false},
+	} {
+		if err := c.gcpinfo.checkRoutePool(); (err == nil) != c.ok {
+			t.Errorf("route_by_attribute %q route_concurrency %d ordered %v: expected ok %v, got %v", c.gcpinfo.Route_attr, c.gcpinfo.Route_pool, c.gcpinfo.Ordered, c.ok, err)
+		}
+	}
+}
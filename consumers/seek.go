@@ -0,0 +1,64 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// DefaultRetention is how long pub/sub keeps the messages of a subscription when its config does not say.
+const DefaultRetention = 7 * 24 * time.Hour
+
+// Seek resets the subscription to to, for replaying a window after an incident: the messages published after to are
+// delivered again, also the ones that were acked, and the ones published before it count as acked. The subscription has
+// to retain acked messages and to may not be older than its retention, otherwise the seek would replay less than asked
+// for and fails up front. A time in the future would ack everything before it and is rejected too.
+//
+// Seek only moves the subscription, the messages come in through the next Consume. It is not part of Run, the CLI
+// only calls it for an explicit -seek-to.
+func (gcpinfo *GCPInfo) Seek(ctx context.Context, to time.Time) error {
+	client, err := gcpinfo.pubsubClient(ctx)
+	if err != nil {
+		return err
+	}
+	sub := client.Subscription(gcpinfo.Subscription)
+	if err = gcpinfo.checkExists(ctx, "subscription", gcpinfo.Subscription, sub.Exists); err != nil {
+		return err
+	}
+	config, err := gcpinfo.subscriptionConfig(ctx, sub)
+	if err != nil {
+		return err
+	}
+	if err = checkSeek(config.RetainAckedMessages, config.RetentionDuration, to, time.Now()); err != nil {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to seek subscription %q", gcpinfo.Subscription), err)
+	}
+
+	gcpinfo.Worker.Worker_logger_info.Println("Seeking subscription", gcpinfo.Subscription, "to", to.UTC().Format(time.RFC3339))
+	err = gcpinfo.retry(ctx, "seek the subscription", func() error {
+		return sub.SeekToTime(ctx, to)
+	})
+	if err != nil {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to seek subscription %q in project %q. Does the user have edit permissions", gcpinfo.Subscription, gcpinfo.Project), err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("Subscription", gcpinfo.Subscription, "now delivers from", to.UTC().Format(time.RFC3339))
+	return nil
+}
+
+//checkSeek checks that a subscription with the given retention can replay everything from to on.
+
+func checkSeek(retainAcked bool, retention time.Duration, to time.Time, now time.Time) error {
+	if to.After(now) {
+		return fmt.Errorf("%s is in the future, seeking there would ack every message before it", to.UTC().Format(time.RFC3339))
+	}
+	if !retainAcked {
+		return errors.New("it does not retain acked messages, seeking back would not replay them")
+	}
+	if retention == 0 {
+		retention = DefaultRetention
+	}
+	if oldest := now.Add(-retention); to.Before(oldest) {
+		return fmt.Errorf("%s is older than its retention of %s, it only goes back to %s", to.UTC().Format(time.RFC3339), retention, oldest.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package consumers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSeek(t *testing.T) {
+	now := time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name        string
+		retainAcked bool
+		retention   time.Duration
+		to          time.Time
+		want        string
+	}{
+		{"within retention", true, 0, now.Add(-24 * time.Hour), ""},
+		{"future", true, 0, now.Add(time.Hour), "in the future"},
+		{"acked not retained", false, 0, now.Add(-time.Hour), "does not retain acked messages"},
+		{"past default retention", true, 0, now.Add(-8 * 24 * time.Hour), "older than its retention of 168h0m0s"},
+		{"past configured retention", true, time.Hour, now.Add(-2 * time.Hour), "older than its retention of 1h0m0s"},
+	} {
+		err := checkSeek(tc.retainAcked, tc.retention, tc.to, now)
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: expected the seek allowed, got %v", tc.name, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: expected an error with %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
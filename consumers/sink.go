@@ -0,0 +1,353 @@
+package consumers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+)
+
+// Output formats for workerinfo.output_format. OutputNDJSON, the default, writes one event per line. OutputJSONArray
+// writes each message log file as a single JSON array, opened when the file is and closed on rotation and shutdown, so
+// every event must itself be valid JSON.
+const (
+	OutputNDJSON    = "ndjson"
+	OutputJSONArray = "json_array"
+)
+
+//jsonArrayOpen, jsonArraySep and jsonArrayClose frame the events of a json_array file, one event per line.
+
+var (
+	jsonArrayOpen  = []byte("[\n")
+	jsonArraySep   = []byte(",\n")
+	jsonArrayClose = []byte("\n]\n")
+)
+
+//lumberjackMaxsize is the lumberjack default for rotation.maxsize, in megabytes.
+
+const lumberjackMaxsize = 100
+
+// Sink is where Flush writes a batch. Write gets one newline terminated event, Flush is called once per batch and the
+// batch is only acked when it returns nil.
+type Sink interface {
+	Write(p []byte) error
+	Flush() error
+	Close() error
+}
+
+// FileSink appends events to a local log file for the Splunk forwarder to pick up, buffering a batch between flushes.
+type FileSink struct {
+	file   io.WriteCloser //the log file, or a lumberjack logger rotating it
+	writer *bufio.Writer
+	gz     *gzip.Writer //compresses into writer when set, see NewGzipFileSink
+	out    io.Writer    //gz or writer, whichever events go into
+	fsync  bool         //Sync the file after every Flush, see SyncOnFlush
+	closed bool
+
+	//json_array state, see JSONArray
+	path    string
+	array   bool
+	events  int   //events in the current array
+	size    int64 //bytes in the current file, written or buffered
+	maxsize int64 //rotation size in bytes for a rotating sink, 0 otherwise
+
+	meta      *fileMeta //counts what reaches the file for its sidecar, see MetaOnClose
+	unflushed int64     //newlines written since the last Flush, they only count for meta once it succeeds
+}
+
+//gone reports whether the file the sink was opened on no longer exists.
+
+func (s *FileSink) gone() bool {
+	if s.path == "" || s.closed {
+		return false
+	}
+	_, err := os.Stat(s.path)
+	return os.IsNotExist(err)
+}
+
+//syncer is an *os.File, the part of it SyncOnFlush needs.
+
+type syncer interface {
+	Sync() error
+}
+
+// NewFileSink opens an existing log file for appending. Use CreateMessageLogFiles to create it first.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, wrap(ErrFileOpen, "Unable to Open events output log file", err)
+	}
+	writer := bufio.NewWriter(file)
+	return &FileSink{file: file, writer: writer, out: writer, path: path}, nil
+}
+
+// RotationInfo turns on rotation for the message log. With lumberjack size rotation, the default, the live file keeps
+// its name and rotated files get a timestamp before the extension, e.g. sub-2020-01-02T03-04-05.000.log, so a
+// <subscription>*.log monitor stanza matches both. With time rotation every file is named after its period, see
+// RotateTime.
+type RotationInfo struct {
+	Mode       string `json:"mode,omitempty" yaml:"mode,omitempty"`         //size (default) or time, see RotateSize
+	Maxsize    int    `json:"maxsize" yaml:"maxsize"`                       //megabytes before rotating, lumberjack defaults to 100
+	Maxbackups int    `json:"maxbackups" yaml:"maxbackups"`                 //rotated files to keep, 0 keeps all
+	Maxage     int    `json:"maxage" yaml:"maxage"`                         //days to keep rotated files, 0 keeps all
+	Compress   bool   `json:"compress" yaml:"compress"`                     //gzip rotated files
+	Interval   int    `json:"interval,omitempty" yaml:"interval,omitempty"` //minutes per file for time rotation, defaults to 60
+}
+
+// NewRotatingFileSink is NewFileSink with the file rotated by lumberjack.
+func NewRotatingFileSink(path string, rotation RotationInfo) *FileSink {
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    rotation.Maxsize,
+		MaxBackups: rotation.Maxbackups,
+		MaxAge:     rotation.Maxage,
+		Compress:   rotation.Compress,
+	}
+	writer := bufio.NewWriter(file)
+	return &FileSink{file: file, writer: writer, out: writer, path: path}
+}
+
+// NewGzipFileSink is NewFileSink with the events gzipped. Every Flush ends on a gzip sync point, so the forwarder can
+// decompress up to the last flushed batch while the file is still being written. Each sink appends its own gzip member,
+// which gzip readers treat as one stream.
+func NewGzipFileSink(path string) (*FileSink, error) {
+	s, err := NewFileSink(path)
+	if err != nil {
+		return nil, err
+	}
+	s.gz = gzip.NewWriter(s.writer)
+	s.out = s.gz
+	return s, nil
+}
+
+// SyncOnFlush makes every Flush also fsync the file so a flushed batch survives a crash of the host, not just of the
+// worker. It fails for a rotating sink, lumberjack does not expose the file to sync.
+func (s *FileSink) SyncOnFlush() error {
+	if _, ok := s.file.(syncer); !ok {
+		return errors.New("Unable to fsync the events output log file, it is not a plain file")
+	}
+	s.fsync = true
+	return nil
+}
+
+// JSONArray makes the sink write its file as a JSON array instead of one event per line. A file left by an earlier sink
+// is reopened by dropping its closing bracket and carrying on with the array. A rotating sink closes the array before
+// every rotation and opens a new one in the next file, so rotated files are valid JSON too. It has to be called before
+// the first Write and fails for a gzip sink, whose earlier output cannot be reopened.
+func (s *FileSink) JSONArray() error {
+	if s.gz != nil {
+		return errors.New("Unable to write a JSON array to a gzipped events output log file")
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return wrap(ErrFileOpen, "Unable to Open events output log file", err)
+	}
+	s.size = info.Size()
+	if lj, ok := s.file.(*lumberjack.Logger); ok {
+		maxsize := lj.MaxSize
+		if maxsize == 0 {
+			maxsize = lumberjackMaxsize
+		}
+		s.maxsize = int64(maxsize) * 1024 * 1024
+	}
+
+	if s.size == 0 {
+		err = s.openArray()
+	} else if err = s.reopenArray(); err != nil {
+		return wrap(ErrFileOpen, "Unable to reopen the JSON array in events output log file", err)
+	}
+	s.array = err == nil
+	return err
+}
+
+//reopenArray drops the closing bracket an earlier sink left, a file without one was not closed cleanly and is carried
+//on as it is.
+
+func (s *FileSink) reopenArray() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tail := make([]byte, len(jsonArrayClose))
+	if s.size >= int64(len(tail)) {
+		if _, err = f.ReadAt(tail, s.size-int64(len(tail))); err != nil {
+			return err
+		}
+		if bytes.Equal(tail, jsonArrayClose) {
+			s.size -= int64(len(tail))
+			if err = os.Truncate(s.path, s.size); err != nil {
+				return err
+			}
+		}
+	}
+	if s.size > int64(len(jsonArrayOpen)) {
+		s.events = 1
+	}
+	return nil
+}
+
+//openArray starts a new array in the current file.
+
+func (s *FileSink) openArray() error {
+	s.events = 0
+	return s.write(jsonArrayOpen)
+}
+
+//rotate closes the array, has lumberjack rotate the file and opens a new array in the next one.
+
+func (s *FileSink) rotate() error {
+	if err := s.write(jsonArrayClose); err != nil {
+		return err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.(*lumberjack.Logger).Rotate(); err != nil {
+		return err
+	}
+	s.size = 0
+	return s.openArray()
+}
+
+// SetBufferSize replaces the default 4KB write buffer, a buffer that holds a whole batch turns each Flush into a single
+// write call. It has to be called before the first Write.
+func (s *FileSink) SetBufferSize(size int) {
+	var file io.Writer = s.file
+	if s.meta != nil {
+		file = io.MultiWriter(s.file, s.meta)
+	}
+	s.writer = bufio.NewWriterSize(file, size)
+	s.out = s.writer
+	if s.gz != nil {
+		s.gz.Reset(s.writer)
+		s.out = s.gz
+	}
+}
+
+func (s *FileSink) Write(p []byte) error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	if !s.array {
+		_, err := s.out.Write(p)
+		if err == nil && s.meta != nil {
+			s.unflushed += int64(bytes.Count(p, []byte("\n")))
+		}
+		return err
+	}
+
+	p = bytes.TrimSuffix(p, []byte("\n"))
+	sep := 0
+	if s.events > 0 {
+		sep = len(jsonArraySep)
+	}
+	//rotate ahead of lumberjack, which would otherwise cut the file in the middle of the array
+	if s.maxsize > 0 && s.events > 0 && s.size+int64(sep+len(p)+len(jsonArrayClose)) > s.maxsize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		sep = 0
+	}
+	if sep > 0 {
+		if err := s.write(jsonArraySep); err != nil {
+			return err
+		}
+	}
+	s.events++
+	return s.write(p)
+}
+
+//write is a json_array write that keeps count of the file size.
+
+func (s *FileSink) write(p []byte) error {
+	n, err := s.out.Write(p)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Flush() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	err := s.flush()
+	s.countFlushed(err)
+	return err
+}
+
+//flush is Flush without the line count of meta.
+
+func (s *FileSink) flush() error {
+	if s.gz != nil {
+		if err := s.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.fsync {
+		return s.file.(syncer).Sync()
+	}
+	return nil
+}
+
+//countFlushed adds the lines written since the last flush to meta once err says they are out, a failed flush drops
+//them with its batch.
+
+func (s *FileSink) countFlushed(err error) {
+	if s.meta != nil && err == nil {
+		s.meta.lines += s.unflushed
+	}
+	s.unflushed = 0
+}
+
+// Close flushes anything still buffered and closes the file. Closing again is a no-op.
+func (s *FileSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.array {
+		err = s.write(jsonArrayClose)
+	}
+	if s.gz != nil {
+		err = s.gz.Close()
+	}
+	if ferr := s.writer.Flush(); err == nil {
+		err = ferr
+	}
+	s.countFlushed(err)
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if s.meta != nil && err == nil {
+		err = s.meta.write(s.path)
+	}
+	return err
+}
+
+//checkOutputFormat checks workerinfo.output_format once it is defaulted. json_array needs a file it can reopen, so it
+//does not go with a gzipped message log or with HEC.
+
+func (worker *WorkerInfo) checkOutputFormat() error {
+	switch worker.Output_format {
+	case OutputNDJSON:
+		return nil
+	case OutputJSONArray:
+		if worker.Compress_messages {
+			return errors.New("ERROR: config field workerinfo.output_format json_array cannot be combined with workerinfo.compress_messages, use rotation.compress")
+		}
+		if worker.HEC != nil {
+			return errors.New("ERROR: config field workerinfo.output_format json_array cannot be combined with workerinfo.hec")
+		}
+		return nil
+	}
+	return fmt.Errorf("ERROR: config field workerinfo.output_format %q must be %s or %s", worker.Output_format, OutputNDJSON, OutputJSONArray)
+}
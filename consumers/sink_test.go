@@ -0,0 +1,210 @@
+package consumers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGzipFileSinkIsReadableAfterEachFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/" + subscription + ".log.gz"
+	if err = createMessageLog(dir, subscription+".log.gz", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewGzipFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write([]byte("one\n"))
+	sink.Write([]byte("two\n"))
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the stream is not closed yet, a reader still gets everything up to the flush
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _ := gz.Read(buf)
+	if string(buf[:n]) != "one\ntwo\n" {
+		t.Errorf("expected both lines readable after the flush, got %q", buf[:n])
+	}
+}
+
+func TestRotatingFileSinkKeepsFileName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/" + subscription + ".log"
+	sink := NewRotatingFileSink(path, RotationInfo{Maxsize: 1, Maxbackups: 2})
+	sink.Write([]byte("one\n"))
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "one\n" {
+		t.Errorf("expected the line in %s, got %q", path, content)
+	}
+}
+
+func TestSyncOnFlushRejectsRotatingSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewRotatingFileSink(dir+"/"+subscription+".log", RotationInfo{})
+	defer sink.Close()
+	if err := sink.SyncOnFlush(); err == nil {
+		t.Error("expected SyncOnFlush to fail for a lumberjack file")
+	}
+}
+
+//countingFile counts the write calls that reach the file.
+
+type countingFile struct{ writes int }
+
+func (f *countingFile) Write(p []byte) (int, error) { f.writes++; return len(p), nil }
+func (f *countingFile) Close() error                { return nil }
+
+func TestSetBufferSizeFlushesBatchInOneWrite(t *testing.T) {
+	file := &countingFile{}
+	sink := &FileSink{file: file, writer: bufio.NewWriter(file)}
+	sink.out = sink.writer
+	sink.SetBufferSize(1 << 16)
+
+	line := []byte(strings.Repeat("x", 999) + "\n")
+	for i := 0; i < 20; i++ {
+		if err := sink.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if file.writes != 1 {
+		t.Errorf("expected a 20KB batch in one write call with a 64KB buffer, got %d", file.writes)
+	}
+}
+
+func TestJSONArraySinkReopensArray(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/" + subscription + ".log"
+	if err = createMessageLog(dir, subscription+".log", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	//a second sink on the same file has to carry on with the array the first one closed
+	for _, events := range [][]string{{`{"n":1}`, `{"n":2}`}, {}, {`{"n":3}`}} {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sink.JSONArray(); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			sink.Write([]byte(event + "\n"))
+		}
+		if err = sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]int
+	if err = json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("expected a valid JSON array, got %q: %v", content, err)
+	}
+	if len(got) != 3 || got[2]["n"] != 3 {
+		t.Errorf("expected the 3 events in order, got %v", got)
+	}
+}
+
+func TestJSONArraySinkClosesArrayOnRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal("Not able to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/" + subscription + ".log"
+	if err = createMessageLog(dir, subscription+".log", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	sink := NewRotatingFileSink(path, RotationInfo{Maxsize: 1})
+	if err = sink.JSONArray(); err != nil {
+		t.Fatal(err)
+	}
+	//a megabyte is a lot of events, rotate after about two of them instead
+	sink.maxsize = 24
+	for i := 0; i < 5; i++ {
+		if err = sink.Write([]byte(`{"n":` + strconv.Itoa(i) + "}\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected the message log to rotate, got %d files", len(files))
+	}
+	var total int
+	for _, file := range files {
+		content, err := ioutil.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]int
+		if err = json.Unmarshal(content, &got); err != nil {
+			t.Errorf("expected %s to be a valid JSON array, got %q: %v", file.Name(), content, err)
+		}
+		total += len(got)
+	}
+	if total != 5 {
+		t.Errorf("expected the 5 events across the rotated files, got %d", total)
+	}
+}
@@ -0,0 +1,272 @@
+package consumers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults of workerinfo.spool.
+const (
+	DefaultSpoolBytes     = 1 << 30
+	DefaultSpoolRetrySecs = 30
+)
+
+// SpoolSuffix ends the name of a batch file in the spool directory.
+const SpoolSuffix = ".batch"
+
+// SpoolInfo configures the spool of workerinfo.hec. A batch HEC does not take is written to a file in path and acked,
+// instead of nacked, and posted again in the background until HEC takes it. Pub/sub consumption goes on while HEC is
+// down, without the redelivery storm of batches nacked over and over. A spooled batch is fsynced before it is acked.
+// Batches that come in while older ones are still spooled go to HEC right away, so events can arrive out of order.
+type SpoolInfo struct {
+	Path           string `json:"path" yaml:"path"`                                         //directory for spooled batches, created on startup
+	Max_bytes      int64  `json:"max_bytes,omitempty" yaml:"max_bytes,omitempty"`           //spool size limit, a batch that does not fit is nacked, see DefaultSpoolBytes
+	Retry_interval int    `json:"retry_interval,omitempty" yaml:"retry_interval,omitempty"` //seconds between attempts to drain the spool, see DefaultSpoolRetrySecs
+}
+
+//checkSpool checks workerinfo.spool and fills in its defaults. Only HEC has a downstream that can be away, with the
+//message log the disk failing a batch would fail its spooled copy as well.
+
+func (worker *WorkerInfo) checkSpool() error {
+	spool := worker.Spool
+	if spool == nil {
+		return nil
+	}
+	if worker.HEC == nil {
+		return errors.New("ERROR: config field workerinfo.spool needs workerinfo.hec")
+	}
+	if spool.Path == "" {
+		return errors.New("ERROR: config field workerinfo.spool.path is required")
+	}
+	if spool.Max_bytes < 0 || spool.Retry_interval < 0 {
+		return errors.New("ERROR: config field workerinfo.spool must not have negative values")
+	}
+	if spool.Max_bytes == 0 {
+		spool.Max_bytes = DefaultSpoolBytes
+	}
+	if spool.Retry_interval == 0 {
+		spool.Retry_interval = DefaultSpoolRetrySecs
+	}
+	return nil
+}
+
+//spool is the directory of spooled batches. put and replay run holding the consumer's mu.
+
+type spool struct {
+	dir  string
+	max  int64
+	size int64 //bytes of the batch files in dir
+	seq  int   //tells apart batches spooled within the same nanosecond
+	full bool  //the last put found the spool full and logged it
+}
+
+//openSpool creates the spool directory and counts the batches left in it by an earlier run, they are drained first.
+
+func openSpool(info *SpoolInfo) (*spool, error) {
+	if err := os.MkdirAll(info.Path, 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: info.Path, max: info.Max_bytes}
+	names, err := s.batches()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+			s.size += fi.Size()
+		}
+	}
+	return s, nil
+}
+
+//batches lists the spooled batch files, oldest first.
+
+func (s *spool) batches() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range files {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), SpoolSuffix) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//put writes the lines of a batch into a new batch file, each line after its length so lines with newlines survive. The
+//file is fsynced and renamed into place before put returns, a batch file that exists is complete.
+
+func (s *spool) put(lines [][]byte) error {
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	for _, line := range lines {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(line)))])
+		buf.Write(line)
+	}
+	if size := s.size + int64(buf.Len()); size > s.max {
+		return fmt.Errorf("spool %s is full, %d bytes with the batch, max_bytes is %d", s.dir, size, s.max)
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, SpoolSuffix)
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.size += int64(buf.Len())
+	return nil
+}
+
+//replay posts the oldest spooled batch through sink and removes its file once the sink took it. It reports whether a
+//batch was replayed, false with a nil error means the spool is empty.
+
+func (s *spool) replay(sink Sink) (bool, error) {
+	names, err := s.batches()
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+	path := filepath.Join(s.dir, names[0])
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	lines, err := spooledLines(content)
+	if err != nil {
+		//a bad file would stop the spool from ever draining past it
+		s.size -= int64(len(content))
+		if rerr := os.Rename(path, path+".bad"); rerr != nil {
+			return false, rerr
+		}
+		return false, fmt.Errorf("%s: %v, moved it aside to %s.bad", path, err, names[0])
+	}
+	for _, line := range lines {
+		if err = sink.Write(line); err != nil {
+			return false, err
+		}
+	}
+	if err = sink.Flush(); err != nil {
+		return false, err
+	}
+	if err = os.Remove(path); err != nil {
+		return false, err
+	}
+	s.size -= int64(len(content))
+	return true, nil
+}
+
+//spooledLines splits a batch file back into its lines.
+
+func spooledLines(content []byte) ([][]byte, error) {
+	var lines [][]byte
+	for len(content) > 0 {
+		n, k := binary.Uvarint(content)
+		if k <= 0 || uint64(len(content)-k) < n {
+			return nil, errors.New("truncated batch file")
+		}
+		lines = append(lines, content[k:k+int(n)])
+		content = content[k+int(n):]
+	}
+	return lines, nil
+}
+
+//spoolBatch spools the lines of a batch the sink failed, err is the failure. It returns nil once the batch is in the
+//spool and can be acked, or err when the spool does not take it either. Callers hold mu.
+
+func (gcpinfo *GCPInfo) spoolBatch(lines [][]byte, err error) error {
+	if serr := gcpinfo.spool.put(lines); serr != nil {
+		if !gcpinfo.spool.full {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to spool a batch of", len(lines), "messages, nacking batches until the spool drains:", serr)
+		}
+		gcpinfo.spool.full = true
+		return err
+	}
+	gcpinfo.spool.full = false
+	gcpinfo.Worker.Worker_logger_error.Println("WARNING: spooled a batch of", len(lines), "messages to", gcpinfo.spool.dir, "after:", err)
+	return nil
+}
+
+//spoolGroups spools the groups of a batch the sink failed and returns the first error left, nil once every failed group
+//is in the spool. A fatal write error is not spooled, the group keeps it so stopOnFatal still sees it. Callers hold mu.
+
+func (gcpinfo *GCPInfo) spoolGroups(groups []*routeGroup) error {
+	var first error
+	for _, group := range groups {
+		if group.err != nil && !fatalWrite(group.err) {
+			group.err = gcpinfo.spoolBatch(group.lines, group.err)
+		}
+		if first == nil {
+			first = group.err
+		}
+	}
+	return first
+}
+
+//drainEvery replays the spool every retry_interval until ctx is done. Each tick drains it batch by batch until it is
+//empty or the sink fails again, mu is taken per batch so the callbacks are not held up for the whole spool.
+
+func (gcpinfo *GCPInfo) drainEvery(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(gcpinfo.Worker.Spool.Retry_interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			gcpinfo.drain()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//drain replays spooled batches until the spool is empty or one fails.
+
+func (gcpinfo *GCPInfo) drain() {
+	var replayed int
+	for {
+		gcpinfo.mu.Lock()
+		if gcpinfo.sink == nil {
+			gcpinfo.mu.Unlock()
+			return
+		}
+		ok, err := gcpinfo.spool.replay(gcpinfo.sink)
+		gcpinfo.mu.Unlock()
+		if err != nil {
+			gcpinfo.Worker.Worker_logger_error.Println("Unable to drain the spool, retrying in", time.Duration(gcpinfo.Worker.Spool.Retry_interval)*time.Second, "next:", err)
+			return
+		}
+		if !ok {
+			if replayed > 0 {
+				gcpinfo.Worker.Worker_logger_info.Println("Drained", replayed, "spooled batches from", gcpinfo.spool.dir)
+			}
+			return
+		}
+		replayed++
+	}
+}
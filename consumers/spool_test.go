@@ -0,0 +1,192 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+//linesSink keeps what is written to it.
+
+type linesSink struct{ lines []string }
+
+func (s *linesSink) Write(p []byte) error { s.lines = append(s.lines, string(p)); return nil }
+func (s *linesSink) Flush() error         { return nil }
+func (s *linesSink) Close() error         { return nil }
+
+func newTestSpool(t *testing.T, max int64) *spool {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool(&SpoolInfo{Path: filepath.Join(dir, "spool"), Max_bytes: max})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSpoolReplaysBatchesInOrder(t *testing.T) {
+	s := newTestSpool(t, DefaultSpoolBytes)
+	defer os.RemoveAll(filepath.Dir(s.dir))
+
+	if err := s.put([][]byte{[]byte("one\n"), []byte("two\nlines\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put([][]byte{[]byte("three\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restarted worker finds the batches left behind
+	s, err := openSpool(&SpoolInfo{Path: s.dir, Max_bytes: DefaultSpoolBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.size == 0 {
+		t.Error("expected the size of the spooled batches counted on open")
+	}
+
+	sink := &linesSink{}
+	for {
+		ok, err := s.replay(sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+	}
+	if want := []string{"one\n", "two\nlines\n", "three\n"}; !reflect.DeepEqual(sink.lines, want) {
+		t.Errorf("expected %q, got %q", want, sink.lines)
+	}
+	if names, _ := s.batches(); len(names) != 0 || s.size != 0 {
+		t.Errorf("expected the spool empty after the replay, got %v and %d bytes", names, s.size)
+	}
+}
+
+func TestSpoolKeepsBatchWhenReplayFails(t *testing.T) {
+	s := newTestSpool(t, DefaultSpoolBytes)
+	defer os.RemoveAll(filepath.Dir(s.dir))
+
+	if err := s.put([][]byte{[]byte("one\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.replay(failingSink{}); err == nil {
+		t.Fatal("expected the sink error")
+	}
+	if names, _ := s.batches(); len(names) != 1 {
+		t.Errorf("expected the batch kept for the next attempt, got %v", names)
+	}
+}
+
+func TestSpoolMovesBadFileAside(t *testing.T) {
+	s := newTestSpool(t, DefaultSpoolBytes)
+	defer os.RemoveAll(filepath.Dir(s.dir))
+
+	if err := ioutil.WriteFile(filepath.Join(s.dir, "1"+SpoolSuffix), []byte{0x20, 'x'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.replay(&linesSink{}); err == nil {
+		t.Fatal("expected an error for the truncated file")
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "1"+SpoolSuffix+".bad")); err != nil {
+		t.Errorf("expected the file moved aside, got %v", err)
+	}
+	if ok, err := s.replay(&linesSink{}); ok || err != nil {
+		t.Errorf("expected the spool empty after moving the file aside, got %v and %v", ok, err)
+	}
+}
+
+func TestFlushSpoolsBatchHECRejects(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.HEC = &HECInfo{URL: "https://hec", Token: "secret"}
+	gcpinfo.Worker.Spool = &SpoolInfo{Retry_interval: 1}
+	gcpinfo.spool = newTestSpool(t, DefaultSpoolBytes)
+	defer os.RemoveAll(filepath.Dir(gcpinfo.spool.dir))
+	gcpinfo.sink = failingSink{}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")}, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatalf("expected the batch spooled, got %v", err)
+	}
+	if !reflect.DeepEqual(*acked, []string{"1", "2"}) || len(*nacked) != 0 {
+		t.Errorf("expected the spooled batch acked, got acked %v nacked %v", *acked, *nacked)
+	}
+
+	//HEC is back
+	sink := &linesSink{}
+	gcpinfo.sink = sink
+	gcpinfo.drain()
+	if want := []string{"one\n", "two\n"}; !reflect.DeepEqual(sink.lines, want) {
+		t.Errorf("expected the spool drained into the sink, got %q", sink.lines)
+	}
+}
+
+func TestFlushNacksWhenSpoolIsFull(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.HEC = &HECInfo{URL: "https://hec", Token: "secret"}
+	gcpinfo.spool = newTestSpool(t, 4)
+	defer os.RemoveAll(filepath.Dir(gcpinfo.spool.dir))
+	gcpinfo.sink = failingSink{}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); err == nil {
+		t.Fatal("expected the sink error once the spool is full")
+	}
+	if len(*acked) != 0 || !reflect.DeepEqual(*nacked, []string{"1"}) {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+}
+
+func TestFlushDoesNotSpoolFatalWriteErrors(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.Worker.HEC = &HECInfo{URL: "https://hec", Token: "secret"}
+	gcpinfo.spool = newTestSpool(t, DefaultSpoolBytes)
+	defer os.RemoveAll(filepath.Dir(gcpinfo.spool.dir))
+	gcpinfo.sink = diskFullSink{}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	if err := gcpinfo.Flush(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected ENOSPC, got %v", err)
+	}
+	if gcpinfo.fatal == nil {
+		t.Error("expected the fatal write error to stop the worker")
+	}
+	if len(*acked) != 0 || !reflect.DeepEqual(*nacked, []string{"1"}) {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if files, err := gcpinfo.spool.batches(); err != nil || len(files) != 0 {
+		t.Errorf("expected nothing spooled, got %v %v", files, err)
+	}
+}
+
+func TestNewGCPclientRejectsSpoolWithoutHEC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","subscription":"s","workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`","spool":{"path":"`+dir+`/spool"}}}`)
+	if _, err := NewGCPclient(configfile); err == nil || !strings.Contains(err.Error(), "workerinfo.spool needs workerinfo.hec") {
+		t.Errorf("expected an error for a spool without hec, got %v", err)
+	}
+}
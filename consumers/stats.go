@@ -0,0 +1,67 @@
+package consumers
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a worker for callers that embed the package, the in-process counterpart of the metrics
+// endpoint. The counters are cumulative since the worker was created, they count the same events as the metrics of
+// the same name.
+type Stats struct {
+	Received        uint64
+	Acked           uint64
+	Nacked          uint64
+	Flushes         uint64
+	BytesWritten    uint64
+	CurrentBatchLen int
+	LastFlushTime   time.Time //zero until a non-empty batch was flushed
+
+	//DeliveryAttempts counts received messages by delivery attempt, one count per AttemptBuckets bound and one for the
+	//rest. Only subscriptions with a dead-letter policy report attempts.
+	DeliveryAttempts   []uint64
+	MaxDeliveryAttempt int //highest delivery attempt seen, 0 until one was reported
+
+	MaxAckLatency time.Duration //longest a batch waited from its first message coming in to its acks, see observeAck
+}
+
+//counters back Stats. They are bumped next to the metrics, atomically so Stats needs no lock for them.
+
+type counters struct {
+	received     atomic.Uint64
+	acked        atomic.Uint64
+	nacked       atomic.Uint64
+	flushes      atomic.Uint64
+	bytesWritten atomic.Uint64
+	attempts     [len(AttemptBuckets) + 1]atomic.Uint64
+	maxAttempt   atomic.Int64
+
+	maxAckLatency atomic.Int64 //nanoseconds
+}
+
+// Stats returns what the worker has done so far. It is safe to call from any goroutine while Consume runs.
+func (gcpinfo *GCPInfo) Stats() Stats {
+	gcpinfo.mu.RLock()
+	batchLen, lastFlush := len(gcpinfo.batch), gcpinfo.lastFlush
+	gcpinfo.mu.RUnlock()
+
+	attempts := make([]uint64, len(AttemptBuckets)+1)
+	for i := range attempts {
+		attempts[i] = gcpinfo.counts.attempts[i].Load()
+	}
+
+	return Stats{
+		Received:        gcpinfo.counts.received.Load(),
+		Acked:           gcpinfo.counts.acked.Load(),
+		Nacked:          gcpinfo.counts.nacked.Load(),
+		Flushes:         gcpinfo.counts.flushes.Load(),
+		BytesWritten:    gcpinfo.counts.bytesWritten.Load(),
+		CurrentBatchLen: batchLen,
+		LastFlushTime:   lastFlush,
+
+		DeliveryAttempts:   attempts,
+		MaxDeliveryAttempt: int(gcpinfo.counts.maxAttempt.Load()),
+
+		MaxAckLatency: time.Duration(gcpinfo.counts.maxAckLatency.Load()),
+	}
+}
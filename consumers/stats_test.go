@@ -0,0 +1,37 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+	"os"
+	"testing"
+)
+
+func TestStatsCountsReceiveAndFlush(t *testing.T) {
+	_, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 2)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	fake := &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("one")},
+		{ID: "2", Data: []byte("two")},
+		{ID: "3", Data: []byte("three")},
+	}}
+	if err := gcpinfo.receive(context.Background(), fake, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := gcpinfo.Stats()
+	if stats.Received != 3 || stats.Acked != 3 || stats.Nacked != 0 {
+		t.Errorf("expected 3 received and acked, got %+v", stats)
+	}
+	//a full batch of 2 and the tail of 1
+	if stats.Flushes != 2 || stats.BytesWritten != uint64(len("one\ntwo\nthree\n")) {
+		t.Errorf("expected 2 flushes of 14 bytes, got %+v", stats)
+	}
+	if stats.CurrentBatchLen != 0 || stats.LastFlushTime.IsZero() {
+		t.Errorf("expected an empty batch and a last flush time, got %+v", stats)
+	}
+}
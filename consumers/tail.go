@@ -0,0 +1,124 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// TailExpiration is the expiration policy of the temporary subscription of tail_topic, the shortest pub/sub allows. A
+// worker that is killed before it can delete the subscription leaves it behind until then.
+const TailExpiration = 24 * time.Hour
+
+// TailDeleteTimeout bounds how long shutting down waits for pub/sub to delete the temporary subscription.
+var TailDeleteTimeout = 30 * time.Second
+
+//tailSuffix ends the topic name in the name of a temporary subscription, before a random part.
+
+const tailSuffix = "-tail-"
+
+//nameTail checks tail_topic and names the temporary subscription, in NewGCPclient before anything uses the
+//subscription name. The name is new on every start so two workers tailing a topic do not share its messages.
+
+func (gcpinfo *GCPInfo) nameTail() error {
+	if gcpinfo.Topic == "" {
+		return errors.New("ERROR: config field topic is required with tail_topic, the temporary subscription is created on it")
+	}
+	if gcpinfo.Subscription != "" {
+		return errors.New("ERROR: config field subscription cannot be combined with tail_topic, the temporary subscription is named after the topic")
+	}
+	if gcpinfo.Auto_create {
+		return errors.New("ERROR: config field auto_create_subscription cannot be combined with tail_topic, it always creates its subscription")
+	}
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	suffix := tailSuffix + hex.EncodeToString(random)
+	//subscription names are at most 255 characters, topic names as well
+	topic := gcpinfo.Topic
+	if len(topic) > 255-len(suffix) {
+		topic = topic[:255-len(suffix)]
+	}
+	gcpinfo.Subscription = topic + suffix
+	return nil
+}
+
+//newSubscriptionConfig is the config of a subscription the worker creates on topic, with ordering and exactly-once
+//delivery when the config asks for them so the checks after creating it pass.
+
+func (gcpinfo *GCPInfo) newSubscriptionConfig(topic *pubsub.Topic) pubsub.SubscriptionConfig {
+	return pubsub.SubscriptionConfig{
+		Topic:                     topic,
+		AckDeadline:               time.Duration(gcpinfo.Ack_deadline) * time.Second,
+		EnableMessageOrdering:     gcpinfo.Ordered,
+		EnableExactlyOnceDelivery: gcpinfo.Worker.Delivery_mode == ExactlyOnce,
+	}
+}
+
+//createTail creates the temporary subscription of tail_topic, once for all receive cycles. It only gets the messages
+//published from then on.
+
+func (gcpinfo *GCPInfo) createTail(ctx context.Context, client *pubsub.Client) error {
+	gcpinfo.tailMu.Lock()
+	defer gcpinfo.tailMu.Unlock()
+	if gcpinfo.tailing {
+		return nil
+	}
+
+	topic := client.Topic(gcpinfo.Topic)
+	if err := gcpinfo.checkExists(ctx, "topic", gcpinfo.Topic, topic.Exists); err != nil {
+		return err
+	}
+	config := gcpinfo.newSubscriptionConfig(topic)
+	config.ExpirationPolicy = TailExpiration
+	err := gcpinfo.retry(ctx, "create the temporary subscription", func() error {
+		_, err := client.CreateSubscription(ctx, gcpinfo.Subscription, config)
+		return err
+	})
+	if err != nil {
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to create temporary subscription %q on topic %q in project %q. Does the user have edit permissions", gcpinfo.Subscription, gcpinfo.Topic, gcpinfo.Project), err)
+	}
+	gcpinfo.tailing = true
+	gcpinfo.Worker.Worker_logger_info.Println("Created temporary subscription", gcpinfo.Subscription, "on topic", gcpinfo.Topic, "it is deleted on shutdown")
+	return nil
+}
+
+//deleteTail deletes the temporary subscription of tail_topic if there is one. Shutdown calls it before closing the
+//client, which covers a signal, and Run on its way out, which covers max_messages and a fatal error. A second call
+//waits for a delete in flight, so Run does not return while Shutdown is still deleting.
+
+func (gcpinfo *GCPInfo) deleteTail() error {
+	gcpinfo.tailMu.Lock()
+	defer gcpinfo.tailMu.Unlock()
+	if !gcpinfo.tailing {
+		return nil
+	}
+	gcpinfo.tailing = false
+
+	gcpinfo.mu.RLock()
+	client := gcpinfo.client
+	gcpinfo.mu.RUnlock()
+	if client == nil {
+		gcpinfo.Worker.Worker_logger_error.Println("WARNING: no pub/sub client left to delete temporary subscription", gcpinfo.Subscription, "pub/sub expires it after", TailExpiration)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TailDeleteTimeout)
+	defer cancel()
+	err := gcpinfo.retry(ctx, "delete the temporary subscription", func() error {
+		return client.Subscription(gcpinfo.Subscription).Delete(ctx)
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		gcpinfo.Worker.Worker_logger_error.Println("Unable to delete temporary subscription", gcpinfo.Subscription, "pub/sub expires it after", TailExpiration, ":", err)
+		return wrap(ErrSubscription, fmt.Sprintf("ERROR: Unable to delete temporary subscription %q in project %q", gcpinfo.Subscription, gcpinfo.Project), err)
+	}
+	gcpinfo.Worker.Worker_logger_info.Println("Deleted temporary subscription", gcpinfo.Subscription)
+	return nil
+}
@@ -0,0 +1,77 @@
+package consumers
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNameTail(t *testing.T) {
+	gcpinfo := &GCPInfo{Topic: "events", Tail_topic: true}
+	if err := gcpinfo.nameTail(); err != nil {
+		t.Fatal(err)
+	}
+	first := gcpinfo.Subscription
+	if !strings.HasPrefix(first, "events"+tailSuffix) || len(first) != len("events"+tailSuffix)+8 {
+		t.Errorf("expected events%s and 8 hex digits, got %q", tailSuffix, first)
+	}
+	gcpinfo.Subscription = ""
+	if err := gcpinfo.nameTail(); err != nil || gcpinfo.Subscription == first {
+		t.Errorf("expected a new name on every start, got %q twice %v", first, err)
+	}
+
+	gcpinfo = &GCPInfo{Topic: strings.Repeat("t", 255), Tail_topic: true}
+	if err := gcpinfo.nameTail(); err != nil || len(gcpinfo.Subscription) != 255 {
+		t.Errorf("expected the name cut to 255 characters, got %d %v", len(gcpinfo.Subscription), err)
+	}
+
+	for _, bad := range []*GCPInfo{
+		{Tail_topic: true},
+		{Topic: "events", Subscription: "s", Tail_topic: true},
+		{Topic: "events", Auto_create: true, Tail_topic: true},
+	} {
+		if err := bad.nameTail(); err == nil {
+			t.Errorf("expected tail_topic rejected for %+v", bad)
+		}
+	}
+}
+
+func TestNewGCPclientTailTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configfile := writeTestConfig(t, dir, `{"project":"p","topic":"events","tail_topic":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	gcpinfo, err := NewGCPclient(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcpinfo.Shutdown(context.Background())
+	if _, err = os.Stat(dir + "/" + gcpinfo.Subscription + ".log"); !strings.HasPrefix(gcpinfo.Subscription, "events"+tailSuffix) || err != nil {
+		t.Errorf("expected the message log named after the temporary subscription, got %q %v", gcpinfo.Subscription, err)
+	}
+
+	configfile = writeTestConfig(t, dir, `{"project":"p","subscription":"s","topic":"events","tail_topic":true,"workerinfo":{"messagelogpath":"`+dir+`","workerlogpath":"`+dir+`"}}`)
+	if _, err = NewGCPclient(configfile); !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "tail_topic") {
+		t.Errorf("expected tail_topic with a subscription rejected, got %v", err)
+	}
+}
+
+func TestDeleteTailWithoutSubscription(t *testing.T) {
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+
+	if err := gcpinfo.deleteTail(); err != nil {
+		t.Errorf("expected nothing to delete, got %v", err)
+	}
+	//a subscription created without a client left, e.g. after closeClient, is left to its expiration policy
+	gcpinfo.tailing = true
+	if err := gcpinfo.deleteTail(); err != nil || gcpinfo.tailing {
+		t.Errorf("expected the subscription given up on, got %v tailing %v", err, gcpinfo.tailing)
+	}
+}
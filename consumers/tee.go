@@ -0,0 +1,141 @@
+package consumers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Types of a workerinfo.tee entry.
+const (
+	TeeStdout = "stdout"
+	TeeStderr = "stderr"
+	TeeFile   = "file"
+)
+
+// TeeInfo is one extra sink of workerinfo.tee. Each batch goes to the message log, or HEC or the fifo, and to every
+// tee sink, and is only acked once all of them took it. A batch one of them fails is nacked as a whole, also where the
+// others took it already, and comes back through pub/sub: a sink can see the events of a nacked batch twice.
+type TeeInfo struct {
+	Type string `json:"type" yaml:"type"`                     //stdout, stderr or file, see TeeStdout
+	Path string `json:"path,omitempty" yaml:"path,omitempty"` //file to append to for type file, created on startup
+}
+
+//checkTee checks workerinfo.tee. The spool would replay a batch into every sink, also the ones that took it.
+
+func (worker *WorkerInfo) checkTee() error {
+	if len(worker.Tee) > 0 && worker.Spool != nil {
+		return errors.New("ERROR: config field workerinfo.tee does not go with workerinfo.spool")
+	}
+	for i, tee := range worker.Tee {
+		switch tee.Type {
+		case TeeStdout, TeeStderr:
+		case TeeFile:
+			if tee.Path == "" {
+				return fmt.Errorf("ERROR: config field workerinfo.tee[%d].path is required for type file", i)
+			}
+		default:
+			return fmt.Errorf("ERROR: config field workerinfo.tee[%d].type %q must be %s, %s or %s", i, tee.Type, TeeStdout, TeeStderr, TeeFile)
+		}
+	}
+	return nil
+}
+
+//openTee opens the tee sinks and puts them behind primary.
+
+func (worker *WorkerInfo) openTee(primary Sink) (Sink, error) {
+	sinks := []Sink{primary}
+	names := []string{"primary"}
+	for _, tee := range worker.Tee {
+		var sink Sink
+		switch tee.Type {
+		case TeeStdout:
+			sink = newStreamSink(os.Stdout)
+		case TeeStderr:
+			sink = newStreamSink(os.Stderr)
+		default:
+			if err := createMessageLog(filepath.Dir(tee.Path), filepath.Base(tee.Path), worker.Dirmode, worker.Filemode); err != nil {
+				closeAll(sinks)
+				return nil, err
+			}
+			file, err := NewFileSink(tee.Path)
+			if err != nil {
+				closeAll(sinks)
+				return nil, err
+			}
+			sink = file
+		}
+		sinks = append(sinks, sink)
+		names = append(names, strings.TrimSpace(tee.Type+" "+tee.Path))
+	}
+	return &teeSink{sinks: sinks, names: names}, nil
+}
+
+//newStreamSink is a FileSink on stdout or stderr, closing it leaves the stream open.
+
+func newStreamSink(stream *os.File) *FileSink {
+	writer := bufio.NewWriter(stream)
+	return &FileSink{file: nopCloser{stream}, writer: writer, out: writer}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func closeAll(sinks []Sink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
+
+//teeSink writes every event to all of sinks. Flush flushes each of them even after one failed, so no sink keeps half
+//a batch buffered into the next one, and fails when any of them did.
+
+type teeSink struct {
+	sinks []Sink
+	names []string //what the errors call each sink
+}
+
+func (s *teeSink) Write(p []byte) error {
+	for i, sink := range s.sinks {
+		if err := sink.Write(p); err != nil {
+			return fmt.Errorf("tee %s: %w", s.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (s *teeSink) Flush() error {
+	var first error
+	for i, sink := range s.sinks {
+		if err := sink.Flush(); err != nil && first == nil {
+			first = fmt.Errorf("tee %s: %w", s.names[i], err)
+		}
+	}
+	return first
+}
+
+func (s *teeSink) Close() error {
+	var first error
+	for i, sink := range s.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = fmt.Errorf("tee %s: %w", s.names[i], err)
+		}
+	}
+	return first
+}
+
+//gone passes a vanished message log through, reopenIfGone then reopens the tee with it.
+
+func (s *teeSink) gone() bool {
+	v, ok := s.sinks[0].(vanishing)
+	return ok && v.gone()
+}
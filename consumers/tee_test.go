@@ -0,0 +1,77 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlushWritesToTee(t *testing.T) {
+	acked, _, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	path := gcpinfo.Worker.Message_log_path + "/tee/copy.log"
+	gcpinfo.Worker.Tee = []TeeInfo{{Type: TeeFile, Path: path}}
+	if err := gcpinfo.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")}, &pubsub.Message{ID: "2", Data: []byte("two")})
+	if err := gcpinfo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readMessageLog(t, gcpinfo); !reflect.DeepEqual(lines, []string{"one", "two"}) {
+		t.Errorf("expected the batch in the message log, got %q", lines)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "one\ntwo\n" {
+		t.Errorf("expected the batch in the tee file, got %q %v", content, err)
+	}
+	if len(*acked) != 2 {
+		t.Errorf("expected the batch acked, got %v", *acked)
+	}
+}
+
+func TestFlushNacksWhenOneTeeSinkFails(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 3)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	var events []string
+	gcpinfo.sink = &teeSink{sinks: []Sink{failingSink{}, eventSink{&events}}, names: []string{"primary", "stdout"}}
+
+	gcpinfo.batch = append(gcpinfo.batch, &pubsub.Message{ID: "1", Data: []byte("one")})
+	err := gcpinfo.Flush()
+	if err == nil || !strings.Contains(err.Error(), "tee primary") {
+		t.Fatalf("expected the failing sink named in the error, got %v", err)
+	}
+	if len(*acked) != 0 || len(*nacked) != 1 {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	//the sink that took the batch is still flushed, it must not carry it into the next one
+	if !reflect.DeepEqual(events, []string{"write", "flush"}) {
+		t.Errorf("expected the other sink written and flushed, got %v", events)
+	}
+}
+
+func TestCheckTee(t *testing.T) {
+	bad := []WorkerInfo{
+		{Tee: []TeeInfo{{Type: "syslog"}}},
+		{Tee: []TeeInfo{{Type: TeeFile}}},
+		{Tee: []TeeInfo{{Type: TeeStdout}}, Spool: &SpoolInfo{Path: "/tmp"}},
+	}
+	for _, worker := range bad {
+		if err := worker.checkTee(); err == nil {
+			t.Errorf("expected tee %+v to be rejected", worker.Tee)
+		}
+	}
+	worker := WorkerInfo{Tee: []TeeInfo{{Type: TeeStdout}, {Type: TeeFile, Path: "/var/log/copy.log"}}}
+	if err := worker.checkTee(); err != nil {
+		t.Errorf("expected a stdout and a file tee to pass, got %v", err)
+	}
+}
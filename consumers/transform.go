@@ -0,0 +1,132 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+//transforms are the TransformFunc values that can be picked by name with the transform config field.
+
+var transforms = map[string]func(gcpinfo *GCPInfo) func(msg *pubsub.Message) ([]byte, error){
+	"envelope": func(gcpinfo *GCPInfo) func(msg *pubsub.Message) ([]byte, error) {
+		return envelopeTransform(gcpinfo.Subscription, gcpinfo.attributeFilter())
+	},
+	"attributes": func(gcpinfo *GCPInfo) func(msg *pubsub.Message) ([]byte, error) {
+		keep := gcpinfo.attributeFilter()
+		return func(msg *pubsub.Message) ([]byte, error) {
+			return attributesTransform(msg, keep)
+		}
+	},
+}
+
+//checkAttributeLists checks attribute_allowlist and attribute_denylist, they only apply to the transforms that write
+//attributes.
+
+func (gcpinfo *GCPInfo) checkAttributeLists() error {
+	if len(gcpinfo.Attr_allow) == 0 && len(gcpinfo.Attr_deny) == 0 {
+		return nil
+	}
+	if gcpinfo.Transform != "attributes" && gcpinfo.Transform != "envelope" {
+		return errors.New("ERROR: config fields attribute_allowlist and attribute_denylist need include_attributes or transform attributes or envelope")
+	}
+	return nil
+}
+
+//attributeFilter returns what drops the attributes attribute_allowlist and attribute_denylist do not let through,
+//nil when neither is set. With both set only the allowlist applies. The attributes are copied, the message keeps its
+//own.
+
+func (gcpinfo *GCPInfo) attributeFilter() func(attributes map[string]string) map[string]string {
+	keys, allow := gcpinfo.Attr_deny, false
+	if len(gcpinfo.Attr_allow) > 0 {
+		keys, allow = gcpinfo.Attr_allow, true
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
+	}
+	return func(attributes map[string]string) map[string]string {
+		kept := make(map[string]string, len(attributes))
+		for key, value := range attributes {
+			if listed[key] == allow {
+				kept[key] = value
+			}
+		}
+		return kept
+	}
+}
+
+type envelope struct {
+	Subscription string            `json:"subscription"`
+	PublishTime  time.Time         `json:"publishTime"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Data         json.RawMessage   `json:"data"`
+}
+
+// EnvelopeTransform wraps each payload in a json object with the subscription, publish time and attributes.
+// A json payload is embedded as is, anything else becomes a json string.
+func EnvelopeTransform(subscription string) func(msg *pubsub.Message) ([]byte, error) {
+	return envelopeTransform(subscription, nil)
+}
+
+//envelopeTransform is EnvelopeTransform with the attributes passed through keep first, unless it is nil.
+
+func envelopeTransform(subscription string, keep func(map[string]string) map[string]string) func(msg *pubsub.Message) ([]byte, error) {
+	return func(msg *pubsub.Message) ([]byte, error) {
+		data, err := jsonOrString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		attributes := msg.Attributes
+		if keep != nil {
+			attributes = keep(attributes)
+		}
+		return json.Marshal(envelope{
+			Subscription: subscription,
+			PublishTime:  msg.PublishTime,
+			Attributes:   attributes,
+			Data:         data,
+		})
+	}
+}
+
+func jsonOrString(data []byte) (json.RawMessage, error) {
+	if json.Valid(data) {
+		return json.RawMessage(data), nil
+	}
+	return json.Marshal(string(data))
+}
+
+type attributesLine struct {
+	Attributes map[string]string `json:"attributes"`
+	Data       json.RawMessage   `json:"data"`
+}
+
+// AttributesTransform writes the message attributes next to the payload. This is what include_attributes turns on, with
+// attribute_allowlist or attribute_denylist applied. encoding/json writes map keys sorted, so lines are stable for
+// diffs and tests.
+func AttributesTransform(msg *pubsub.Message) ([]byte, error) {
+	return attributesTransform(msg, nil)
+}
+
+//attributesTransform is AttributesTransform with the attributes passed through keep first, unless it is nil.
+
+func attributesTransform(msg *pubsub.Message, keep func(map[string]string) map[string]string) ([]byte, error) {
+	data, err := jsonOrString(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	attributes := msg.Attributes
+	if keep != nil {
+		attributes = keep(attributes)
+	}
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	return json.Marshal(attributesLine{Attributes: attributes, Data: data})
+}
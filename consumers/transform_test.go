@@ -0,0 +1,132 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeTransform(t *testing.T) {
+	transform := EnvelopeTransform(subscription)
+	published := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	out, err := transform(&pubsub.Message{
+		Data:        []byte(`{"user":"a"}`),
+		PublishTime: published,
+		Attributes:  map[string]string{"type": "login"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"subscription":"` + subscription + `","publishTime":"2020-01-02T03:04:05Z","attributes":{"type":"login"},"data":{"user":"a"}}`
+	if string(out) != want {
+		t.Errorf("unexpected envelope\n got %s\nwant %s", out, want)
+	}
+
+	out, err = transform(&pubsub.Message{Data: []byte("plain text"), PublishTime: published})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"subscription":"` + subscription + `","publishTime":"2020-01-02T03:04:05Z","data":"plain text"}`
+	if string(out) != want {
+		t.Errorf("unexpected envelope\n got %s\nwant %s", out, want)
+	}
+}
+
+func TestAttributesTransform(t *testing.T) {
+	out, err := AttributesTransform(&pubsub.Message{
+		Data:       []byte(`{"user":"a"}`),
+		Attributes: map[string]string{"source": "host1", "eventType": "login", "app": "box"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"attributes":{"app":"box","eventType":"login","source":"host1"},"data":{"user":"a"}}`
+	if string(out) != want {
+		t.Errorf("unexpected line\n got %s\nwant %s", out, want)
+	}
+
+	out, err = AttributesTransform(&pubsub.Message{Data: []byte("not json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"attributes":{},"data":"not json"}`
+	if string(out) != want {
+		t.Errorf("unexpected line\n got %s\nwant %s", out, want)
+	}
+}
+
+func TestAttributeLists(t *testing.T) {
+	msg := &pubsub.Message{
+		Data:       []byte(`{"user":"a"}`),
+		Attributes: map[string]string{"source": "host1", "eventType": "login", "googclient_schemaencoding": "JSON", "app": "box"},
+	}
+	cases := []struct {
+		allow, deny []string
+		want        string
+	}{
+		{nil, nil, `{"app":"box","eventType":"login","googclient_schemaencoding":"JSON","source":"host1"}`},
+		{[]string{"source", "app", "missing"}, nil, `{"app":"box","source":"host1"}`},
+		{nil, []string{"googclient_schemaencoding"}, `{"app":"box","eventType":"login","source":"host1"}`},
+		//the allowlist wins when both are set
+		{[]string{"eventType"}, []string{"eventType", "app"}, `{"eventType":"login"}`},
+	}
+	for _, c := range cases {
+		gcpinfo := &GCPInfo{Subscription: subscription, Transform: "attributes", Attr_allow: c.allow, Attr_deny: c.deny}
+		out, err := transforms["attributes"](gcpinfo)(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"attributes":` + c.want + `,"data":{"user":"a"}}`; string(out) != want {
+			t.Errorf("allowlist %v denylist %v: unexpected line\n got %s\nwant %s", c.allow, c.deny, out, want)
+		}
+
+		gcpinfo.Transform = "envelope"
+		out, err = transforms["envelope"](gcpinfo)(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `"attributes":` + c.want + `,"data"`; !strings.Contains(string(out), want) {
+			t.Errorf("allowlist %v denylist %v: expected %s in the envelope, got %s", c.allow, c.deny, want, out)
+		}
+	}
+	if len(msg.Attributes) != 4 {
+		t.Errorf("expected the message to keep its attributes, got %v", msg.Attributes)
+	}
+
+	if err := (&GCPInfo{Attr_deny: []string{"app"}}).checkAttributeLists(); err == nil {
+		t.Error("expected attribute_denylist rejected without a transform that writes attributes")
+	}
+}
+
+func TestFlushNacksFailedTransform(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 5)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.TransformFunc = func(msg *pubsub.Message) ([]byte, error) {
+		if msg.ID == "bad" {
+			return nil, errors.New("cannot transform")
+		}
+		return append([]byte("t:"), msg.Data...), nil
+	}
+
+	if err := gcpinfo.receive(context.Background(), &fakeReceiver{msgs: []*pubsub.Message{
+		{ID: "good", Data: []byte("one")},
+		{ID: "bad", Data: []byte("two")},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*acked) != 1 || (*acked)[0] != "good" || len(*nacked) != 1 || (*nacked)[0] != "bad" {
+		t.Errorf("expected only the failed transform nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if lines := readMessageLog(t, gcpinfo); len(lines) != 1 || lines[0] != "t:one" {
+		t.Errorf("expected only the transformed message written, got %q", lines)
+	}
+}
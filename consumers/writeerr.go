@@ -0,0 +1,43 @@
+package consumers
+
+import (
+	"errors"
+	"syscall"
+)
+
+//fatalErrnos are write errors a redelivery cannot fix: the disk is full or over quota, the file system went read-only,
+//the file can no longer be written. Retrying them only nacks the same batch over and over. Anything else, e.g. EINTR,
+//EAGAIN or a HEC post that failed, is taken as transient and the batch is nacked for another try.
+
+var fatalErrnos = map[syscall.Errno]bool{
+	syscall.ENOSPC: true,
+	syscall.EDQUOT: true,
+	syscall.EROFS:  true,
+	syscall.EBADF:  true,
+	syscall.EFBIG:  true,
+	syscall.EACCES: true,
+	syscall.EPERM:  true,
+}
+
+//fatalWrite reports whether a failed flush of the sink is one that will fail again on redelivery.
+
+func fatalWrite(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && fatalErrnos[errno]
+}
+
+//stopOnFatal stops the worker after a flush failed with a fatal write error. The batch is nacked already, the receive
+//cycle is cancelled so nothing more is pulled in, and receive returns ErrWriteFatal so Run ends and the supervisor, and
+//error_reporting, see why. Callers hold mu.
+
+func (gcpinfo *GCPInfo) stopOnFatal(err error) {
+	if gcpinfo.fatal != nil {
+		return
+	}
+	gcpinfo.fatal = err
+	gcpinfo.Worker.Worker_logger_error.Println("Writing the message log failed in a way a retry cannot fix, stopping GCP Receiver:", err)
+	gcpinfo.stopping = true
+	if gcpinfo.cancel != nil {
+		gcpinfo.cancel()
+	}
+}
@@ -0,0 +1,64 @@
+package consumers
+
+import (
+	"cloud.google.com/go/pubsub"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+	"testing"
+)
+
+//diskFullSink fails every flush the way a FileSink on a full disk does.
+
+type diskFullSink struct{}
+
+func (diskFullSink) Write(p []byte) error { return nil }
+func (diskFullSink) Flush() error {
+	return &os.PathError{Op: "write", Path: "/var/log/sub.log", Err: syscall.ENOSPC}
+}
+func (diskFullSink) Close() error { return nil }
+
+func TestFatalWrite(t *testing.T) {
+	fatal := []error{
+		&os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC},
+		fmt.Errorf("tee primary: %w", &os.PathError{Op: "write", Path: "f", Err: syscall.EROFS}),
+	}
+	for _, err := range fatal {
+		if !fatalWrite(err) {
+			t.Errorf("expected %v to be fatal", err)
+		}
+	}
+	transient := []error{
+		&os.PathError{Op: "write", Path: "f", Err: syscall.EINTR},
+		errors.New("HEC returned 503"),
+		wrap(ErrDiskLow, "", nil),
+	}
+	for _, err := range transient {
+		if fatalWrite(err) {
+			t.Errorf("expected %v to be transient", err)
+		}
+	}
+}
+
+func TestConsumeStopsOnDiskFull(t *testing.T) {
+	acked, nacked, restore := recordAcks()
+	defer restore()
+
+	gcpinfo := newTestGCPInfo(t, 1)
+	defer os.RemoveAll(gcpinfo.Worker.Message_log_path)
+	gcpinfo.sink = diskFullSink{}
+	gcpinfo.receiver = &fakeReceiver{msgs: []*pubsub.Message{{ID: "1", Data: []byte("one")}}, wait: true}
+
+	err := gcpinfo.Consume(context.Background())
+	if !errors.Is(err, ErrWriteFatal) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected Consume to stop with ErrWriteFatal on ENOSPC, got %v", err)
+	}
+	if len(*acked) != 0 || len(*nacked) != 1 {
+		t.Errorf("expected the batch nacked, got acked %v nacked %v", *acked, *nacked)
+	}
+	if !gcpinfo.isStopping() {
+		t.Error("expected the worker to be stopping so Run does not start another cycle")
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Counters and histograms for the log workers, served in the prometheus text format so they can be scraped.
+Kept to the handful of types the workers need instead of pulling in the full prometheus client.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+//every series is labelled with the subscription (or queue) the worker reads from, so one process can run many workers.
+
+const label = "subscription"
+
+var (
+	MessagesReceived = NewCounter("logworker_messages_received_total", "Messages handed to the worker by the receiver.")
+	MessagesAcked    = NewCounter("logworker_messages_acked_total", "Messages acked after a successful flush.")
+	MessagesNacked   = NewCounter("logworker_messages_nacked_total", "Messages nacked because their flush failed.")
+	MessagesDropped  = NewCounter("logworker_messages_dropped_total", "Messages acked on receive in at_most_once mode whose flush failed.")
+	MessagesFiltered = NewCounter("logworker_messages_filtered_total", "Messages acked without writing because they did not match the filter.")
+	MessagesDeduped  = NewCounter("logworker_messages_deduped_total", "Redelivered messages acked without writing because they were already written.")
+	BytesWritten     = NewCounter("logworker_bytes_written_total", "Payload bytes written to the message log.")
+	Flushes          = NewCounter("logworker_flushes_total", "Batches flushed to the message log.")
+	FlushFailures    = NewCounter("logworker_flush_failures_total", "Batches whose write or flush failed.")
+	FlushDuration    = NewHistogram("logworker_flush_duration_seconds", "Time taken to write, flush and ack a batch.",
+		[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+	DeliveryAttempts = NewHistogram("logworker_delivery_attempts", "Delivery attempt of each received message, on subscriptions with a dead-letter policy.",
+		[]float64{1, 2, 3, 5, 10, 20, 50, 100})
+	AckDuration = NewHistogram("logworker_ack_duration_seconds", "Time taken to ack a batch once it is flushed.",
+		[]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5})
+)
+
+//registry holds everything Handler serves, in registration order.
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+func register(c collector) {
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+}
+
+// Counter is a monotonically increasing value per subscription.
+type Counter struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounter creates a counter and registers it with Handler.
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help, values: map[string]uint64{}}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(subscription string) {
+	c.Add(subscription, 1)
+}
+
+func (c *Counter) Add(subscription string, n uint64) {
+	c.mu.Lock()
+	c.values[subscription] += n
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value(subscription string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[subscription]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, sub := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, label, sub, c.values[sub])
+	}
+}
+
+// Histogram counts observations into cumulative buckets per subscription.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 //one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds, in increasing order, and registers it with Handler.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(subscription string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[subscription]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[subscription] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	subs := make([]string, 0, len(h.series))
+	for sub := range h.series {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	for _, sub := range subs {
+		s := h.series[sub]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", h.name, label, sub, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, label, sub, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, label, sub, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, label, sub, s.count)
+	}
+}
+
+// Handler serves every registered metric in the prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for _, c := range registry {
+			c.write(w)
+		}
+	})
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServesTextFormat(t *testing.T) {
+	c := NewCounter("test_events_total", "Events seen by the test.")
+	c.Inc("subA")
+	c.Add("subA", 2)
+
+	h := NewHistogram("test_latency_seconds", "Latency seen by the test.", []float64{0.1, 1})
+	h.Observe("subA", 0.05)
+	h.Observe("subA", 0.5)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"# TYPE test_events_total counter",
+		`test_events_total{subscription="subA"} 3`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{subscription="subA",le="0.1"} 1`,
+		`test_latency_seconds_bucket{subscription="subA",le="1"} 2`,
+		`test_latency_seconds_bucket{subscription="subA",le="+Inf"} 2`,
+		`test_latency_seconds_count{subscription="subA"} 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %q in output:\n%s", want, body)
+		}
+	}
+}